@@ -0,0 +1,49 @@
+// Package blob stores binary objects such as posters under string keys.
+// Keys are slash separated paths, e.g. "posters/42.jpg"
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("blob not found")
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+type Info struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ETag        string //Changes whenever content changes, without quotes
+	ContentType string
+}
+
+type Store interface {
+	// Put stores content under the key, replacing previous content. Readers never see partial content
+	Put(ctx context.Context, key string, r io.Reader, contentType string) (Info, error)
+	// Get returns content of the key. Caller must close the reader
+	Get(ctx context.Context, key string) (io.ReadCloser, Info, error)
+	// Delete removes the key. Deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (Info, error)
+	// List returns blobs whose keys start with prefix, sorted by key
+	List(ctx context.Context, prefix string) ([]Info, error)
+}
+
+// ValidKey reports whether key is a clean relative path
+func ValidKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,257 @@
+package blob
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Local keeps blobs on disk in a content-addressed layout:
+//
+//	objects/ab/abcdef... content named by its SHA-256, shared by keys with equal content
+//	refs/<key>           small file with the content hash and content type of the key
+//
+// Both are written to a temporary file first and renamed, so updates are atomic.
+// Objects left without refs are removed by Prune
+type Local struct {
+	Root string
+}
+
+// NewLocal creates the directory layout. Root is made absolute so later changes of the
+// working directory don't affect the store
+func NewLocal(root string) (*Local, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{"objects", "refs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(abs, dir), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &Local{Root: abs}, nil
+}
+
+func (l *Local) refPath(key string) string {
+	return filepath.Join(l.Root, "refs", filepath.FromSlash(key))
+}
+
+func (l *Local) objectPath(hash string) string {
+	return filepath.Join(l.Root, "objects", hash[:2], hash)
+}
+
+// writeAtomic writes data from r to path through a temporary file
+func (l *Local) writeAtomic(path string, r io.Reader) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(l.Root, "tmp"), "blob-*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return n, err
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, contentType string) (Info, error) {
+	if !ValidKey(key) {
+		return Info{}, ErrInvalidKey
+	}
+	tmp, err := os.CreateTemp(filepath.Join(l.Root, "tmp"), "blob-*")
+	if err != nil {
+		return Info{}, err
+	}
+	defer os.Remove(tmp.Name())
+	sum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, sum), r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	hash := hex.EncodeToString(sum.Sum(nil))
+	object := l.objectPath(hash)
+	if _, err := os.Stat(object); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(object), 0o755); err != nil {
+			return Info{}, err
+		}
+		if err := os.Rename(tmp.Name(), object); err != nil {
+			return Info{}, err
+		}
+	} else {
+		//Fresh modification time keeps Prune away from the object until the ref is written
+		now := time.Now()
+		if err := os.Chtimes(object, now, now); err != nil {
+			return Info{}, err
+		}
+	}
+	if _, err := l.writeAtomic(l.refPath(key), strings.NewReader(hash+"\n"+contentType+"\n")); err != nil {
+		return Info{}, err
+	}
+	return l.Stat(ctx, key)
+}
+
+// readRef returns content hash and content type of the key
+func (l *Local) readRef(key string) (string, string, os.FileInfo, error) {
+	if !ValidKey(key) {
+		return "", "", nil, ErrInvalidKey
+	}
+	f, err := os.Open(l.refPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", nil, ErrNotFound
+		}
+		return "", "", nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", "", nil, err
+	}
+	if info.IsDir() {
+		return "", "", nil, ErrNotFound
+	}
+	s := bufio.NewScanner(f)
+	var lines []string
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if len(lines) < 2 || len(lines[0]) != sha256.Size*2 {
+		return "", "", nil, ErrNotFound
+	}
+	return lines[0], lines[1], info, s.Err()
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (Info, error) {
+	hash, contentType, refInfo, err := l.readRef(key)
+	if err != nil {
+		return Info{}, err
+	}
+	objInfo, err := os.Stat(l.objectPath(hash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Info{}, ErrNotFound
+		}
+		return Info{}, err
+	}
+	return Info{Key: key, Size: objInfo.Size(), ModTime: refInfo.ModTime(), ETag: hash, ContentType: contentType}, nil
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, Info, error) {
+	info, err := l.Stat(ctx, key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	f, err := os.Open(l.objectPath(info.ETag))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, Info{}, ErrNotFound
+		}
+		return nil, Info{}, err
+	}
+	return f, info, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	if err := os.Remove(l.refPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string) ([]Info, error) {
+	refs := filepath.Join(l.Root, "refs")
+	list := []Info{}
+	err := filepath.WalkDir(refs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(refs, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := l.Stat(ctx, key)
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		list = append(list, info)
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, err
+}
+
+// pruneGrace protects objects of Put calls that haven't written their ref yet
+const pruneGrace time.Duration = time.Hour
+
+// Prune removes objects no key refers to and returns how many were removed
+func (l *Local) Prune(ctx context.Context) (int, error) {
+	used := map[string]bool{}
+	refs := filepath.Join(l.Root, "refs")
+	err := filepath.WalkDir(refs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(refs, path)
+		if hash, _, _, err := l.readRef(filepath.ToSlash(rel)); err == nil {
+			used[hash] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	err = filepath.WalkDir(filepath.Join(l.Root, "objects"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || used[d.Name()] {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) < pruneGrace {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,163 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore runs the behaviour shared by all Store implementations
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	put := func(key, content string) Info {
+		t.Helper()
+		info, err := s.Put(ctx, key, strings.NewReader(content), "text/plain")
+		if err != nil {
+			t.Fatalf("Put(%s): %s", key, err)
+		}
+		return info
+	}
+	a := put("posters/1.jpg", "first")
+	if a.Key != "posters/1.jpg" || a.Size != 5 || a.ETag == "" || a.ContentType != "text/plain" {
+		t.Errorf("Put() info = %+v", a)
+	}
+	put("posters/2.jpg", "first")
+	put("media/1/a.jpg", "other")
+
+	r, info, err := s.Get(ctx, "posters/1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "first" || info.ETag != a.ETag {
+		t.Errorf("Get() = %q, %+v", data, info)
+	}
+
+	b := put("posters/1.jpg", "replaced")
+	if b.ETag == a.ETag {
+		t.Errorf("ETag did not change after replace")
+	}
+	if info, err := s.Stat(ctx, "posters/2.jpg"); err != nil || info.Size != 5 {
+		t.Errorf("Stat() of key sharing old content = %+v, %v", info, err)
+	}
+
+	list, err := s.List(ctx, "posters/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Key != "posters/1.jpg" || list[1].Key != "posters/2.jpg" {
+		t.Errorf("List() = %+v", list)
+	}
+
+	if err := s.Delete(ctx, "posters/1.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "posters/1.jpg"); err != nil {
+		t.Errorf("Delete() of missing key = %v", err)
+	}
+	if _, err := s.Stat(ctx, "posters/1.jpg"); err != ErrNotFound {
+		t.Errorf("Stat() after delete = %v, want ErrNotFound", err)
+	}
+	if _, _, err := s.Get(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("Get() of missing key = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Put(ctx, "../escape", strings.NewReader("x"), ""); err != ErrInvalidKey {
+		t.Errorf("Put() of invalid key = %v, want ErrInvalidKey", err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, l)
+}
+
+func TestLocalDedupe(t *testing.T) {
+	ctx := context.Background()
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := l.Put(ctx, "a", strings.NewReader("same"), "")
+	b, _ := l.Put(ctx, "b", strings.NewReader("same"), "")
+	if a.ETag != b.ETag {
+		t.Errorf("ETags of equal content differ: %s, %s", a.ETag, b.ETag)
+	}
+	objects, _ := filepath.Glob(filepath.Join(l.Root, "objects", "*", "*"))
+	if len(objects) != 1 {
+		t.Errorf("objects = %v, want one", objects)
+	}
+}
+
+func TestLocalPrune(t *testing.T) {
+	ctx := context.Background()
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, _ := l.Put(ctx, "kept", strings.NewReader("kept"), "")
+	old, _ := l.Put(ctx, "old", strings.NewReader("old"), "")
+	fresh, _ := l.Put(ctx, "fresh", strings.NewReader("fresh"), "")
+	l.Delete(ctx, "old")
+	l.Delete(ctx, "fresh")
+	past := time.Now().Add(-2 * pruneGrace)
+	for _, info := range []Info{kept, old} {
+		os.Chtimes(l.objectPath(info.ETag), past, past)
+	}
+
+	removed, err := l.Prune(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("Prune() = %d, want 1", removed)
+	}
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{name: "Referenced", hash: kept.ETag, want: true},
+		{name: "Unreferenced", hash: old.ETag, want: false},
+		{name: "Within grace period", hash: fresh.ETag, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := os.Stat(l.objectPath(tt.hash))
+			if got := err == nil; got != tt.want {
+				t.Errorf("object exists = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "posters/1.jpg", want: true},
+		{key: "a", want: true},
+		{key: "", want: false},
+		{key: "/abs", want: false},
+		{key: "dir/", want: false},
+		{key: "a//b", want: false},
+		{key: "a/../b", want: false},
+		{key: "./a", want: false},
+		{key: `a\b`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := ValidKey(tt.key); got != tt.want {
+				t.Errorf("ValidKey(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 stores blobs in a bucket of an S3 compatible service. Requests use path-style
+// addressing (endpoint/bucket/key), which AWS, MinIO and most other services accept
+type S3 struct {
+	Endpoint  string //e.g. https://s3.eu-central-1.amazonaws.com
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+	now       func() time.Time
+}
+
+const emptyPayloadHash string = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+func (s *S3) objectURL(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.TrimSuffix(s.Endpoint, "/") + "/" + url.PathEscape(s.Bucket) + "/" + strings.Join(parts, "/")
+}
+
+// do signs and sends the request. body may be nil
+func (s *S3) do(ctx context.Context, method, rawURL string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	sign(req, body, s.AccessKey, s.SecretKey, s.Region, now())
+	return s.client().Do(req)
+}
+
+// s3Error turns unexpected response into an error, reading the service message
+func s3Error(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func infoFromHeader(key string, h http.Header) Info {
+	info := Info{Key: key, ETag: strings.Trim(h.Get("ETag"), `"`), ContentType: h.Get("Content-Type")}
+	info.Size, _ = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = http.ParseTime(h.Get("Last-Modified"))
+	return info
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, contentType string) (Info, error) {
+	if !ValidKey(key) {
+		return Info{}, ErrInvalidKey
+	}
+	//Payload is signed, so it is read whole. Uploads of this app are small
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return Info{}, err
+	}
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(ctx, http.MethodPut, s.objectURL(key), body, header)
+	if err != nil {
+		return Info{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Info{}, s3Error(resp)
+	}
+	return s.Stat(ctx, key)
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, Info, error) {
+	if !ValidKey(key) {
+		return nil, Info{}, ErrInvalidKey
+	}
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(key), nil, nil)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, infoFromHeader(key, resp.Header), nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, Info{}, ErrNotFound
+	}
+	defer resp.Body.Close()
+	return nil, Info{}, s3Error(resp)
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	if !ValidKey(key) {
+		return Info{}, ErrInvalidKey
+	}
+	resp, err := s.do(ctx, http.MethodHead, s.objectURL(key), nil, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return infoFromHeader(key, resp.Header), nil
+	case http.StatusNotFound:
+		return Info{}, ErrNotFound
+	}
+	return Info{}, s3Error(resp)
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	resp, err := s.do(ctx, http.MethodDelete, s.objectURL(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]Info, error) {
+	list := []Info{}
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		rawURL := strings.TrimSuffix(s.Endpoint, "/") + "/" + url.PathEscape(s.Bucket) + "?" + q.Encode()
+		resp, err := s.do(ctx, http.MethodGet, rawURL, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			list = append(list, Info{Key: c.Key, Size: c.Size, ModTime: c.LastModified, ETag: strings.Trim(c.ETag, `"`)})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// uriEncode escapes a string as AWS Signature Version 4 requires
+func uriEncode(s string, encodeSlash bool) string {
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sign adds AWS Signature Version 4 headers to the request
+func sign(req *http.Request, body []byte, accessKey, secretKey, region string, t time.Time) {
+	const service string = "s3"
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		payloadHash = sha256Hex(body)
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "content-type" || lk == "range" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := strings.Builder{}
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	path := req.URL.EscapedPath()
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		path = uriEncode(unescaped, false)
+	}
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, strings.Join(params, "&"), canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
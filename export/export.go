@@ -0,0 +1,167 @@
+// Package export bundles personal data of a user into a ZIP archive of JSON and CSV files
+package export
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+const ContentType = "application/zip"
+
+type Profile struct {
+	UserId          int       `json:"userId"`
+	Username        string    `json:"username"`
+	Email           string    `json:"email,omitempty"`
+	DisplayName     string    `json:"displayName"`
+	Bio             string    `json:"bio"`
+	RegisterDate    time.Time `json:"registerDate"`
+	Admin           bool      `json:"admin"`
+	WatchlistPublic bool      `json:"watchlistPublic"`
+	DiaryPublic     bool      `json:"diaryPublic"`
+}
+
+type Rating struct {
+	MovieId int       `json:"movieId"`
+	Title   string    `json:"title"`
+	Rating  float32   `json:"rating"`
+	RatedAt time.Time `json:"ratedAt"`
+}
+
+type Comment struct {
+	CommentId int        `json:"commentId"`
+	MovieId   int        `json:"movieId"`
+	Title     string     `json:"title"`
+	ParentId  int        `json:"parentId,omitempty"`
+	Text      string     `json:"text"`
+	PostedAt  time.Time  `json:"postedAt"`
+	EditedAt  *time.Time `json:"editedAt,omitempty"`
+	Hidden    bool       `json:"hidden"`
+}
+
+// Movie added to the catalog by the user
+type Movie struct {
+	MovieId int       `json:"movieId"`
+	Title   string    `json:"title"`
+	Genres  string    `json:"genres"`
+	AddedAt time.Time `json:"addedAt"`
+}
+
+// Session is a login of the user. Tokens are never exported
+type Session struct {
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"userAgent"`
+}
+
+type Data struct {
+	GeneratedAt time.Time
+	Profile     Profile
+	Ratings     []Rating
+	Comments    []Comment
+	Movies      []Movie
+	Sessions    []Session
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatFloat(f float32) string {
+	return strconv.FormatFloat(float64(f), 'f', 1, 32)
+}
+
+// Write writes the archive. Every list is stored as JSON for machines and as CSV for spreadsheets
+func Write(w io.Writer, d *Data) error {
+	zw := zip.NewWriter(w)
+	readme := "Personal data export generated at " + formatTime(d.GeneratedAt) + ".\n" +
+		"profile.json: account details\n" +
+		"ratings: movie ratings\n" +
+		"comments: comments, including hidden ones\n" +
+		"movies: movies added to the catalog\n" +
+		"sessions: logins with their devices and last activity\n"
+	if err := writeFile(zw, "README.txt", d.GeneratedAt, func(w io.Writer) error {
+		_, err := io.WriteString(w, readme)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := writeJSON(zw, "profile.json", d.GeneratedAt, d.Profile); err != nil {
+		return err
+	}
+
+	ratings := [][]string{{"movieId", "title", "rating", "ratedAt"}}
+	for _, r := range d.Ratings {
+		ratings = append(ratings, []string{strconv.Itoa(r.MovieId), r.Title, formatFloat(r.Rating), formatTime(r.RatedAt)})
+	}
+	if err := writeBoth(zw, "ratings", d.GeneratedAt, d.Ratings, ratings); err != nil {
+		return err
+	}
+
+	comments := [][]string{{"commentId", "movieId", "title", "parentId", "text", "postedAt", "editedAt", "hidden"}}
+	for _, c := range d.Comments {
+		edited := ""
+		if c.EditedAt != nil {
+			edited = formatTime(*c.EditedAt)
+		}
+		comments = append(comments, []string{strconv.Itoa(c.CommentId), strconv.Itoa(c.MovieId), c.Title,
+			strconv.Itoa(c.ParentId), c.Text, formatTime(c.PostedAt), edited, strconv.FormatBool(c.Hidden)})
+	}
+	if err := writeBoth(zw, "comments", d.GeneratedAt, d.Comments, comments); err != nil {
+		return err
+	}
+
+	movies := [][]string{{"movieId", "title", "genres", "addedAt"}}
+	for _, m := range d.Movies {
+		movies = append(movies, []string{strconv.Itoa(m.MovieId), m.Title, m.Genres, formatTime(m.AddedAt)})
+	}
+	if err := writeBoth(zw, "movies", d.GeneratedAt, d.Movies, movies); err != nil {
+		return err
+	}
+
+	sessions := [][]string{{"createdAt", "lastSeenAt", "expiresAt", "ip", "userAgent"}}
+	for _, s := range d.Sessions {
+		sessions = append(sessions, []string{formatTime(s.CreatedAt), formatTime(s.LastSeenAt), formatTime(s.ExpiresAt),
+			s.IP, s.UserAgent})
+	}
+	if err := writeBoth(zw, "sessions", d.GeneratedAt, d.Sessions, sessions); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeFile(zw *zip.Writer, name string, modified time.Time, write func(io.Writer) error) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	return write(f)
+}
+
+func writeJSON(zw *zip.Writer, name string, modified time.Time, v any) error {
+	return writeFile(zw, name, modified, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	})
+}
+
+// writeBoth writes list as name.json and its rows, header included, as name.csv
+func writeBoth[T any](zw *zip.Writer, name string, modified time.Time, list []T, rows [][]string) error {
+	if list == nil {
+		list = []T{}
+	}
+	if err := writeJSON(zw, name+".json", modified, list); err != nil {
+		return err
+	}
+	return writeFile(zw, name+".csv", modified, func(w io.Writer) error {
+		cw := csv.NewWriter(w)
+		cw.WriteAll(rows)
+		return cw.Error()
+	})
+}
@@ -0,0 +1,91 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	edited := now.Add(time.Hour)
+	d := &Data{
+		GeneratedAt: now,
+		Profile:     Profile{UserId: 3, Username: "alice", Bio: "line\nbreak"},
+		Ratings:     []Rating{{MovieId: 1, Title: "Heat, 1995", Rating: 4.5, RatedAt: now}},
+		Comments:    []Comment{{CommentId: 7, MovieId: 1, Text: `say "hi"`, PostedAt: now, EditedAt: &edited}},
+		Sessions:    []Session{{CreatedAt: now, LastSeenAt: edited, ExpiresAt: edited, IP: "192.0.2.1", UserAgent: "Mozilla/5.0"}},
+	}
+	buf := &bytes.Buffer{}
+	if err := Write(buf, d); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], _ = io.ReadAll(r)
+		r.Close()
+	}
+	for _, name := range []string{"README.txt", "profile.json", "ratings.json", "ratings.csv", "comments.json",
+		"comments.csv", "movies.json", "movies.csv", "sessions.json", "sessions.csv"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("archive has no %s", name)
+		}
+	}
+
+	var profile Profile
+	if err := json.Unmarshal(files["profile.json"], &profile); err != nil || profile.Username != "alice" || profile.Bio != "line\nbreak" {
+		t.Errorf("profile.json = %+v, %v", profile, err)
+	}
+	tests := []struct {
+		name string
+		file string
+		want [][]string
+	}{
+		{name: "Quoted CSV", file: "ratings.csv", want: [][]string{
+			{"movieId", "title", "rating", "ratedAt"},
+			{"1", "Heat, 1995", "4.5", "2024-05-01T12:00:00Z"},
+		}},
+		{name: "Optional column", file: "comments.csv", want: [][]string{
+			{"commentId", "movieId", "title", "parentId", "text", "postedAt", "editedAt", "hidden"},
+			{"7", "1", "", "0", `say "hi"`, "2024-05-01T12:00:00Z", "2024-05-01T13:00:00Z", "false"},
+		}},
+		{name: "Session history", file: "sessions.csv", want: [][]string{
+			{"createdAt", "lastSeenAt", "expiresAt", "ip", "userAgent"},
+			{"2024-05-01T12:00:00Z", "2024-05-01T13:00:00Z", "2024-05-01T13:00:00Z", "192.0.2.1", "Mozilla/5.0"},
+		}},
+		{name: "Empty list", file: "movies.csv", want: [][]string{{"movieId", "title", "genres", "addedAt"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := csv.NewReader(bytes.NewReader(files[tt.file])).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("%s = %q, want %q", tt.file, got, tt.want)
+			}
+			for i := range got {
+				for j := range got[i] {
+					if got[i][j] != tt.want[i][j] {
+						t.Errorf("%s[%d][%d] = %q, want %q", tt.file, i, j, got[i][j], tt.want[i][j])
+					}
+				}
+			}
+		})
+	}
+	if string(bytes.TrimSpace(files["movies.json"])) != "[]" {
+		t.Errorf("movies.json = %s, want []", files["movies.json"])
+	}
+}
@@ -0,0 +1,111 @@
+// Package filter checks user content for spam and abuse. Filters are combined into a Pipeline
+// and each of them can allow the content, hold it for moderation or reject it
+package filter
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+type Verdict int
+
+const (
+	Allow Verdict = iota
+	Hold
+	Reject
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Hold:
+		return "hold"
+	case Reject:
+		return "reject"
+	}
+	return "allow"
+}
+
+// Post is a previous post of the same author
+type Post struct {
+	Text     string
+	PostedAt time.Time
+}
+
+type Input struct {
+	Text       string
+	AccountAge time.Duration
+	Recent     []Post //Posts of the author, at least as old as the Lookback of the pipeline
+	Now        time.Time
+}
+
+type Result struct {
+	Verdict Verdict
+	Reason  string //Explanation shown to the author or moderators, empty for Allow
+}
+
+type Filter interface {
+	Check(in Input) Result
+}
+
+// Lookbacker is implemented by filters that need history of the author's posts
+type Lookbacker interface {
+	Lookback() time.Duration
+}
+
+// Pipeline runs filters in order and returns the strictest verdict. Reject stops the pipeline
+type Pipeline []Filter
+
+func (p Pipeline) Check(in Input) Result {
+	result := Result{Verdict: Allow}
+	for _, f := range p {
+		r := f.Check(in)
+		if r.Verdict > result.Verdict {
+			result = r
+		}
+		if result.Verdict == Reject {
+			break
+		}
+	}
+	return result
+}
+
+// Lookback returns how far back the author's posts are needed by the filters
+func (p Pipeline) Lookback() time.Duration {
+	var d time.Duration
+	for _, f := range p {
+		if l, ok := f.(Lookbacker); ok && l.Lookback() > d {
+			d = l.Lookback()
+		}
+	}
+	return d
+}
+
+// Content returns filters of the pipeline that check the text alone, without history of the author's posts
+func (p Pipeline) Content() Pipeline {
+	content := Pipeline{}
+	for _, f := range p {
+		if _, ok := f.(Lookbacker); !ok {
+			content = append(content, f)
+		}
+	}
+	return content
+}
+
+// normalize lowercases text and collapses everything but letters and digits to single spaces
+func normalize(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// countLinks counts web addresses in text
+func countLinks(text string) int {
+	n := 0
+	for _, field := range strings.Fields(strings.ToLower(text)) {
+		if strings.Contains(field, "http://") || strings.Contains(field, "https://") || strings.Contains(field, "www.") {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,67 @@
+package filter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	old := 30 * 24 * time.Hour
+	p := append(Default(), WordList{Reject: []string{"buy pills"}, Hold: []string{"casino"}})
+	tests := []struct {
+		name string
+		in   Input
+		want Verdict
+	}{
+		{name: "Plain comment", in: Input{Text: "Great movie", AccountAge: old, Now: now}, want: Allow},
+		{name: "Some links", in: Input{Text: "see https://a.com and www.b.com", AccountAge: old, Now: now}, want: Allow},
+		{name: "Too many links", in: Input{Text: "http://a http://b http://c http://d", AccountAge: old, Now: now}, want: Reject},
+		{name: "New account link", in: Input{Text: "see https://a.com", AccountAge: time.Hour, Now: now}, want: Hold},
+		{name: "New account without links", in: Input{Text: "hello", AccountAge: time.Hour, Now: now}, want: Allow},
+		{name: "Forbidden phrase", in: Input{Text: "BUY, pills!", AccountAge: old, Now: now}, want: Reject},
+		{name: "Suspicious word", in: Input{Text: "best Casino ever", AccountAge: old, Now: now}, want: Hold},
+		{name: "Word inside another word", in: Input{Text: "casinos", AccountAge: old, Now: now}, want: Allow},
+		{name: "Duplicate", in: Input{Text: "Great  movie!", AccountAge: old, Now: now,
+			Recent: []Post{{Text: "great movie", PostedAt: now.Add(-10 * time.Minute)}}}, want: Reject},
+		{name: "Old duplicate", in: Input{Text: "Great movie", AccountAge: old, Now: now,
+			Recent: []Post{{Text: "Great movie", PostedAt: now.Add(-2 * time.Hour)}}}, want: Allow},
+		{name: "Rate", in: Input{Text: "sixth", AccountAge: old, Now: now, Recent: []Post{
+			{"1", now.Add(-10 * time.Second)}, {"2", now.Add(-20 * time.Second)}, {"3", now.Add(-30 * time.Second)},
+			{"4", now.Add(-40 * time.Second)}, {"5", now.Add(-50 * time.Second)}}}, want: Reject},
+		{name: "Hold and reject", in: Input{Text: "casino http://a http://b http://c http://d", AccountAge: time.Hour, Now: now}, want: Reject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.Check(tt.in)
+			if got.Verdict != tt.want {
+				t.Errorf("Check() = %v (%s), want %v", got.Verdict, got.Reason, tt.want)
+			}
+			if (got.Reason == "") != (got.Verdict == Allow) {
+				t.Errorf("Check() reason = %q for verdict %v", got.Reason, got.Verdict)
+			}
+		})
+	}
+}
+
+func TestPipelineLookback(t *testing.T) {
+	if got := Default().Lookback(); got != time.Hour {
+		t.Errorf("Lookback() = %v, want %v", got, time.Hour)
+	}
+	if got := (Pipeline{LinkLimit{Max: 1}}).Lookback(); got != 0 {
+		t.Errorf("Lookback() = %v, want 0", got)
+	}
+}
+
+func TestPipelineContent(t *testing.T) {
+	got := Default().Content()
+	if len(got) != 2 || got.Lookback() != 0 {
+		t.Fatalf("Content() = %v, want link and new account filters", got)
+	}
+	in := Input{Text: "same", AccountAge: 48 * time.Hour, Now: time.Now(),
+		Recent: []Post{{Text: "same", PostedAt: time.Now()}, {Text: "a", PostedAt: time.Now()}, {Text: "b", PostedAt: time.Now()},
+			{Text: "c", PostedAt: time.Now()}, {Text: "d", PostedAt: time.Now()}}}
+	if r := got.Check(in); r.Verdict != Allow {
+		t.Errorf("Content().Check() = %v, want %v", r, Allow)
+	}
+}
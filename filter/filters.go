@@ -0,0 +1,105 @@
+package filter
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WordList rejects or holds content containing listed words or phrases. Matching ignores case and punctuation
+type WordList struct {
+	Reject []string
+	Hold   []string
+}
+
+func (f WordList) Check(in Input) Result {
+	text := " " + normalize(in.Text) + " "
+	contains := func(words []string) bool {
+		for _, w := range words {
+			if w = normalize(w); w != "" && strings.Contains(text, " "+w+" ") {
+				return true
+			}
+		}
+		return false
+	}
+	if contains(f.Reject) {
+		return Result{Reject, "Comment contains forbidden words"}
+	}
+	if contains(f.Hold) {
+		return Result{Hold, "Comment contains suspicious words"}
+	}
+	return Result{Verdict: Allow}
+}
+
+// LinkLimit rejects content with more than Max links
+type LinkLimit struct {
+	Max int
+}
+
+func (f LinkLimit) Check(in Input) Result {
+	if countLinks(in.Text) > f.Max {
+		return Result{Reject, "Comment can't contain more than " + strconv.Itoa(f.Max) + " links"}
+	}
+	return Result{Verdict: Allow}
+}
+
+// NewAccount holds content with more than MaxLinks links from accounts younger than MinAge
+type NewAccount struct {
+	MinAge   time.Duration
+	MaxLinks int
+}
+
+func (f NewAccount) Check(in Input) Result {
+	if in.AccountAge < f.MinAge && countLinks(in.Text) > f.MaxLinks {
+		return Result{Hold, "Links from new accounts are reviewed by moderators"}
+	}
+	return Result{Verdict: Allow}
+}
+
+// Duplicate rejects content that repeats a post of the author made within Window
+type Duplicate struct {
+	Window time.Duration
+}
+
+func (f Duplicate) Lookback() time.Duration { return f.Window }
+
+func (f Duplicate) Check(in Input) Result {
+	text := normalize(in.Text)
+	for _, p := range in.Recent {
+		if in.Now.Sub(p.PostedAt) <= f.Window && normalize(p.Text) == text {
+			return Result{Reject, "You have already posted this comment"}
+		}
+	}
+	return Result{Verdict: Allow}
+}
+
+// Rate rejects content when the author already made Max posts within Window
+type Rate struct {
+	Max    int
+	Window time.Duration
+}
+
+func (f Rate) Lookback() time.Duration { return f.Window }
+
+func (f Rate) Check(in Input) Result {
+	n := 0
+	for _, p := range in.Recent {
+		if in.Now.Sub(p.PostedAt) <= f.Window {
+			n++
+		}
+	}
+	if n >= f.Max {
+		return Result{Reject, "You are posting too fast, try again later"}
+	}
+	return Result{Verdict: Allow}
+}
+
+// Default returns pipeline with rate, duplicate, link and new account restrictions
+func Default() Pipeline {
+	return Pipeline{
+		Rate{Max: 5, Window: time.Minute},
+		Duplicate{Window: time.Hour},
+		LinkLimit{Max: 3},
+		NewAccount{MinAge: 24 * time.Hour, MaxLinks: 0},
+	}
+}
@@ -0,0 +1,209 @@
+// Package format renders a small markdown subset used in comments.
+// Supported: **strong**, *emphasis*, [links](https://...), ||spoilers||,
+// "> " quotes, "- " or "* " bullet lists and "1. " numbered lists.
+// All other text is escaped so the output is safe to insert into a page.
+package format
+
+import (
+	"html"
+	"html/template"
+	"net/url"
+	"strings"
+)
+
+type blockKind int
+
+const (
+	paragraph blockKind = iota
+	quote
+	bullets
+	numbers
+)
+
+// Comment converts comment source to sanitized HTML
+func Comment(src string) template.HTML {
+	b := &strings.Builder{}
+	kind, lines := paragraph, []string{}
+	flush := func() {
+		if len(lines) > 0 {
+			writeBlock(b, kind, lines)
+		}
+		lines = lines[:0]
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		k, text := classify(line)
+		if k != kind {
+			flush()
+			kind = k
+		}
+		lines = append(lines, text)
+	}
+	flush()
+	return template.HTML(b.String())
+}
+
+// Plain strips formatting from comment source for short previews. Spoilers are replaced with a placeholder
+func Plain(src string) string {
+	b := &strings.Builder{}
+	for s := src; len(s) > 0; {
+		i := strings.IndexAny(s, "*|[")
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+		if _, n := delimited(s, "||"); n > 0 {
+			b.WriteString("[spoiler]")
+			s = s[n:]
+			continue
+		}
+		if inner, n := delimited(s, "**"); n > 0 {
+			b.WriteString(Plain(inner))
+			s = s[n:]
+			continue
+		}
+		if inner, n := delimited(s, "*"); n > 0 {
+			b.WriteString(Plain(inner))
+			s = s[n:]
+			continue
+		}
+		if text, _, n := link(s); n > 0 {
+			b.WriteString(Plain(text))
+			s = s[n:]
+			continue
+		}
+		b.WriteString(s[:1])
+		s = s[1:]
+	}
+	return b.String()
+}
+
+// classify returns kind of the block the line belongs to and the line without its block marker
+func classify(line string) (blockKind, string) {
+	switch {
+	case strings.HasPrefix(line, ">"):
+		return quote, strings.TrimPrefix(strings.TrimPrefix(line, ">"), " ")
+	case strings.HasPrefix(line, "- "), strings.HasPrefix(line, "* "):
+		return bullets, line[2:]
+	}
+	if i := strings.Index(line, ". "); i > 0 && i <= 3 && strings.Trim(line[:i], "0123456789") == "" {
+		return numbers, line[i+2:]
+	}
+	return paragraph, line
+}
+
+func writeBlock(b *strings.Builder, kind blockKind, lines []string) {
+	switch kind {
+	case bullets, numbers:
+		tag := "ul"
+		if kind == numbers {
+			tag = "ol"
+		}
+		b.WriteString("<" + tag + ">")
+		for _, line := range lines {
+			b.WriteString("<li>")
+			inline(b, line, true)
+			b.WriteString("</li>")
+		}
+		b.WriteString("</" + tag + ">")
+	default:
+		open, close := "<p>", "</p>"
+		if kind == quote {
+			open, close = "<blockquote><p>", "</p></blockquote>"
+		}
+		b.WriteString(open)
+		for i, line := range lines {
+			if i > 0 {
+				b.WriteString("<br>")
+			}
+			inline(b, line, true)
+		}
+		b.WriteString(close)
+	}
+}
+
+// inline writes escaped text with inline markup. Links are not allowed inside link text
+func inline(b *strings.Builder, s string, links bool) {
+	for len(s) > 0 {
+		i := strings.IndexAny(s, "*|[")
+		if i < 0 {
+			b.WriteString(html.EscapeString(s))
+			return
+		}
+		b.WriteString(html.EscapeString(s[:i]))
+		s = s[i:]
+		if inner, n := delimited(s, "||"); n > 0 {
+			b.WriteString(`<span class="spoiler" tabindex="0" title="Spoiler" onclick="this.classList.add('revealed')">`)
+			inline(b, inner, links)
+			b.WriteString("</span>")
+			s = s[n:]
+			continue
+		}
+		if inner, n := delimited(s, "**"); n > 0 {
+			b.WriteString("<strong>")
+			inline(b, inner, links)
+			b.WriteString("</strong>")
+			s = s[n:]
+			continue
+		}
+		if inner, n := delimited(s, "*"); n > 0 {
+			b.WriteString("<em>")
+			inline(b, inner, links)
+			b.WriteString("</em>")
+			s = s[n:]
+			continue
+		}
+		if text, href, n := link(s); links && n > 0 {
+			b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow ugc noopener" target="_blank">`)
+			inline(b, text, false)
+			b.WriteString("</a>")
+			s = s[n:]
+			continue
+		}
+		b.WriteString(html.EscapeString(s[:1]))
+		s = s[1:]
+	}
+}
+
+// delimited returns text between marker at the start of s and the next marker and length of the whole span.
+// n is 0 if s doesn't start with a valid span
+func delimited(s, marker string) (inner string, n int) {
+	if !strings.HasPrefix(s, marker) {
+		return "", 0
+	}
+	end := strings.Index(s[len(marker):], marker)
+	if end <= 0 {
+		return "", 0
+	}
+	inner = s[len(marker) : len(marker)+end]
+	if strings.TrimSpace(inner) != inner {
+		return "", 0
+	}
+	return inner, len(marker)*2 + end
+}
+
+// link parses [text](url) at the start of s. Only absolute http and https urls are accepted
+func link(s string) (text, href string, n int) {
+	if !strings.HasPrefix(s, "[") {
+		return "", "", 0
+	}
+	mid := strings.Index(s, "](")
+	if mid <= 1 {
+		return "", "", 0
+	}
+	end := strings.IndexByte(s[mid+2:], ')')
+	if end <= 0 {
+		return "", "", 0
+	}
+	href = s[mid+2 : mid+2+end]
+	u, err := url.Parse(href)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", 0
+	}
+	return s[1:mid], u.String(), mid + 3 + end
+}
@@ -0,0 +1,61 @@
+package format
+
+import (
+	"html/template"
+	"testing"
+)
+
+func TestComment(t *testing.T) {
+	type args struct {
+		src string
+	}
+	tests := []struct {
+		name string
+		args args
+		want template.HTML
+	}{
+		{name: "Plain text", args: args{src: "Great movie"}, want: "<p>Great movie</p>"},
+		{name: "Escaping", args: args{src: `<script>alert("x")</script>`}, want: "<p>&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;</p>"},
+		{name: "Line breaks", args: args{src: "one\ntwo\n\nthree"}, want: "<p>one<br>two</p><p>three</p>"},
+		{name: "Emphasis", args: args{src: "**bold** and *italic*"}, want: "<p><strong>bold</strong> and <em>italic</em></p>"},
+		{name: "Nested", args: args{src: "**bold *em* text**"}, want: "<p><strong>bold <em>em</em> text</strong></p>"},
+		{name: "Unclosed", args: args{src: "2 * 3 = 6"}, want: "<p>2 * 3 = 6</p>"},
+		{name: "Spoiler", args: args{src: "he ||dies|| at the end"}, want: `<p>he <span class="spoiler" tabindex="0" title="Spoiler" onclick="this.classList.add('revealed')">dies</span> at the end</p>`},
+		{name: "Link", args: args{src: "[site](https://example.com/a?b=1&c=2)"}, want: `<p><a href="https://example.com/a?b=1&amp;c=2" rel="nofollow ugc noopener" target="_blank">site</a></p>`},
+		{name: "Javascript link", args: args{src: "[x](javascript:alert(1))"}, want: "<p>[x](javascript:alert(1))</p>"},
+		{name: "Quoted link", args: args{src: `[x](https://a.com/"onmouseover="y)`}, want: `<p><a href="https://a.com/%22onmouseover=%22y" rel="nofollow ugc noopener" target="_blank">x</a></p>`},
+		{name: "Quote", args: args{src: "> first\n> second\nreply"}, want: "<blockquote><p>first<br>second</p></blockquote><p>reply</p>"},
+		{name: "Bullets", args: args{src: "- one\n* two"}, want: "<ul><li>one</li><li>two</li></ul>"},
+		{name: "Numbers", args: args{src: "1. one\n2. **two**"}, want: "<ol><li>one</li><li><strong>two</strong></li></ol>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Comment(tt.args.src); got != tt.want {
+				t.Errorf("Comment() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlain(t *testing.T) {
+	type args struct {
+		src string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{name: "Plain text", args: args{src: "Great movie"}, want: "Great movie"},
+		{name: "Emphasis", args: args{src: "**bold** and *italic*"}, want: "bold and italic"},
+		{name: "Spoiler", args: args{src: "he ||dies|| at the end"}, want: "he [spoiler] at the end"},
+		{name: "Link", args: args{src: "see [site](https://example.com)"}, want: "see site"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Plain(tt.args.src); got != tt.want {
+				t.Errorf("Plain() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package format
+
+import "strings"
+
+// MaxMentions limits how many users one comment can mention
+const MaxMentions int = 10
+
+func isUsernameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-'
+}
+
+// Mentions returns unique @usernames found in comment source, without the @ sign, in order of appearance.
+// Mention must not be preceded by a username character, so e-mail addresses are skipped
+func Mentions(src string) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for i := 0; i < len(src) && len(names) < MaxMentions; i++ {
+		if src[i] != '@' || i > 0 && isUsernameByte(src[i-1]) {
+			continue
+		}
+		end := i + 1
+		for end < len(src) && isUsernameByte(src[end]) {
+			end++
+		}
+		//Trailing dots are punctuation of the sentence rather than a part of the name
+		name := strings.TrimRight(src[i+1:end], ".")
+		i = end - 1
+		if name == "" || seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		names = append(names, name)
+	}
+	return names
+}
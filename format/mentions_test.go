@@ -0,0 +1,31 @@
+package format
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMentions(t *testing.T) {
+	type args struct {
+		src string
+	}
+	tests := []struct {
+		name string
+		args args
+		want []string
+	}{
+		{name: "No mentions", args: args{src: "Great movie"}, want: []string{}},
+		{name: "One mention", args: args{src: "@alice agreed"}, want: []string{"alice"}},
+		{name: "Punctuation", args: args{src: "ask @bob.smith, or @carol."}, want: []string{"bob.smith", "carol"}},
+		{name: "Duplicates", args: args{src: "@dave @Dave @dave"}, want: []string{"dave"}},
+		{name: "E-mail", args: args{src: "write to me@example.com"}, want: []string{}},
+		{name: "Lone sign", args: args{src: "@ @!"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Mentions(tt.args.src); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Mentions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,8 +3,10 @@ module movie_db
 go 1.24.0
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/go-sql-driver/mysql v1.8.1
 	golang.org/x/crypto v0.33.0
+	golang.org/x/image v0.25.0
 )
 
 require filippo.io/edwards25519 v1.1.0 // indirect
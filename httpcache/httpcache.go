@@ -0,0 +1,114 @@
+// Package httpcache adds validators and cache policies to file responses
+package httpcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Immutable is the policy for responses whose URL changes together with the content
+const Immutable string = "public, max-age=31536000, immutable"
+
+type entry struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+// Hasher caches content hashes of files. Cached hash is dropped when the file's
+// modification time or size changes
+type Hasher struct {
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+func NewHasher() *Hasher {
+	return &Hasher{entries: make(map[string]entry)}
+}
+
+// Hash returns hex encoded content hash of the opened file
+func (h *Hasher) Hash(path string, f *os.File, info os.FileInfo) (string, error) {
+	h.mu.Lock()
+	e, ok := h.entries[path]
+	h.mu.Unlock()
+	if ok && e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+		return e.hash, nil
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(sum.Sum(nil))[:32]
+	h.mu.Lock()
+	h.entries[path] = entry{info.ModTime(), info.Size(), hash}
+	h.mu.Unlock()
+	return hash, nil
+}
+
+// ServeFile writes the file with ETag and Cache-Control headers. Conditional and range requests
+// are answered by http.ServeContent, so a matching If-None-Match gets 304 Not Modified
+func (h *Hasher) ServeFile(w http.ResponseWriter, r *http.Request, path, contentType, cacheControl string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hash, err := h.Hash(path, f, info)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Cache-Control", cacheControl)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return nil
+}
+
+// ServeReader writes content that is not a local file, e.g. from a blob store, with ETag and
+// Cache-Control headers. A matching If-None-Match gets 304 Not Modified without reading content
+func ServeReader(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time, contentType, cacheControl string, content io.Reader) error {
+	h := w.Header()
+	h.Set("ETag", `"`+etag+`"`)
+	h.Set("Cache-Control", cacheControl)
+	if NoneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	if !modTime.IsZero() {
+		h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err := io.Copy(w, content)
+	return err
+}
+
+// NoneMatch reports whether If-None-Match of the request matches the unquoted etag
+func NoneMatch(r *http.Request, etag string) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == `"`+etag+`"` {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatic(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "style.css"), []byte("body{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStatic(dir, "/static/")
+	url := s.URL("style.css")
+	if !strings.HasPrefix(url, "/static/style.css?v=") {
+		t.Fatalf("URL() = %s", url)
+	}
+	if got := s.URL("missing.css"); got != "/static/missing.css" {
+		t.Errorf("URL() of missing file = %s", got)
+	}
+	tests := []struct {
+		name        string
+		url         string
+		ifNoneMatch bool
+		wantStatus  int
+		wantCache   string
+	}{
+		{name: "Fingerprinted", url: url, wantStatus: http.StatusOK, wantCache: Immutable},
+		{name: "Plain", url: "/static/style.css", wantStatus: http.StatusOK, wantCache: "no-cache"},
+		{name: "Stale fingerprint", url: "/static/style.css?v=000000000000", wantStatus: http.StatusOK, wantCache: "no-cache"},
+		{name: "Not modified", url: "/static/style.css", ifNoneMatch: true, wantStatus: http.StatusNotModified, wantCache: "no-cache"},
+		{name: "Missing", url: "/static/missing.css", wantStatus: http.StatusNotFound},
+		{name: "Directory", url: "/static/", wantStatus: http.StatusNotFound},
+		{name: "Escape", url: "/static/../httpcache.go", wantStatus: http.StatusNotFound},
+	}
+	etag := ""
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.ifNoneMatch {
+				r.Header.Set("If-None-Match", etag)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantCache != "" && w.Header().Get("Cache-Control") != tt.wantCache {
+				t.Errorf("Cache-Control = %q, want %q", w.Header().Get("Cache-Control"), tt.wantCache)
+			}
+			if w.Code == http.StatusOK {
+				etag = w.Header().Get("ETag")
+				if etag == "" {
+					t.Errorf("ETag is empty")
+				}
+			}
+		})
+	}
+}
+
+func TestHasherInvalidation(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "poster.jpg")
+	h := NewHasher()
+	hash := func() string {
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		info, _ := f.Stat()
+		got, err := h.Hash(p, f, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	os.WriteFile(p, []byte("first"), 0o644)
+	first := hash()
+	if hash() != first {
+		t.Errorf("Hash() changed without file change")
+	}
+	os.WriteFile(p, []byte("second version"), 0o644)
+	if hash() == first {
+		t.Errorf("Hash() didn't change with the file")
+	}
+}
+
+func TestServeReader(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		ifNoneMatch string
+		wantStatus  int
+		wantBody    string
+	}{
+		{name: "Get", method: http.MethodGet, wantStatus: http.StatusOK, wantBody: "poster"},
+		{name: "Head", method: http.MethodHead, wantStatus: http.StatusOK},
+		{name: "Not modified", method: http.MethodGet, ifNoneMatch: `"abc"`, wantStatus: http.StatusNotModified},
+		{name: "Weak in list", method: http.MethodGet, ifNoneMatch: `"old", W/"abc"`, wantStatus: http.StatusNotModified},
+		{name: "Stale", method: http.MethodGet, ifNoneMatch: `"old"`, wantStatus: http.StatusOK, wantBody: "poster"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/poster", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			if err := ServeReader(w, r, "abc", time.Time{}, "image/jpeg", "public", strings.NewReader("poster")); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.wantStatus || w.Body.String() != tt.wantBody {
+				t.Errorf("ServeReader() = %d %q, want %d %q", w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if w.Header().Get("ETag") != `"abc"` {
+				t.Errorf("ETag = %s", w.Header().Get("ETag"))
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package httpcache
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Static serves files from Dir under Prefix. URL adds content fingerprint to the address,
+// fingerprinted requests are cached for a year and the rest are revalidated with ETag
+type Static struct {
+	Dir    string
+	Prefix string
+	hasher *Hasher
+}
+
+func NewStatic(dir, prefix string) *Static {
+	return &Static{Dir: dir, Prefix: prefix, hasher: NewHasher()}
+}
+
+// filePath maps name relative to Prefix to a file in Dir, rejecting names that escape it
+func (s *Static) filePath(name string) (string, bool) {
+	name = path.Clean("/" + name)
+	if strings.Contains(name, "..") {
+		return "", false
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(name)), true
+}
+
+// URL returns fingerprinted address of the file, e.g. /static/style.css?v=1a2b3c4d5e6f.
+// Unknown files get the plain address so a missing asset doesn't break the page
+func (s *Static) URL(name string) string {
+	plain := s.Prefix + strings.TrimPrefix(name, "/")
+	p, ok := s.filePath(name)
+	if !ok {
+		return plain
+	}
+	hash, err := s.hash(p)
+	if err != nil {
+		return plain
+	}
+	return plain + "?v=" + hash[:12]
+}
+
+func (s *Static) hash(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	return s.hasher.Hash(p, f, info)
+}
+
+func (s *Static) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutPrefix(r.URL.Path, s.Prefix)
+	p, valid := s.filePath(name)
+	if !ok || !valid {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := os.Stat(p)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	cacheControl := "no-cache"
+	//Old fingerprint must not be cached as immutable with new content
+	if v := r.URL.Query().Get("v"); v != "" {
+		if hash, err := s.hash(p); err == nil && strings.HasPrefix(hash, v) && len(v) == 12 {
+			cacheControl = Immutable
+		}
+	}
+	if err := s.hasher.ServeFile(w, r, p, "", cacheControl); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
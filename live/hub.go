@@ -0,0 +1,100 @@
+// Package live implements in-process publish/subscribe used for pushing updates to connected clients
+package live
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrTooManySubscribers = errors.New("too many subscribers")
+
+// Subscription receives messages published to its topic. C is closed when the subscriber
+// falls behind and is dropped by the hub
+type Subscription[T any] struct {
+	C     <-chan T
+	c     chan T
+	topic int
+}
+
+// Hub delivers messages to subscribers of a topic. Publishing never blocks: subscribers
+// with full buffers are dropped so one slow client can't stall the others
+type Hub[T any] struct {
+	mu          sync.Mutex
+	topics      map[int]map[*Subscription[T]]struct{}
+	total       int
+	maxPerTopic int
+	maxTotal    int
+	buffer      int
+}
+
+// NewHub creates a hub with connection limits. Zero limit means no limit
+func NewHub[T any](maxPerTopic, maxTotal, buffer int) *Hub[T] {
+	return &Hub[T]{
+		topics:      make(map[int]map[*Subscription[T]]struct{}),
+		maxPerTopic: maxPerTopic,
+		maxTotal:    maxTotal,
+		buffer:      buffer,
+	}
+}
+
+func (h *Hub[T]) Subscribe(topic int) (*Subscription[T], error) {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+	subs := h.topics[topic]
+	if h.maxTotal > 0 && h.total >= h.maxTotal || h.maxPerTopic > 0 && len(subs) >= h.maxPerTopic {
+		return nil, ErrTooManySubscribers
+	}
+	if subs == nil {
+		subs = make(map[*Subscription[T]]struct{})
+		h.topics[topic] = subs
+	}
+	c := make(chan T, h.buffer)
+	s := &Subscription[T]{C: c, c: c, topic: topic}
+	subs[s] = struct{}{}
+	h.total++
+	return s, nil
+}
+
+// Unsubscribe removes subscription from the hub. It is safe to call it more than once
+func (h *Hub[T]) Unsubscribe(s *Subscription[T]) {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+	h.remove(s)
+}
+
+// remove must be called with the lock held
+func (h *Hub[T]) remove(s *Subscription[T]) {
+	subs := h.topics[s.topic]
+	if _, ok := subs[s]; !ok {
+		return
+	}
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(h.topics, s.topic)
+	}
+	h.total--
+	close(s.c)
+}
+
+// Publish sends message to all subscribers of the topic and returns number of subscribers reached
+func (h *Hub[T]) Publish(topic int, msg T) int {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+	delivered := 0
+	for s := range h.topics[topic] {
+		select {
+		case s.c <- msg:
+			delivered++
+		default:
+			h.remove(s)
+		}
+	}
+	return delivered
+}
+
+// Count returns number of subscribers of the topic
+func (h *Hub[T]) Count(topic int) int {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+	return len(h.topics[topic])
+}
@@ -0,0 +1,67 @@
+package live
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHubLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxPerTopic int
+		maxTotal    int
+		topics      []int
+		wantErr     []bool
+	}{
+		{name: "No limits", topics: []int{1, 1, 2}, wantErr: []bool{false, false, false}},
+		{name: "Per topic", maxPerTopic: 1, topics: []int{1, 1, 2}, wantErr: []bool{false, true, false}},
+		{name: "Total", maxTotal: 2, topics: []int{1, 2, 3}, wantErr: []bool{false, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHub[string](tt.maxPerTopic, tt.maxTotal, 1)
+			for i, topic := range tt.topics {
+				_, err := h.Subscribe(topic)
+				if (err != nil) != tt.wantErr[i] {
+					t.Errorf("Subscribe(%d) error = %v, wantErr %v", topic, err, tt.wantErr[i])
+				}
+				if err != nil && !errors.Is(err, ErrTooManySubscribers) {
+					t.Errorf("Subscribe(%d) error = %v, want %v", topic, err, ErrTooManySubscribers)
+				}
+			}
+		})
+	}
+}
+
+func TestHubPublish(t *testing.T) {
+	h := NewHub[string](0, 0, 1)
+	a, _ := h.Subscribe(1)
+	b, _ := h.Subscribe(1)
+	other, _ := h.Subscribe(2)
+	if got := h.Publish(1, "first"); got != 2 {
+		t.Errorf("Publish() = %d, want 2", got)
+	}
+	if got := <-a.C; got != "first" {
+		t.Errorf("received %q, want %q", got, "first")
+	}
+	if len(other.C) != 0 {
+		t.Errorf("subscriber of another topic received a message")
+	}
+	//b hasn't read the first message, its buffer is full and it gets dropped
+	if got := h.Publish(1, "second"); got != 1 {
+		t.Errorf("Publish() = %d, want 1", got)
+	}
+	<-b.C
+	if _, ok := <-b.C; ok {
+		t.Errorf("slow subscriber channel is not closed")
+	}
+	if got := h.Count(1); got != 1 {
+		t.Errorf("Count() = %d, want 1", got)
+	}
+	h.Unsubscribe(b)
+	h.Unsubscribe(a)
+	h.Unsubscribe(a)
+	if got := h.Count(1); got != 0 {
+		t.Errorf("Count() = %d, want 0", got)
+	}
+}
@@ -0,0 +1,33 @@
+package live
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteEvent writes a named Server-Sent Event. Every line of data gets its own data field
+func WriteEvent(w io.Writer, event, data string) error {
+	b := &strings.Builder{}
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteComment writes an SSE comment line. Clients ignore it, so it is used as a heartbeat
+func WriteComment(w io.Writer, text string) error {
+	_, err := fmt.Fprintf(w, ": %s\n\n", text)
+	return err
+}
+
+// WriteRetry tells client how many milliseconds to wait before reconnecting
+func WriteRetry(w io.Writer, ms int) error {
+	_, err := fmt.Fprintf(w, "retry: %d\n\n", ms)
+	return err
+}
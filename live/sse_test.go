@@ -0,0 +1,34 @@
+package live
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteEvent(t *testing.T) {
+	type args struct {
+		event string
+		data  string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{name: "Named event", args: args{event: "comment", data: "<p>hi</p>"}, want: "event: comment\ndata: <p>hi</p>\n\n"},
+		{name: "Unnamed event", args: args{data: "x"}, want: "data: x\n\n"},
+		{name: "Multiline", args: args{event: "comment", data: "<ul>\r\n<li>a</li>\n</ul>"}, want: "event: comment\ndata: <ul>\ndata: <li>a</li>\ndata: </ul>\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &strings.Builder{}
+			if err := WriteEvent(b, tt.args.event, tt.args.data); err != nil {
+				t.Errorf("WriteEvent() error = %v", err)
+				return
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("WriteEvent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// Package mail sends plain text emails through SMTP or, for local development, into files or the log
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var ErrInvalidAddress = errors.New("mail: invalid address")
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages. Implementations must be safe for concurrent use
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// ValidAddress reports whether addr looks like a deliverable address and is safe to put into headers
+func ValidAddress(addr string) bool {
+	if len(addr) > 254 || strings.ContainsAny(addr, "\r\n<>\" ,;") {
+		return false
+	}
+	local, domain, ok := strings.Cut(addr, "@")
+	return ok && local != "" && domain != "" && !strings.Contains(domain, "@") &&
+		strings.Contains(domain, ".") && !strings.HasPrefix(domain, ".") && !strings.HasSuffix(domain, ".")
+}
+
+// Bytes formats the message as RFC 5322 text with CRLF line endings
+func (m Message) Bytes(from string, date time.Time) []byte {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "From: %s\r\n", from)
+	fmt.Fprintf(b, "To: %s\r\n", m.To)
+	fmt.Fprintf(b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	body := strings.ReplaceAll(m.Body, "\r\n", "\n")
+	for line := range strings.SplitSeq(body, "\n") {
+		//Lone dot is escaped by net/smtp, long lines are kept as is
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	return b.Bytes()
+}
+
+func check(from string, m Message) error {
+	if !ValidAddress(from) || !ValidAddress(m.To) || strings.ContainsAny(m.Subject, "\r\n") {
+		return ErrInvalidAddress
+	}
+	return nil
+}
+
+// SMTP sends through a mail server. STARTTLS is used when the server offers it,
+// credentials are only sent over TLS or to localhost as net/smtp enforces
+type SMTP struct {
+	Addr     string //host:port
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTP) Send(ctx context.Context, m Message) error {
+	if err := check(s.From, m); err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(nil); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(m.To); err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(m.Bytes(s.From, time.Now())); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// File writes every message into its own .eml file in Dir
+type File struct {
+	Dir  string
+	From string
+	seq  atomic.Uint64
+}
+
+func (f *File) Send(ctx context.Context, m Message) error {
+	if err := check(f.From, m); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.Dir, 0o755); err != nil {
+		return err
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%s-%d.eml", now.Format("20060102-150405"), f.seq.Add(1))
+	return os.WriteFile(filepath.Join(f.Dir, name), m.Bytes(f.From, now), 0o600)
+}
+
+// Log prints messages to the standard logger
+type Log struct {
+	From string
+}
+
+func (l Log) Send(ctx context.Context, m Message) error {
+	if err := check(l.From, m); err != nil {
+		return err
+	}
+	log.Printf("Mail to %s: %s\n%s", m.To, m.Subject, m.Body)
+	return nil
+}
@@ -0,0 +1,160 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+		want bool
+	}{
+		{"simple", "user@example.com", true},
+		{"subdomain", "first.last+tag@mail.example.org", true},
+		{"no at", "user.example.com", false},
+		{"no domain dot", "user@localhost", false},
+		{"two at", "a@b@example.com", false},
+		{"empty local", "@example.com", false},
+		{"header injection", "user@example.com\r\nBcc: x@example.com", false},
+		{"list", "a@example.com, b@example.com", false},
+		{"trailing dot", "user@example.", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidAddress(tt.addr); got != tt.want {
+				t.Errorf("ValidAddress(%q) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+	m := Message{To: "user@example.com", Subject: "Сброс пароля", Body: "Hello\nline two\n"}
+	got := string(m.Bytes("noreply@example.com", time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)))
+	for _, want := range []string{
+		"From: noreply@example.com\r\n",
+		"To: user@example.com\r\n",
+		"Subject: =?utf-8?q?",
+		"Date: Thu, 02 Jan 2025 03:04:05 +0000\r\n",
+		"\r\n\r\nHello\r\nline two\r\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("message doesn't contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	f := &File{Dir: dir, From: "noreply@example.com"}
+	for range 2 {
+		if err := f.Send(context.Background(), Message{To: "user@example.com", Subject: "Hi", Body: "Body"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got %d files, want 2", len(files))
+	}
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "Subject: Hi\r\n") {
+		t.Errorf("unexpected file content:\n%s", b)
+	}
+	if err := f.Send(context.Background(), Message{To: "bad", Subject: "Hi"}); err != ErrInvalidAddress {
+		t.Errorf("invalid address: got %v, want %v", err, ErrInvalidAddress)
+	}
+}
+
+// fakeSMTP accepts a single message without extensions and returns the envelope and data
+func fakeSMTP(t *testing.T) (string, <-chan []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		write := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		write("220 fake ESMTP")
+		lines := []string{}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmd := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				write("250 fake")
+			case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+				lines = append(lines, line)
+				write("250 OK")
+			case cmd == "DATA":
+				write("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimRight(line, "\r\n")
+					if line == "." {
+						break
+					}
+					lines = append(lines, line)
+				}
+				write("250 queued")
+			case cmd == "QUIT":
+				write("221 bye")
+				received <- lines
+				return
+			default:
+				write("502 not implemented")
+			}
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestSMTP(t *testing.T) {
+	addr, received := fakeSMTP(t)
+	s := &SMTP{Addr: addr, From: "noreply@example.com"}
+	m := Message{To: "user@example.com", Subject: "Reset", Body: "Follow the link\n.\nBye"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Send(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	select {
+	case lines = <-received:
+	case <-ctx.Done():
+		t.Fatal("message not received")
+	}
+	got := strings.Join(lines, "\n")
+	for _, want := range []string{"MAIL FROM:<noreply@example.com>", "RCPT TO:<user@example.com>", "Subject: Reset", "Follow the link\n..\nBye"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("session doesn't contain %q:\n%s", want, got)
+		}
+	}
+}
@@ -1,11 +1,25 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
+	"movie_db/blob"
 	"movie_db/db"
+	"movie_db/filter"
+	"movie_db/live"
+	"movie_db/mail"
 	"movie_db/movie"
+	"movie_db/oidc"
+	"movie_db/poster"
+	"movie_db/webauthn"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -56,17 +70,228 @@ func hourly() {
 			if err := movie.SM.Shrink(); err != nil {
 				log.Printf("Error shrinking sessions: %s", err)
 			}
+			if err := movie.CleanExports(context.Background()); err != nil {
+				log.Printf("Error cleaning data exports: %s", err)
+			}
+			if localBlobs != nil {
+				if _, err := localBlobs.Prune(context.Background()); err != nil {
+					log.Printf("Error pruning blobs: %s", err)
+				}
+			}
 			<-t.C
 		}
 	}()
 }
 
+// flushSessions writes renewed sessions to DB in batches
+func flushSessions() {
+	go func() {
+		t := time.NewTicker(movie.FlushInterval)
+		for range t.C {
+			if err := movie.SM.Flush(); err != nil {
+				log.Printf("Error writing session renewals: %s", err)
+			}
+		}
+	}()
+}
+
+// pollSessions applies session changes made by other instances sharing the DB
+func pollSessions() {
+	go func() {
+		t := time.NewTicker(movie.PollInterval)
+		for range t.C {
+			if err := movie.SM.Poll(); err != nil {
+				log.Printf("Error polling session changes: %s", err)
+			}
+		}
+	}()
+}
+
+// Optional settings from environment, defaults are kept if not set
+func config() {
+	if v, err := strconv.Atoi(os.Getenv("MOVIE_DB_REPLY_DEPTH")); err == nil && v > 0 {
+		movie.MaxReplyDepth = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("MOVIE_DB_REPORTS_TO_HIDE")); err == nil && v > 0 {
+		movie.ReportsToHide = v
+	}
+	movie.CommentFilter = filter.Default()
+	//Comma separated words or phrases
+	forbidden, suspicious := os.Getenv("MOVIE_DB_FORBIDDEN_WORDS"), os.Getenv("MOVIE_DB_SUSPICIOUS_WORDS")
+	if forbidden != "" || suspicious != "" {
+		movie.CommentFilter = append(movie.CommentFilter, filter.WordList{
+			Reject: strings.Split(forbidden, ","),
+			Hold:   strings.Split(suspicious, ","),
+		})
+	}
+	if v, err := strconv.Atoi(os.Getenv("MOVIE_DB_LIVE_PER_MOVIE")); err == nil && v > 0 {
+		movie.MaxStreamsPerMovie = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("MOVIE_DB_LIVE_TOTAL")); err == nil && v > 0 {
+		movie.MaxStreams = v
+	}
+	if v, err := strconv.ParseBool(os.Getenv("MOVIE_DB_ADMIN_2FA")); err == nil {
+		movie.RequireAdmin2FA = v
+	}
+	//Session lifetimes as durations, e.g. "12h". Remember me sessions use the REMEMBER limits
+	if v, err := time.ParseDuration(os.Getenv("MOVIE_DB_SESSION_IDLE")); err == nil && v > 0 {
+		movie.DefaultSessions.Idle = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("MOVIE_DB_SESSION_MAX")); err == nil && v > 0 {
+		movie.DefaultSessions.Absolute = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("MOVIE_DB_REMEMBER_IDLE")); err == nil && v > 0 {
+		movie.RememberSessions.Idle = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("MOVIE_DB_REMEMBER_MAX")); err == nil && v > 0 {
+		movie.RememberSessions.Absolute = v
+	}
+	//How soon logins and logouts on other instances sharing the DB are seen
+	if v, err := time.ParseDuration(os.Getenv("MOVIE_DB_SESSION_POLL")); err == nil && v > 0 {
+		movie.PollInterval = v
+	}
+}
+
+// localBlobs is set when blobs are kept on local disk, which needs periodic pruning
+var localBlobs *blob.Local
+
+// Blob storage for posters. MOVIE_DB_BLOB selects "local" (default) or "s3".
+// Local blobs and posters of the old layout are kept in MOVIE_DB_DATA_DIR
+func storage() {
+	dataDir := os.Getenv("MOVIE_DB_DATA_DIR")
+	if dataDir == "" {
+		dataDir = "assets"
+	}
+	var blobs blob.Store
+	switch kind := os.Getenv("MOVIE_DB_BLOB"); kind {
+	case "", "local":
+		local, err := blob.NewLocal(filepath.Join(dataDir, "blobs"))
+		if err != nil {
+			log.Fatalf("Error creating blob store: %s", err)
+		}
+		localBlobs, blobs = local, local
+	case "s3":
+		blobs = &blob.S3{
+			Endpoint:  os.Getenv("MOVIE_DB_S3_ENDPOINT"),
+			Bucket:    os.Getenv("MOVIE_DB_S3_BUCKET"),
+			Region:    os.Getenv("MOVIE_DB_S3_REGION"),
+			AccessKey: os.Getenv("MOVIE_DB_S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("MOVIE_DB_S3_SECRET_KEY"),
+			Client:    &http.Client{Timeout: 30 * time.Second},
+		}
+	default:
+		log.Fatalf("Unknown blob store %q", kind)
+	}
+	movie.Posters = poster.Store{Blobs: blobs}
+	movie.Exports = blobs
+	n, err := movie.Posters.Import(context.Background(), filepath.Join(dataDir, "posters"))
+	if err != nil {
+		log.Printf("Error importing posters: %s", err)
+	}
+	if n > 0 {
+		log.Printf("Imported %d poster files into blob store", n)
+	}
+}
+
+// Mail sender for password reset and email verification. MOVIE_DB_MAIL selects
+// "log" (default), "file" to write messages into MOVIE_DB_MAIL_DIR or "smtp"
+func mailer() {
+	from := os.Getenv("MOVIE_DB_MAIL_FROM")
+	if from == "" {
+		from = "noreply@movie-db.local"
+	}
+	switch kind := os.Getenv("MOVIE_DB_MAIL"); kind {
+	case "", "log":
+		movie.Mail = mail.Log{From: from}
+	case "file":
+		dir := os.Getenv("MOVIE_DB_MAIL_DIR")
+		if dir == "" {
+			dir = "outbox"
+		}
+		movie.Mail = &mail.File{Dir: dir, From: from}
+	case "smtp":
+		movie.Mail = &mail.SMTP{
+			Addr:     os.Getenv("MOVIE_DB_SMTP_ADDR"),
+			Username: os.Getenv("MOVIE_DB_SMTP_USERNAME"),
+			Password: os.Getenv("MOVIE_DB_SMTP_PASSWORD"),
+			From:     from,
+		}
+	default:
+		log.Fatalf("Unknown mail sender %q", kind)
+	}
+	//Links in emails must not depend on Host header of the request
+	movie.BaseURL = strings.TrimSuffix(os.Getenv("MOVIE_DB_BASE_URL"), "/")
+	if movie.BaseURL == "" {
+		movie.BaseURL = "https://localhost"
+		log.Printf("MOVIE_DB_BASE_URL is not set, links in emails point to %s", movie.BaseURL)
+	}
+}
+
+// Relying party of passkeys on the site address. MOVIE_DB_WEBAUTHN_RP_ID can widen it to a parent domain
+func webAuthn() {
+	u, err := url.Parse(movie.BaseURL)
+	if err != nil || u.Host == "" {
+		log.Fatalf("Error parsing base URL %q: %v", movie.BaseURL, err)
+	}
+	id := os.Getenv("MOVIE_DB_WEBAUTHN_RP_ID")
+	if id == "" {
+		id = u.Hostname()
+	}
+	movie.RP = &webauthn.RelyingParty{ID: id, Name: "Movie DB", Origin: u.Scheme + "://" + u.Host}
+}
+
+// OpenID Connect login providers. MOVIE_DB_OIDC_PROVIDERS lists names, e.g. "google,gitlab", settings of
+// each are read from MOVIE_DB_OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET and optional _LABEL.
+// Redirect address to register with the provider is <base URL>/login/oidc/<name>/callback
+func sso() {
+	names := os.Getenv("MOVIE_DB_OIDC_PROVIDERS")
+	if names == "" {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !providerName.MatchString(name) {
+			log.Fatalf("Wrong login provider name %q", name)
+		}
+		prefix := "MOVIE_DB_OIDC_" + strings.ToUpper(name) + "_"
+		p := &oidc.Provider{
+			Name:         name,
+			Label:        os.Getenv(prefix + "LABEL"),
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  movie.BaseURL + "/login/oidc/" + name + "/callback",
+			Scopes:       []string{"email", "profile"},
+			Client:       client,
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			log.Fatalf("%sISSUER and %sCLIENT_ID must be set", prefix, prefix)
+		}
+		if p.Label == "" {
+			p.Label = name
+		}
+		movie.Providers = append(movie.Providers, p)
+	}
+}
+
+var providerName = regexp.MustCompile(`^[a-z0-9]{1,32}$`)
+
 func main() {
+	config()
+	storage()
+	mailer()
+	webAuthn()
+	sso()
 	movie.Sessions = movie.NewSessionsStore()
+	movie.CommentsHub = live.NewHub[movie.CommentEvent](movie.MaxStreamsPerMovie, movie.MaxStreams, 16)
 	db.Connect()
 	defer db.DB.Close()
 	movie.SM = &movie.SessionManager{DB: db.DB, Cache: movie.Sessions}
 	movie.SM.InitSync()
+	flushSessions()
+	pollSessions()
+	movie.ResumeExports()
 	hourly()
 	server()
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"log"
 	"movie_db/movie"
+	"movie_db/utils"
 	"net/http"
 )
 
@@ -30,11 +31,19 @@ func (rr *ResponseRecorder) WriteHeader(code int) {
 	rr.ResponseWriter.WriteHeader(code)
 }
 
+// Only error responses are kept, they are the ones being logged. Long streams would grow the buffer endlessly
 func (rr *ResponseRecorder) Write(b []byte) (int, error) {
-	rr.Body.Write(b)
+	if rr.StatusCode >= 400 {
+		rr.Body.Write(b)
+	}
 	return rr.ResponseWriter.Write(b)
 }
 
+// Unwrap lets http.ResponseController reach Flush of the underlying writer
+func (rr *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
 func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
 	return &ResponseRecorder{ResponseWriter: w, StatusCode: http.StatusOK, Body: &bytes.Buffer{}}
 }
@@ -50,6 +59,18 @@ func Logging(next http.Handler) http.Handler {
 	})
 }
 
+// Activity renews the session of a logged in user on every request, so active users stay logged in
+func Activity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("session_token"); err == nil && cookie.Value != "" {
+			if session, ok := movie.Sessions.Get(utils.HashToken(cookie.Value)); ok {
+				movie.SM.Seen(cookie.Value, session, movie.ClientIP(r))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		cookie, err := r.Cookie("session_token")
@@ -57,7 +78,7 @@ func Auth(next http.Handler) http.Handler {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		session, ok := movie.Sessions.Get(cookie.Value)
+		session, ok := movie.Sessions.Get(utils.HashToken(cookie.Value))
 		if !ok {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
@@ -80,6 +101,10 @@ func Admin(next http.Handler) http.Handler {
 			http.Error(w, "Forbidden: no admin access!", http.StatusForbidden)
 			return
 		}
+		if movie.RequireAdmin2FA && !session.MFA {
+			http.Error(w, "Forbidden: log in with two-factor authentication or a passkey to use admin access!", http.StatusForbidden)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,287 @@
+package movie
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"movie_db/db"
+	"movie_db/utils"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const sessionTokenLength int = 32
+
+// setSessionCookie sets the session token cookie. Cookie of a session without remember me ends with
+// the browser session, server ends the session earlier when it's idle
+func setSessionCookie(w http.ResponseWriter, token string, remember bool) {
+	cookie := &http.Cookie{
+		Name:     "session_token",
+		Value:    token,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		Path:     "/",
+	}
+	if remember {
+		cookie.Expires = time.Now().Add(RememberSessions.Absolute)
+	}
+	http.SetCookie(w, cookie)
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Expires:  time.Now().Add(-time.Hour),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		Path:     "/",
+	})
+}
+
+// logIn creates a session for the device of the request with a new token and sets the cookie.
+// Session the request came with is ended, so a token planted before login can't be used after it
+func logIn(w http.ResponseWriter, r *http.Request, session Session) error {
+	if cookie, err := r.Cookie("session_token"); err == nil && cookie.Value != "" {
+		if err := SM.Delete(cookie.Value); err != nil {
+			return err
+		}
+	}
+	token, err := utils.GenerateToken(sessionTokenLength)
+	if err != nil {
+		return err
+	}
+	if err := SM.Create(withClient(r, session), token); err != nil {
+		return err
+	}
+	setSessionCookie(w, token, session.Remember)
+	return nil
+}
+
+// rotateSession gives the session of the request a new token after a privilege change.
+// mfa is set when the user has just verified a second factor
+func rotateSession(w http.ResponseWriter, r *http.Request, session Session, mfa bool) error {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return err
+	}
+	token, err := SM.Rotate(session.UserId, cookie.Value, mfa)
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, token, session.Remember)
+	return nil
+}
+
+// errNoPassword is returned for accounts created with single sign-on that haven't set a password yet
+var errNoPassword = errors.New("password is not set")
+
+// noPasswordMessage tells a user without a password how to confirm sensitive actions
+const noPasswordMessage = "Your account has no password yet, set one in account settings first!"
+
+// checkPassword reports whether password is the current password of the user.
+// Fails with errNoPassword when the user never set one
+func checkPassword(userId int, password string) (bool, error) {
+	var hash string
+	var passwordSet bool
+	query := `SELECT password, passwordSet FROM users WHERE userId = ?`
+	if err := db.DB.QueryRow(query, userId).Scan(&hash, &passwordSet); err != nil {
+		return false, err
+	}
+	if !passwordSet {
+		return false, errNoPassword
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+}
+
+func (h *Handler) GetAccountPage(w http.ResponseWriter, r *http.Request) {
+	const wrapperName, contentName string = "index", "account-page"
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in GetAccountPage")
+		return
+	}
+	account := accountContext{Session: session}
+	var email, pending sql.NullString
+	query := `SELECT u.email, (SELECT t.email FROM usertokens t WHERE t.userId = u.userId AND t.purpose = ? AND t.expiresDT > NOW()), u.passwordSet
+		FROM users u WHERE u.userId = ?`
+	if err := db.DB.QueryRow(query, TokenVerify, session.UserId).Scan(&email, &pending, &account.PasswordSet); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting account email: %s", err)
+		return
+	}
+	account.Email, account.PendingEmail = email.String, pending.String
+	if err := utils.TemplateWrap(tmpl, w, contentName, account, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+// ChangePassword replaces the password and logs out all other sessions of the user.
+// Current session gets a new token, so a stolen copy of the old one stops working too.
+// Users created with single sign-on set their first password without the current one
+func (h *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	currentPassword := r.PostFormValue("currentPassword")
+	password := r.PostFormValue("password")
+	confirmPassword := r.PostFormValue("confirmPassword")
+	if password == "" {
+		http.Error(w, "Password can't be empty!", http.StatusBadRequest)
+		return
+	}
+	if password != confirmPassword {
+		http.Error(w, "Passwords don't match!", http.StatusBadRequest)
+		return
+	}
+	if !utils.PasswordAnalysis(password) {
+		http.Error(w, "Password doesn't meet the requirements!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in ChangePassword")
+		return
+	}
+	valid, err := checkPassword(session.UserId, currentPassword)
+	if err == errNoPassword {
+		valid = true
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking password: %s", err)
+		return
+	}
+	if !valid {
+		http.Error(w, "Current password is wrong!", http.StatusBadRequest)
+		return
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error hashing password: %s", err)
+		return
+	}
+	query := `UPDATE users SET password = ?, passwordSet = 1 WHERE userId = ?`
+	if _, err := db.DB.Exec(query, hashedPassword, session.UserId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating password: %s", err)
+		return
+	}
+	if err := SM.KickUser(session.UserId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error kicking user sessions: %s", err)
+		return
+	}
+	if err := logIn(w, r, session); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error creating a session: %s", err)
+		return
+	}
+	w.Write([]byte("Password changed. Other devices were logged out."))
+}
+
+func (h *Handler) ChangeUsername(w http.ResponseWriter, r *http.Request) {
+	username := r.PostFormValue("username")
+	if !utils.UsernameAnalysis(username) {
+		http.Error(w, "Username doesn't meet the requirements!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in ChangeUsername")
+		return
+	}
+	var exists bool
+	query := `SELECT EXISTS(SELECT * FROM users WHERE username = ? AND userId <> ?)`
+	if err := db.DB.QueryRow(query, username, session.UserId).Scan(&exists); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking username existanse in db: %s", err)
+		return
+	}
+	if exists {
+		http.Error(w, "Username already exists!", http.StatusBadRequest)
+		return
+	}
+	query = `UPDATE users SET username = ? WHERE userId = ?`
+	if _, err := db.DB.Exec(query, username, session.UserId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating username: %s", err)
+		return
+	}
+	if err := SM.Rename(session.UserId, username); err != nil {
+		log.Printf("Error recording session change of user %d: %s", session.UserId, err)
+	}
+	w.Header().Add("HX-Redirect", "/auth/account")
+}
+
+// DeleteAccount removes the user after password confirmation. Comments stay and are shown as
+// written by DELETED, ratings are removed and reaction counters of comments are corrected
+func (h *Handler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	password := r.PostFormValue("password")
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in DeleteAccount")
+		return
+	}
+	valid, err := checkPassword(session.UserId, password)
+	if err == errNoPassword {
+		http.Error(w, noPasswordMessage, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking password: %s", err)
+		return
+	}
+	if !valid {
+		http.Error(w, "Password is wrong!", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	queries := []string{
+		`UPDATE comments c JOIN commentreactions cr ON cr.commentId = c.commentId AND cr.userId = ?
+			SET c.upvotes = c.upvotes - (cr.reaction = 1), c.downvotes = c.downvotes - (cr.reaction = -1)`,
+		`DELETE FROM movierating WHERE userId = ?`,
+		`DELETE FROM sessions WHERE userId = ?`,
+		//Remaining user data is removed or anonymized by foreign keys
+		`DELETE FROM users WHERE userId = ?`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, session.UserId); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error deleting account %d: %s", session.UserId, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error committing account deletion: %s", err)
+		return
+	}
+	//Sessions were deleted with the account, other instances still need to drop them
+	SM.Cache.KickUser(session.UserId)
+	if err := SM.changed(session.UserId); err != nil {
+		log.Printf("Error recording session change of user %d: %s", session.UserId, err)
+	}
+	if err := Posters.DeleteAvatar(r.Context(), session.UserId); err != nil {
+		log.Printf("Error deleting avatar of user %d: %s", session.UserId, err)
+	}
+	if err := deleteUserExports(r.Context(), session.UserId); err != nil {
+		log.Printf("Error deleting data exports of user %d: %s", session.UserId, err)
+	}
+	log.Printf("User %d deleted their account", session.UserId)
+	clearSessionCookie(w)
+	w.Header().Add("HX-Redirect", "/")
+}
@@ -0,0 +1,366 @@
+package movie
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"log"
+	"movie_db/blob"
+	"movie_db/db"
+	"movie_db/export"
+	"movie_db/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Exports keeps generated data export archives
+var Exports blob.Store
+
+// Status of a data export
+const (
+	ExportPending string = "pending"
+	ExportReady   string = "ready"
+	ExportFailed  string = "failed"
+)
+
+const (
+	exportLifetime time.Duration = 24 * time.Hour //Download link of a ready export works this long
+	exportCooldown time.Duration = time.Hour      //Minimal time between export requests of a user
+)
+
+// exportSlots limits how many exports are generated at once
+var exportSlots = make(chan struct{}, 2)
+
+type DataExport struct {
+	ExportId    int
+	Status      string
+	Size        int64
+	RequestedDT string
+	ExpiresDT   string
+}
+
+func exportKey(userId, exportId int) string {
+	return "exports/" + strconv.Itoa(userId) + "/" + strconv.Itoa(exportId) + ".zip"
+}
+
+func loadExports(userId int) ([]DataExport, error) {
+	query := `SELECT exportId, status, size, requestedDT, expiresDT FROM dataexports
+		WHERE userId = ? AND (expiresDT IS NULL OR expiresDT > NOW()) ORDER BY exportId DESC`
+	rows, err := db.DB.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	exports := []DataExport{}
+	for rows.Next() {
+		e := DataExport{}
+		var requested time.Time
+		var expires sql.NullTime
+		if err := rows.Scan(&e.ExportId, &e.Status, &e.Size, &requested, &expires); err != nil {
+			return nil, err
+		}
+		e.RequestedDT = requested.Format(time.DateTime)
+		if expires.Valid {
+			e.ExpiresDT = expires.Time.Format(time.DateTime)
+		}
+		exports = append(exports, e)
+	}
+	return exports, rows.Err()
+}
+
+// exportData collects everything the site holds about the user
+func exportData(userId int) (*export.Data, error) {
+	d := &export.Data{GeneratedAt: time.Now()}
+	p := &d.Profile
+	query := `SELECT userId, username, IFNULL(email, ''), displayName, bio, registerDate, admin, watchlistPublic, diaryPublic FROM users WHERE userId = ?`
+	if err := db.DB.QueryRow(query, userId).Scan(&p.UserId, &p.Username, &p.Email, &p.DisplayName, &p.Bio, &p.RegisterDate,
+		&p.Admin, &p.WatchlistPublic, &p.DiaryPublic); err != nil {
+		return nil, err
+	}
+
+	query = `SELECT r.movieId, m.title, r.rating, r.timeStamp FROM movierating r JOIN movies m ON r.movieId = m.movieId
+		WHERE r.userId = ? ORDER BY r.timeStamp`
+	rows, err := db.DB.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := export.Rating{}
+		if err := rows.Scan(&r.MovieId, &r.Title, &r.Rating, &r.RatedAt); err != nil {
+			return nil, err
+		}
+		d.Ratings = append(d.Ratings, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `SELECT c.commentId, c.movieId, m.title, IFNULL(c.parentId, 0), c.comment, c.postedDT, c.editedDT, c.hidden
+		FROM comments c JOIN movies m ON c.movieId = m.movieId WHERE c.userId = ? AND c.deleted = 0 ORDER BY c.commentId`
+	rows, err = db.DB.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := export.Comment{}
+		var edited sql.NullTime
+		if err := rows.Scan(&c.CommentId, &c.MovieId, &c.Title, &c.ParentId, &c.Text, &c.PostedAt, &edited, &c.Hidden); err != nil {
+			return nil, err
+		}
+		if edited.Valid {
+			c.EditedAt = &edited.Time
+		}
+		d.Comments = append(d.Comments, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `SELECT movieId, title, IFNULL(genres, ''), addedDT FROM movies WHERE adderUserId = ? ORDER BY movieId`
+	rows, err = db.DB.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m := export.Movie{}
+		var added sql.NullTime
+		if err := rows.Scan(&m.MovieId, &m.Title, &m.Genres, &added); err != nil {
+			return nil, err
+		}
+		m.AddedAt = added.Time
+		d.Movies = append(d.Movies, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `SELECT createdDT, lastSeenDT, expirationDT, ip, userAgent FROM sessions WHERE userId = ? ORDER BY createdDT`
+	rows, err = db.DB.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s := export.Session{}
+		if err := rows.Scan(&s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.IP, &s.UserAgent); err != nil {
+			return nil, err
+		}
+		d.Sessions = append(d.Sessions, s)
+	}
+	return d, rows.Err()
+}
+
+// runExport generates the archive in background and records the result
+func runExport(exportId, userId int) {
+	exportSlots <- struct{}{}
+	defer func() { <-exportSlots }()
+	err := func() error {
+		d, err := exportData(userId)
+		if err != nil {
+			return err
+		}
+		buf := &bytes.Buffer{}
+		if err := export.Write(buf, d); err != nil {
+			return err
+		}
+		size := buf.Len()
+		if _, err := Exports.Put(context.Background(), exportKey(userId, exportId), buf, export.ContentType); err != nil {
+			return err
+		}
+		query := `UPDATE dataexports SET status = ?, size = ?, expiresDT = ? WHERE exportId = ?`
+		_, err = db.DB.Exec(query, ExportReady, size, time.Now().Add(exportLifetime), exportId)
+		return err
+	}()
+	if err != nil {
+		log.Printf("Error generating data export %d: %s", exportId, err)
+		query := `UPDATE dataexports SET status = ?, expiresDT = ? WHERE exportId = ?`
+		if _, err := db.DB.Exec(query, ExportFailed, time.Now().Add(exportLifetime), exportId); err != nil {
+			log.Printf("Error marking data export %d as failed: %s", exportId, err)
+		}
+	}
+}
+
+// ResumeExports restarts exports interrupted by a restart
+func ResumeExports() {
+	query := `SELECT exportId, userId FROM dataexports WHERE status = ?`
+	rows, err := db.DB.Query(query, ExportPending)
+	if err != nil {
+		log.Printf("Error getting pending data exports: %s", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var exportId, userId int
+		if err := rows.Scan(&exportId, &userId); err != nil {
+			log.Printf("Error scanning pending data export: %s", err)
+			return
+		}
+		go runExport(exportId, userId)
+	}
+}
+
+// CleanExports removes expired exports with their archives
+func CleanExports(ctx context.Context) error {
+	query := `SELECT exportId, userId FROM dataexports WHERE expiresDT < NOW()`
+	rows, err := db.DB.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var exportId, userId int
+		if err := rows.Scan(&exportId, &userId); err != nil {
+			return err
+		}
+		if err := Exports.Delete(ctx, exportKey(userId, exportId)); err != nil {
+			return err
+		}
+		query = `DELETE FROM dataexports WHERE exportId = ?`
+		if _, err := db.DB.Exec(query, exportId); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// deleteUserExports removes archives of a deleted account. Rows are removed by foreign key
+func deleteUserExports(ctx context.Context, userId int) error {
+	list, err := Exports.List(ctx, "exports/"+strconv.Itoa(userId)+"/")
+	if err != nil {
+		return err
+	}
+	for _, info := range list {
+		if err := Exports.Delete(ctx, info.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) GetExportPage(w http.ResponseWriter, r *http.Request) {
+	const wrapperName, contentName string = "index", "export-page"
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in GetExportPage")
+		return
+	}
+	exports, err := loadExports(session.UserId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error loading data exports: %s", err)
+		return
+	}
+	if err := utils.TemplateWrap(tmpl, w, contentName, exports, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+// GetExportList renders export statuses. The list polls itself while an export is pending
+func (h *Handler) GetExportList(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in GetExportList")
+		return
+	}
+	h.renderExportList(w, session.UserId)
+}
+
+// PostExport requests a new export of the user's data
+func (h *Handler) PostExport(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in PostExport")
+		return
+	}
+	var recent bool
+	query := `SELECT EXISTS(SELECT * FROM dataexports WHERE userId = ? AND (status = ? OR (status = ? AND requestedDT > ?)))`
+	if err := db.DB.QueryRow(query, session.UserId, ExportPending, ExportReady, time.Now().Add(-exportCooldown)).Scan(&recent); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking recent data exports: %s", err)
+		return
+	}
+	if recent {
+		http.Error(w, "You can request one export per hour!", http.StatusTooManyRequests)
+		return
+	}
+	query = `INSERT INTO dataexports (userId, status) VALUES (?, ?)`
+	result, err := db.DB.Exec(query, session.UserId, ExportPending)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error inserting data export: %s", err)
+		return
+	}
+	exportId, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting last insert ID: %s", err)
+		return
+	}
+	go runExport(int(exportId), session.UserId)
+	h.renderExportList(w, session.UserId)
+}
+
+// DownloadExport sends a ready archive to its owner until it expires
+func (h *Handler) DownloadExport(w http.ResponseWriter, r *http.Request) {
+	exportId, err := strconv.Atoi(r.PathValue("exportId"))
+	if err != nil || exportId < 0 {
+		http.Error(w, "Wrong export id!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in DownloadExport")
+		return
+	}
+	var available bool
+	query := `SELECT EXISTS(SELECT * FROM dataexports WHERE exportId = ? AND userId = ? AND status = ? AND expiresDT > NOW())`
+	if err := db.DB.QueryRow(query, exportId, session.UserId, ExportReady).Scan(&available); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking data export: %s", err)
+		return
+	}
+	if !available {
+		http.Error(w, "Export not found or expired!", http.StatusNotFound)
+		return
+	}
+	content, info, err := Exports.Get(r.Context(), exportKey(session.UserId, exportId))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error opening data export: %s", err)
+		return
+	}
+	defer content.Close()
+	w.Header().Set("Content-Type", export.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Content-Disposition", `attachment; filename="movie-db-export-`+strconv.Itoa(exportId)+`.zip"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	if _, err := io.Copy(w, content); err != nil {
+		log.Printf("Error sending data export: %s", err)
+	}
+}
+
+func (h *Handler) renderExportList(w http.ResponseWriter, userId int) {
+	const templateName string = "export-list"
+	exports, err := loadExports(userId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error loading data exports: %s", err)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, exports); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
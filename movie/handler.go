@@ -2,13 +2,21 @@ package movie
 
 import (
 	"database/sql"
+	"errors"
 	"html/template"
 	"io"
 	"log"
+	"movie_db/blob"
 	"movie_db/db"
+	"movie_db/filter"
+	"movie_db/format"
+	"movie_db/httpcache"
+	"movie_db/poster"
 	"movie_db/utils"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"time"
 	"unicode/utf8"
@@ -16,7 +24,67 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var tmpl = template.Must(template.ParseGlob("views/*.html"))
+// Posters are kept in the blob store chosen by configuration
+var Posters poster.Store
+
+// noPoster is the placeholder for movies without a poster, relative to the static directory
+const noPoster string = "img/no-poster.svg"
+
+// Static serves files of the static directory with fingerprinted URLs
+var Static = httpcache.NewStatic("static", "/static/")
+
+var tmpl = template.Must(template.New("").Funcs(template.FuncMap{
+	"format": format.Comment,
+	"plain":  format.Plain,
+	"static": Static.URL,
+}).ParseGlob(viewsGlob()))
+
+// viewsGlob finds templates from the site root, where the site runs, or from the package directory,
+// where its tests run
+func viewsGlob() string {
+	if _, err := os.Stat("views"); err != nil {
+		return filepath.Join("..", "views", "*.html")
+	}
+	return filepath.Join("views", "*.html")
+}
+
+// repliesPerQuery is the size of a page of replies
+const repliesPerQuery int = 10
+
+var (
+	errNoParent      = errors.New("parent comment doesn't exist")
+	errDeletedParent = errors.New("parent comment is deleted")
+	errHiddenParent  = errors.New("parent comment is hidden")
+)
+
+// replyParent returns where a reply to the comment is attached, its depth and the author of the comment.
+// Comment is locked until the reply is saved, so it can't be removed in between. Too deep replies are
+// attached to the parent of the comment being replied to
+func replyParent(tx *sql.Tx, commentId int, movieId string) (sql.NullInt64, int, int, error) {
+	var grandParentId sql.NullInt64
+	var depth, authorId int
+	var deleted, hidden bool
+	query := `SELECT parentId, depth, deleted, hidden, IFNULL(userId, 0) FROM comments WHERE commentId = ? AND movieId = ? FOR SHARE`
+	if err := tx.QueryRow(query, commentId, movieId).Scan(&grandParentId, &depth, &deleted, &hidden, &authorId); err != nil {
+		if err == sql.ErrNoRows {
+			return sql.NullInt64{}, 0, 0, errNoParent
+		}
+		return sql.NullInt64{}, 0, 0, err
+	}
+	if deleted {
+		return sql.NullInt64{}, 0, 0, errDeletedParent
+	}
+	if hidden {
+		return sql.NullInt64{}, 0, 0, errHiddenParent
+	}
+	parentId := sql.NullInt64{Int64: int64(commentId), Valid: true}
+	depth++
+	if depth > MaxReplyDepth && grandParentId.Valid {
+		parentId = grandParentId
+		depth--
+	}
+	return parentId, depth, authorId, nil
+}
 
 type Handler struct{}
 
@@ -103,9 +171,36 @@ func (h *Handler) GetMovieByID(w http.ResponseWriter, r *http.Request) {
 	}
 	session := Sessions.GetSessionInfo(r)
 	var userRating float32
+	var watchlisted bool
+	var ownLists []MovieList
 	if session != nil {
 		query = `SELECT rating FROM movierating WHERE userId = ? AND movieId = ?`
 		db.DB.QueryRow(query, session.UserId, id).Scan(&userRating)
+		if watchlisted, err = inWatchlist(session.UserId, id); err != nil {
+			log.Printf("Error checking watchlist: %s", err)
+		}
+		if ownLists, err = userLists(session.UserId, true); err != nil {
+			log.Printf("Error getting user lists: %s", err)
+		}
+	}
+	lists, err := movieLists(id)
+	if err != nil {
+		log.Printf("Error getting lists with movie: %s", err)
+	}
+	media, err := loadMedia(id)
+	if err != nil {
+		log.Printf("Error getting movie media: %s", err)
+	}
+	//Primary poster is shown on its own, primary backdrop is the page banner
+	var backdrop *Media
+	gallery := []Media{}
+	for i, m := range media {
+		switch {
+		case m.Primary && m.Kind == MediaBackdrop:
+			backdrop = &media[i]
+		case !(m.Primary && m.Kind == MediaPoster):
+			gallery = append(gallery, m)
+		}
 	}
 
 	context := &struct {
@@ -113,7 +208,15 @@ func (h *Handler) GetMovieByID(w http.ResponseWriter, r *http.Request) {
 		Genres     []string
 		Session    *Session
 		UserRating float32
-	}{Movie: movie, Genres: movie.SplitGenresString(), Session: session, UserRating: userRating}
+		Watchlist  watchlistButton
+		Today      string
+		Lists      []MovieList
+		OwnLists   []MovieList
+		Backdrop   *Media
+		Gallery    []Media
+	}{Movie: movie, Genres: movie.SplitGenresString(), Session: session, UserRating: userRating,
+		Watchlist: watchlistButton{id, watchlisted}, Today: time.Now().Format(time.DateOnly),
+		Lists: lists, OwnLists: ownLists, Backdrop: backdrop, Gallery: gallery}
 
 	if err = utils.TemplateWrap(tmpl, w, contentName, context, wrapperName, nil); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -122,22 +225,35 @@ func (h *Handler) GetMovieByID(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GetPoster serves movie poster. Query parameter size selects full poster or thumbnail.
+// Movies without a poster are redirected to the placeholder image
 func (h *Handler) GetPoster(w http.ResponseWriter, r *http.Request) {
-	fileBytes, err := os.ReadFile("assets/posters/" + r.PathValue("id") + ".png")
+	//Posters can be replaced under the same address, so they are cached for a limited time
+	const cacheControl string = "public, max-age=3600"
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 0 {
+		http.Error(w, "Wrong id!", http.StatusBadRequest)
+		return
+	}
+	size, err := poster.ParseSize(r.FormValue("size"))
 	if err != nil {
-		fileBytes, err = os.ReadFile("assets/posters/no-poster.png")
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			log.Printf("Error reading the default poster: %s", err)
-			return
-		}
+		http.Error(w, "Wrong poster size!", http.StatusBadRequest)
+		return
 	}
-	w.Header().Set("Content-Type", "application/octet-stream")
-	if _, err = w.Write(fileBytes); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error writing writing image to response: %s", err)
+	content, info, err := openPoster(r.Context(), id, size)
+	if err != nil {
+		if err != blob.ErrNotFound {
+			log.Printf("Error opening poster: %s", err)
+		}
+		//Short lived, so a newly uploaded poster shows up soon
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		http.Redirect(w, r, Static.URL(noPoster), http.StatusFound)
 		return
 	}
+	defer content.Close()
+	if err := httpcache.ServeReader(w, r, info.ETag, info.ModTime, info.ContentType, cacheControl, content); err != nil {
+		log.Printf("Error serving poster: %s", err)
+	}
 }
 
 func (h *Handler) AddMoviePage(w http.ResponseWriter, r *http.Request) {
@@ -175,7 +291,8 @@ func (h *Handler) PostMovie(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) DeleteMovie(w http.ResponseWriter, r *http.Request) {
 	const templateName string = "deleted-movie"
 	idStr := r.PathValue("id")
-	if id, err := strconv.Atoi(idStr); err != nil || id < 0 {
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id < 0 {
 		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
 		return
 	}
@@ -190,8 +307,10 @@ func (h *Handler) DeleteMovie(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Movie doesn't exist!", http.StatusBadRequest)
 		return
 	}
-	//Potential error is not handled because poster may not exist
-	os.Remove("assets/posters/" + idStr + ".png")
+	//Media rows are deleted with the movie, images are removed from the blob store here
+	if err := Posters.DeleteMovie(r.Context(), id); err != nil {
+		log.Printf("Error deleting images of movie %d: %s", id, err)
+	}
 	if err = tmpl.ExecuteTemplate(w, templateName, nil); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Error executing template %s: %s", templateName, err)
@@ -249,76 +368,94 @@ func (h *Handler) UpdateMovie(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) UpdatePoster(w http.ResponseWriter, r *http.Request) {
-	const MB int64 = 1 << 20 //megabyte size
 	strId := r.PathValue("id")
 	id, err := strconv.Atoi(strId)
 	if err != nil || id < 0 {
 		http.Error(w, "Wrong id!", http.StatusBadRequest)
 		return
 	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in UpdatePoster")
+		return
+	}
 
 	var exists bool
 	query := `SELECT EXISTS(SELECT * FROM movies WHERE movieId = ?)`
 	if err := db.DB.QueryRow(query, id).Scan(&exists); err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Movie doesn't exist!", http.StatusBadRequest)
-			return
-		}
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Problem with db: %s", err)
 		return
 	}
-	if err := r.ParseMultipartForm(MB); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error while parsing the file: %s", err)
+	if !exists {
+		http.Error(w, "Movie doesn't exist!", http.StatusBadRequest)
 		return
 	}
-	formFile, header, err := r.FormFile("file")
+	data, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
+	images, err := poster.Process(data)
 	if err != nil {
+		uploadError(w, err, poster.Portrait)
+		return
+	}
+	//Uploaded poster joins the gallery and replaces the shown one
+	if _, err := addMedia(r.Context(), id, session.UserId, MediaPoster, "", images, true); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error retrieving the file: %s", err)
+		log.Printf("Error saving poster: %s", err)
 		return
 	}
+	w.Header().Add("HX-Redirect", "/movie/"+strId)
+}
+
+// readUpload reads image file of the multipart form. Error response is written if ok is false
+func readUpload(w http.ResponseWriter, r *http.Request) (data []byte, ok bool) {
+	const MB int64 = 1 << 20 //megabyte size
+	//Room for multipart headers on top of the file itself
+	r.Body = http.MaxBytesReader(w, r.Body, poster.MaxUploadSize+MB)
+	if err := r.ParseMultipartForm(MB); err != nil {
+		http.Error(w, "File is larger than "+strconv.FormatInt(poster.MaxUploadSize/MB, 10)+"MB!", http.StatusBadRequest)
+		return nil, false
+	}
+	formFile, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "No file uploaded!", http.StatusBadRequest)
+		return nil, false
+	}
 	defer func() {
 		if err = formFile.Close(); err != nil {
 			log.Printf("Error closing the file: %s", err)
 			return
 		}
 	}()
-	if header.Size > 1*MB {
-		http.Error(w, "File larger than 1MB!", http.StatusBadRequest)
-		return
+	if header.Size > poster.MaxUploadSize {
+		http.Error(w, "File is larger than "+strconv.FormatInt(poster.MaxUploadSize/MB, 10)+"MB!", http.StatusBadRequest)
+		return nil, false
 	}
-	formFileBytes, err := io.ReadAll(formFile)
+	data, err = io.ReadAll(formFile)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Error reading the file: %s", err)
-		return
-	}
-	if ct := http.DetectContentType(formFileBytes); ct != "image/png" {
-		http.Error(w, "File is not a png image!", http.StatusBadRequest)
-		return
-	}
-	newFile, err := os.Create("assets/posters/" + strId + ".png")
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error creating the file: %s", err)
-		return
+		return nil, false
 	}
-	defer func() {
-		if err := newFile.Close(); err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			log.Printf("Error closing new file on server: %s", err)
-			return
-		}
-	}()
-	if _, err = newFile.Write(formFileBytes); err != nil {
+	return data, true
+}
+
+// uploadError writes response for an error of image processing
+func uploadError(w http.ResponseWriter, err error, layout poster.Layout) {
+	switch err {
+	case poster.ErrFormat:
+		http.Error(w, "File is not a png, jpeg or webp image!", http.StatusBadRequest)
+	case poster.ErrTooSmall:
+		http.Error(w, "Image must be at least "+strconv.Itoa(layout.MinWidth)+"x"+strconv.Itoa(layout.MinHeight)+" pixels!", http.StatusBadRequest)
+	case poster.ErrTooLarge:
+		http.Error(w, "Image dimensions are too large!", http.StatusBadRequest)
+	default:
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error writing the wile on disc: %s", err)
-		return
+		log.Printf("Error processing image: %s", err)
 	}
-	//"File uploaded. Size: " + strconv.FormatInt(header.Size, 10)
-	w.Header().Add("HX-Redirect", "/movie/"+strId)
 }
 
 func (h *Handler) GetAllMovies(w http.ResponseWriter, r *http.Request) {
@@ -351,7 +488,7 @@ func (h *Handler) PostRegister(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Passwords don't match!", http.StatusBadRequest)
 		return
 	}
-	if !utils.UsernameAnalysis(password) {
+	if !utils.UsernameAnalysis(username) {
 		http.Error(w, "Username doesn't meet the requirements!", http.StatusBadRequest)
 		return
 	}
@@ -404,17 +541,18 @@ func (h *Handler) GetRegistrationPage(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
-	const tokenLenght = 32
 	username := r.PostFormValue("username")
 	password := r.PostFormValue("password")
+	remember := r.PostFormValue("remember") == "on"
 	if username == "" || password == "" {
 		http.Error(w, "Username or password can't be empty!", http.StatusBadRequest)
 		return
 	}
-	query := `SELECT userId, password, admin, banUntil FROM users WHERE username = ?`
+	query := `SELECT userId, password, admin, banUntil, totpSecret IS NOT NULL FROM users WHERE username = ?`
 	user := &User{}
 	banUntil := &time.Time{}
-	if err := db.DB.QueryRow(query, username).Scan(&user.Id, &user.Password, &user.Admin, banUntil); err != nil {
+	var twoFactor bool
+	if err := db.DB.QueryRow(query, username).Scan(&user.Id, &user.Password, &user.Admin, banUntil, &twoFactor); err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Invalid username or password!", http.StatusUnauthorized)
 			return
@@ -431,33 +569,29 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "You are banned until "+banUntil.Format(time.DateTime), http.StatusForbidden)
 		return
 	}
-	token, err := utils.GenerateToken(tokenLenght)
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error generating token: %s", err)
+	if twoFactor {
+		//Session is created after the second step
+		token, err := createLoginChallenge(user.Id, remember)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error creating login challenge: %s", err)
+			return
+		}
+		setChallengeCookie(w, token, time.Now().Add(loginChallengeLifetime))
+		w.Header().Add("HX-Redirect", "/login/2fa")
 		return
 	}
-	session := Session{user.Id, username, user.Admin, time.Now().Add(time.Hour * 24)}
-	if err := SM.Create(session, token); err != nil {
+	if err := logIn(w, r, Session{UserId: user.Id, Username: username, Admin: user.Admin, Remember: remember}); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Error creating a session: %s", err)
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_token",
-		Value:    token,
-		Expires:  session.Expires,
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
-		Path:     "/",
-	})
 	w.Header().Add("HX-Redirect", "/")
 }
 
 func (h *Handler) GetLoginPage(w http.ResponseWriter, r *http.Request) {
 	const wrapperName, contentName string = "index", "login-block"
-	if err := utils.TemplateWrap(tmpl, w, contentName, nil, wrapperName, nil); err != nil {
+	if err := utils.TemplateWrap(tmpl, w, contentName, ssoProviderLinks(), wrapperName, nil); err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
 		return
@@ -477,15 +611,7 @@ func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Error deleteing a session: %s", err)
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_token",
-		Value:    "",
-		Expires:  time.Now().Add(-time.Hour),
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
-		Path:     "/",
-	})
+	clearSessionCookie(w)
 	w.Header().Add("HX-Redirect", "/")
 }
 
@@ -519,19 +645,109 @@ func (h *Handler) PostComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query = `INSERT INTO comments (userId, movieId, comment) VALUES (?, ?, ?)`
-	res, err := db.DB.Exec(query, session.UserId, movieId, comment)
+	replyTo := -1
+	if v := r.PostFormValue("parentId"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 0 {
+			http.Error(w, "Wrong parent comment id!", http.StatusBadRequest)
+			return
+		}
+		replyTo = id
+	}
+
+	verdict, err := checkComment(session.UserId, comment, false)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking comment with filter: %s", err)
+		return
+	}
+	if verdict.Verdict == filter.Reject {
+		http.Error(w, verdict.Reason+"!", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	var parentId sql.NullInt64
+	var depth, parentAuthorId int
+	if replyTo >= 0 {
+		parentId, depth, parentAuthorId, err = replyParent(tx, replyTo, movieId)
+		switch {
+		case errors.Is(err, errNoParent):
+			http.Error(w, "Parent comment doesn't exist!", http.StatusBadRequest)
+			return
+		case errors.Is(err, errDeletedParent):
+			http.Error(w, "Can't reply to a deleted comment!", http.StatusBadRequest)
+			return
+		case errors.Is(err, errHiddenParent):
+			http.Error(w, "Can't reply to a hidden comment!", http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Printf("Error getting parent comment from db: %s", err)
+			return
+		}
+	}
+	query = `INSERT INTO comments (userId, movieId, comment, parentId, depth) VALUES (?, ?, ?, ?, ?)`
+	res, err := tx.Exec(query, session.UserId, movieId, comment, parentId, depth)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Error inserting comment into db: %s", err)
 		return
 	}
-	_, err = res.LastInsertId()
+	commentId, err := res.LastInsertId()
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Error getting last insert ID: %s", err)
 		return
 	}
+	held := verdict.Verdict == filter.Hold
+	if held {
+		if err := holdComment(tx, int(commentId), session.UserId, verdict.Reason); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error holding comment for moderation: %s", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error commiting transaction: %s", err)
+		return
+	}
+	//Held comment stays unseen until a moderator approves it
+	if !held {
+		movieIdInt, _ := strconv.Atoi(movieId)
+		notifyComment(session.UserId, int(commentId), movieIdInt, parentAuthorId, comment)
+		publishComment(movieIdInt, CommentEvent{Kind: commentNew, ActorId: session.UserId, Comment: CommentsContext{Comment: Comment{
+			CommentId:   int(commentId),
+			UserId:      session.UserId,
+			CommentText: comment,
+			PostedDT:    time.Now().Format(time.DateTime),
+			Username:    session.Username,
+			MovieId:     movieId,
+			ParentId:    int(parentId.Int64),
+			Depth:       depth,
+		}}})
+	}
+	if parentId.Valid {
+		//Reply form targets the replies of the comment, but reply may have been attached higher
+		var position int
+		query = `SELECT COUNT(*) FROM comments WHERE parentId = ? AND commentId <= ?`
+		if err := db.DB.QueryRow(query, parentId.Int64, commentId).Scan(&position); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error getting reply position: %s", err)
+			return
+		}
+		//All pages up to the one with the new reply replace the replies shown
+		pages := (position + repliesPerQuery - 1) / repliesPerQuery
+		w.Header().Add("HX-Retarget", "#replies"+strconv.FormatInt(parentId.Int64, 10))
+		renderReplies(w, r, int(parentId.Int64), 0, pages*repliesPerQuery)
+		return
+	}
 	if err := tmpl.ExecuteTemplate(w, templateName, movieId); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Error executing template %s: %s", templateName, err)
@@ -539,10 +755,45 @@ func (h *Handler) PostComment(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// removeComment deletes comment on behalf of the user. Comments with replies are replaced by a tombstone
+// to keep the thread. Returns movie of the comment, whether a tombstone was left and the number of affected rows.
+// Caller publishes the removal with publishRemoval after commit
+func removeComment(tx *sql.Tx, userId int, commentId string) (int, bool, int64, error) {
+	//Lock keeps new replies waiting until the comment is removed, so none is left without its parent
+	var movieId int
+	query := `SELECT movieId FROM comments WHERE commentId = ? FOR UPDATE`
+	if err := tx.QueryRow(query, commentId).Scan(&movieId); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, 0, nil
+		}
+		return 0, false, 0, err
+	}
+	var hasReplies bool
+	query = `SELECT EXISTS(SELECT * FROM comments WHERE parentId = ?)`
+	if err := tx.QueryRow(query, commentId).Scan(&hasReplies); err != nil {
+		return 0, false, 0, err
+	}
+	query = `CALL DeleteComment(?, ?)`
+	if hasReplies {
+		query = `CALL TombstoneComment(?, ?)`
+	}
+	sqlRes, err := tx.Exec(query, userId, commentId)
+	if err != nil {
+		return 0, false, 0, err
+	}
+	n, _ := sqlRes.RowsAffected()
+	return movieId, hasReplies, n, nil
+}
+
+func publishRemoval(movieId, commentId, actorId int, tombstone bool) {
+	publishComment(movieId, CommentEvent{Kind: commentDelete, Comment: CommentsContext{Comment: Comment{CommentId: commentId}}, ActorId: actorId, Tombstone: tombstone})
+}
+
 func (h *Handler) DeleteComment(w http.ResponseWriter, r *http.Request) {
 	const templateName string = "deleted-comment"
 	commentId := r.PathValue("commentId")
-	if v, err := strconv.Atoi(commentId); err != nil || v < 0 {
+	id, err := strconv.Atoi(commentId)
+	if err != nil || id < 0 {
 		http.Error(w, "Wrong comment id!", http.StatusBadRequest)
 		return
 	}
@@ -552,18 +803,33 @@ func (h *Handler) DeleteComment(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Error getting session from context in DeleteComment")
 		return
 	}
-	query := `CALL DeleteComment(?, ?)`
-	sqlRes, err := db.DB.Exec(query, session.UserId, commentId)
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	movieId, hasReplies, n, err := removeComment(tx, session.UserId, commentId)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Error deleting comment from db: %s", err)
 		return
 	}
-	if n, _ := sqlRes.RowsAffected(); n == 0 {
+	if n == 0 {
 		http.Error(w, "Comment doesn't exist or you are not the author", http.StatusBadRequest)
 		return
 	}
-	if err := tmpl.ExecuteTemplate(w, templateName, nil); err != nil {
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error commiting transaction: %s", err)
+		return
+	}
+	publishRemoval(movieId, id, session.UserId, hasReplies)
+	if hasReplies {
+		w.Header().Add("HX-Retarget", "#comment"+commentId)
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, hasReplies); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Error executing template %s: %s", templateName, err)
 		return
@@ -572,8 +838,8 @@ func (h *Handler) DeleteComment(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) UpdateComment(w http.ResponseWriter, r *http.Request) {
 	const templateName string = "comment"
-	commentId := r.PostFormValue("commentId")
-	if v, err := strconv.Atoi(commentId); err != nil || v < 0 {
+	commentId, err := strconv.Atoi(r.PostFormValue("commentId"))
+	if err != nil || commentId < 0 {
 		http.Error(w, "Wrong comment id!", http.StatusBadRequest)
 		return
 	}
@@ -588,22 +854,106 @@ func (h *Handler) UpdateComment(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Error getting session from context in UpdateComment")
 		return
 	}
-	query := `CALL SetComment(?, ?, ?)`
-	sqlRes, err := db.DB.Exec(query, session.UserId, commentId, comment)
+	tx, err := db.DB.Begin()
 	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	var ownerId sql.NullInt64
+	var oldComment string
+	var movieId int
+	var hidden, deleted bool
+	query := `SELECT userId, comment, movieId, hidden, deleted FROM comments WHERE commentId = ? FOR UPDATE`
+	err = tx.QueryRow(query, commentId).Scan(&ownerId, &oldComment, &movieId, &hidden, &deleted)
+	if err != nil && err != sql.ErrNoRows {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		log.Printf("Error updating comment in db: %s", err)
+		log.Printf("Error getting comment from db: %s", err)
 		return
 	}
-	if n, _ := sqlRes.RowsAffected(); n == 0 {
+	//Checked before the text is compared, so the response doesn't tell others whether a guess matches
+	owner := ownerId.Valid && int(ownerId.Int64) == session.UserId
+	if err == sql.ErrNoRows || deleted || !(owner || session.Admin) {
 		http.Error(w, "Comment doesn't exist or you are not the author!", http.StatusBadRequest)
 		return
 	}
-	err = tmpl.ExecuteTemplate(w, templateName, struct {
-		CommentId   string
-		CommentText string
-	}{commentId, comment})
-	if err != nil {
+	//Edits of the author go through content filters, so spam can't be added to an approved comment
+	var held bool
+	if oldComment != comment && owner {
+		verdict, err := checkComment(session.UserId, comment, true)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error checking comment with filter: %s", err)
+			return
+		}
+		if verdict.Verdict == filter.Reject {
+			http.Error(w, verdict.Reason+"!", http.StatusBadRequest)
+			return
+		}
+		if verdict.Verdict == filter.Hold && !hidden {
+			if err := holdComment(tx, commentId, session.UserId, verdict.Reason); err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				log.Printf("Error holding comment for moderation: %s", err)
+				return
+			}
+			held = true
+		}
+	}
+	//Saving unchanged text doesn't make a new revision
+	if oldComment != comment {
+		query = `CALL SetComment(?, ?, ?)`
+		sqlRes, err := tx.Exec(query, session.UserId, commentId, comment)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Printf("Error updating comment in db: %s", err)
+			return
+		}
+		if n, _ := sqlRes.RowsAffected(); n == 0 {
+			http.Error(w, "Comment doesn't exist or you are not the author!", http.StatusBadRequest)
+			return
+		}
+		editorRole := "owner"
+		if !owner {
+			editorRole = "admin"
+		}
+		query = `INSERT INTO comment_revisions (commentId, comment, editorId, editorRole) VALUES (?, ?, ?, ?)`
+		if _, err := tx.Exec(query, commentId, oldComment, session.UserId, editorRole); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Printf("Error saving comment revision: %s", err)
+			return
+		}
+	}
+	query = `SELECT editedDT FROM comments WHERE commentId = ?`
+	var lastEdit sql.NullTime
+	if err := tx.QueryRow(query, commentId).Scan(&lastEdit); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error getting comment edit time: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error commiting transaction: %s", err)
+		return
+	}
+	//Text of a hidden comment must not reach other viewers
+	hidden = hidden || held
+	if !hidden {
+		if err := notifyMentions(session.UserId, commentId, movieId, addedMentions(oldComment, comment)); err != nil {
+			log.Printf("Error creating mention notifications: %s", err)
+		}
+	}
+	context := Comment{CommentId: commentId, CommentText: comment}
+	if lastEdit.Valid {
+		context.EditedDT = lastEdit.Time.Format(time.DateTime)
+	}
+	if held {
+		publishComment(movieId, CommentEvent{Kind: commentHide, Comment: CommentsContext{Comment: Comment{CommentId: commentId, UserId: session.UserId}}})
+	}
+	if oldComment != comment && !hidden {
+		publishComment(movieId, CommentEvent{Kind: commentEdit, Comment: CommentsContext{Comment: context}, ActorId: session.UserId})
+	}
+	if err = tmpl.ExecuteTemplate(w, templateName, context); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Error executing template %s: %s", templateName, err)
 		return
@@ -625,8 +975,28 @@ func (h *Handler) GetComments(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Wrong last comment id!", http.StatusBadRequest)
 		return
 	}
-	query := "CALL GetComments(?, ?, ?)"
-	rows, err := db.DB.Query(query, movieId, lastCommentId, commentsPerQuery)
+	sortBy := r.FormValue("sort")
+	if sortBy == "" {
+		sortBy = CommentSorts[0]
+	}
+	if !slices.Contains(CommentSorts, sortBy) {
+		http.Error(w, "Wrong sort order!", http.StatusBadRequest)
+		return
+	}
+	var lastScore int
+	if v := r.FormValue("score"); v != "" {
+		var err error
+		if lastScore, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Wrong last comment score!", http.StatusBadRequest)
+			return
+		}
+	}
+	var viewerId int
+	if session != nil {
+		viewerId = session.UserId
+	}
+	query := "CALL GetComments(?, ?, ?, ?, ?, ?)"
+	rows, err := db.DB.Query(query, movieId, viewerId, sortBy, lastScore, lastCommentId, commentsPerQuery)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Error getting comments from db: %s", err)
@@ -641,21 +1011,105 @@ func (h *Handler) GetComments(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		comment := &CommentsContext{}
 		var postedDT time.Time
-		err := rows.Scan(&comment.CommentText, &postedDT, &comment.UserId, &comment.CommentId, &comment.Username)
+		var editedDT sql.NullTime
+		err := rows.Scan(&comment.CommentText, &postedDT, &comment.UserId, &comment.CommentId, &comment.Username,
+			&comment.Depth, &comment.Deleted, &comment.Replies, &editedDT, &comment.Upvotes, &comment.Downvotes,
+			&comment.UserReaction, &comment.Hidden, &comment.Score)
 		if err != nil {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			log.Printf("Error scanning a row: %s", err)
 			return
 		}
+		comment.Sort = sortBy
 		comment.PostedDT = postedDT.Format(time.DateTime)
+		if editedDT.Valid {
+			comment.EditedDT = editedDT.Time.Format(time.DateTime)
+		}
+		comment.MovieId = movieId
 		if session != nil {
-			comment.Owner = (session.UserId == comment.UserId) || session.Admin
+			comment.Owner = ((session.UserId == comment.UserId) || session.Admin) && !comment.Deleted
+			comment.CanReply = !comment.Deleted
+		}
+		if comment.Hidden && !comment.Owner {
+			comment.CommentText = ""
 		}
 		ctxSlice = append(ctxSlice, *comment)
 	}
 	if len(ctxSlice) == commentsPerQuery {
 		ctxSlice[commentsPerQuery-1].Last = true
-		ctxSlice[commentsPerQuery-1].MovieId = movieId
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, ctxSlice); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
+
+// GetReplies returns a page of replies to a comment, oldest first
+func (h *Handler) GetReplies(w http.ResponseWriter, r *http.Request) {
+	parentId, err := strconv.Atoi(r.PathValue("commentId"))
+	if err != nil || parentId < 0 {
+		http.Error(w, "Wrong comment id!", http.StatusBadRequest)
+		return
+	}
+	lastReplyId, err := strconv.Atoi(r.PathValue("last_reply_id"))
+	if err != nil || lastReplyId < 0 {
+		http.Error(w, "Wrong last reply id!", http.StatusBadRequest)
+		return
+	}
+	renderReplies(w, r, parentId, lastReplyId, repliesPerQuery)
+}
+
+// renderReplies writes up to n replies to the comment after lastReplyId
+func renderReplies(w http.ResponseWriter, r *http.Request, parentId, lastReplyId, n int) {
+	const templateName string = "replies"
+	session := Sessions.GetSessionInfo(r)
+	ctxSlice := []CommentsContext{}
+	var viewerId int
+	if session != nil {
+		viewerId = session.UserId
+	}
+	query := "CALL GetReplies(?, ?, ?, ?)"
+	rows, err := db.DB.Query(query, parentId, viewerId, lastReplyId, n)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting replies from db: %s", err)
+		return
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("Error closing rows: %s", err)
+			return
+		}
+	}()
+	for rows.Next() {
+		comment := &CommentsContext{}
+		var postedDT time.Time
+		var editedDT sql.NullTime
+		err := rows.Scan(&comment.CommentText, &postedDT, &comment.UserId, &comment.CommentId, &comment.Username,
+			&comment.Depth, &comment.Deleted, &comment.Replies, &editedDT, &comment.Upvotes, &comment.Downvotes,
+			&comment.UserReaction, &comment.Hidden, &comment.MovieId)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error scanning a row: %s", err)
+			return
+		}
+		comment.PostedDT = postedDT.Format(time.DateTime)
+		if editedDT.Valid {
+			comment.EditedDT = editedDT.Time.Format(time.DateTime)
+		}
+		comment.ParentId = parentId
+		if session != nil {
+			comment.Owner = ((session.UserId == comment.UserId) || session.Admin) && !comment.Deleted
+			comment.CanReply = !comment.Deleted
+		}
+		if comment.Hidden && !comment.Owner {
+			comment.CommentText = ""
+		}
+		ctxSlice = append(ctxSlice, *comment)
+	}
+	if len(ctxSlice) == n {
+		ctxSlice[n-1].Last = true
 	}
 	if err := tmpl.ExecuteTemplate(w, templateName, ctxSlice); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -665,15 +1119,17 @@ func (h *Handler) GetComments(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) GetComment(w http.ResponseWriter, r *http.Request) {
-	const templateName string = "comment"
+	const templateName, hiddenName string = "comment", "hidden-comment"
 	commentId, err := strconv.Atoi(r.PathValue("commentId"))
 	if err != nil || commentId < 0 {
 		http.Error(w, "Wrong comment id!", http.StatusBadRequest)
 		return
 	}
-	query := `SELECT comment FROM comments WHERE commentId = ?`
-	var commentText string
-	if err := db.DB.QueryRow(query, commentId).Scan(&commentText); err != nil {
+	query := `SELECT comment, editedDT, hidden, IFNULL(userId, 0) FROM comments WHERE commentId = ?`
+	comment := Comment{CommentId: commentId}
+	var editedDT sql.NullTime
+	var hidden bool
+	if err := db.DB.QueryRow(query, commentId).Scan(&comment.CommentText, &editedDT, &hidden, &comment.UserId); err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Comment not found!", http.StatusBadRequest)
 			return
@@ -682,11 +1138,81 @@ func (h *Handler) GetComment(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Error getting comment from db: %s", err)
 		return
 	}
-	err = tmpl.ExecuteTemplate(w, templateName, struct {
-		CommentId   int
-		CommentText string
-	}{commentId, commentText})
+	//Hidden comment is shown only to its author and admins
+	session := Sessions.GetSessionInfo(r)
+	if hidden && (session == nil || (session.UserId != comment.UserId && !session.Admin)) {
+		if err := tmpl.ExecuteTemplate(w, hiddenName, commentId); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error executing template %s: %s", hiddenName, err)
+		}
+		return
+	}
+	if editedDT.Valid {
+		comment.EditedDT = editedDT.Time.Format(time.DateTime)
+	}
+	if err = tmpl.ExecuteTemplate(w, templateName, comment); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
+
+// GetCommentRevisions lists previous versions of a comment to its author and admins
+func (h *Handler) GetCommentRevisions(w http.ResponseWriter, r *http.Request) {
+	const templateName string = "comment-revisions"
+	commentId, err := strconv.Atoi(r.PathValue("commentId"))
+	if err != nil || commentId < 0 {
+		http.Error(w, "Wrong comment id!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in GetCommentRevisions")
+		return
+	}
+	var ownerId sql.NullInt64
+	query := `SELECT userId FROM comments WHERE commentId = ?`
+	if err := db.DB.QueryRow(query, commentId).Scan(&ownerId); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Comment not found!", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Internal server error!", http.StatusInternalServerError)
+		log.Printf("Error getting comment from db: %s", err)
+		return
+	}
+	if !session.Admin && (!ownerId.Valid || int(ownerId.Int64) != session.UserId) {
+		http.Error(w, "Forbidden: only author and admins can see revisions!", http.StatusForbidden)
+		return
+	}
+	query = `SELECT r.revisionId, r.comment, IFNULL(r.editorId, 0), IFNULL(u.username, 'DELETED'), r.editorRole, r.revisedDT
+		FROM comment_revisions r LEFT JOIN users u ON r.editorId = u.userId
+		WHERE r.commentId = ? ORDER BY r.revisionId DESC`
+	rows, err := db.DB.Query(query, commentId)
 	if err != nil {
+		http.Error(w, "Internal server error!", http.StatusInternalServerError)
+		log.Printf("Error getting comment revisions from db: %s", err)
+		return
+	}
+	defer rows.Close()
+	revisions := []CommentRevision{}
+	for rows.Next() {
+		revision := CommentRevision{}
+		var revisedDT time.Time
+		if err := rows.Scan(&revision.RevisionId, &revision.CommentText, &revision.EditorId, &revision.EditorName,
+			&revision.EditorRole, &revisedDT); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error scanning a row: %s", err)
+			return
+		}
+		revision.RevisedDT = revisedDT.Format(time.DateTime)
+		revisions = append(revisions, revision)
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, struct {
+		CommentId int
+		Revisions []CommentRevision
+	}{commentId, revisions}); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Error executing template %s: %s", templateName, err)
 		return
@@ -700,11 +1226,17 @@ func (h *Handler) GetCommentEditForm(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Wrong comment id", http.StatusBadRequest)
 		return
 	}
-	query := `SELECT comment FROM comments WHERE commentId = ?`
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in GetCommentEditForm")
+		return
+	}
+	query := `SELECT comment FROM comments WHERE commentId = ? AND userId = ? AND deleted = 0`
 	var commentText string
-	if err := db.DB.QueryRow(query, commentId).Scan(&commentText); err != nil {
+	if err := db.DB.QueryRow(query, commentId, session.UserId).Scan(&commentText); err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(w, "Comment not found!", http.StatusBadRequest)
+			http.Error(w, "Comment doesn't exist or you are not the author!", http.StatusBadRequest)
 			return
 		}
 		http.Error(w, "Internal server error!", http.StatusInternalServerError)
@@ -724,7 +1256,16 @@ func (h *Handler) GetCommentEditForm(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) GetUserInfo(w http.ResponseWriter, r *http.Request) {
 	const templateName string = "auth-block"
-	context := Sessions.GetSessionInfo(r)
+	context := struct {
+		Session *Session
+		Unread  int
+	}{Session: Sessions.GetSessionInfo(r)}
+	if context.Session != nil {
+		var err error
+		if context.Unread, err = unreadNotifications(context.Session.UserId); err != nil {
+			log.Printf("Error counting unread notifications: %s", err)
+		}
+	}
 	if err := tmpl.ExecuteTemplate(w, templateName, context); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Error executing template %s: %s", templateName, err)
@@ -839,8 +1380,10 @@ func (h *Handler) GetUserPage(w http.ResponseWriter, r *http.Request) {
 	}
 	user := &User{}
 	var banUntil, registerDate time.Time
-	query := `SELECT userId, username, registerDate, admin, banUntil FROM users WHERE userId = ?`
-	if err := db.DB.QueryRow(query, userId).Scan(&user.Id, &user.Username, &registerDate, &user.Admin, &banUntil); err != nil {
+	query := `SELECT userId, username, registerDate, admin, banUntil, watchlistPublic, diaryPublic, displayName, bio,
+		avatarVersion FROM users WHERE userId = ?`
+	if err := db.DB.QueryRow(query, userId).Scan(&user.Id, &user.Username, &registerDate, &user.Admin, &banUntil,
+		&user.WatchlistPublic, &user.DiaryPublic, &user.DisplayName, &user.Bio, &user.AvatarVersion); err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "User not found!", http.StatusNotFound)
 			return
@@ -853,11 +1396,25 @@ func (h *Handler) GetUserPage(w http.ResponseWriter, r *http.Request) {
 		user.Banned = true
 		user.BanUntil = banUntil.Format(time.DateTime)
 	}
+	session := Sessions.GetSessionInfo(r)
+	lists, err := userLists(userId, session != nil && (session.UserId == userId || session.Admin))
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error getting user lists from db: %s", err)
+		return
+	}
+	stats, activity, favorites := loadProfile(userId)
 	context := struct {
 		*User
-		Session *Session
-		TimeNow string
-	}{User: user, Session: Sessions.GetSessionInfo(r), TimeNow: time.Now().Format(time.DateTime)}
+		Session   *Session
+		TimeNow   string
+		Lists     []MovieList
+		NewList   MovieList
+		Stats     ProfileStats
+		Activity  []Activity
+		Favorites []Movie
+	}{User: user, Session: session, TimeNow: time.Now().Format(time.DateTime), Lists: lists,
+		NewList: MovieList{Visibility: ListPublic}, Stats: stats, Activity: activity, Favorites: favorites}
 	user.RegisterDate = registerDate.Format(time.DateTime)
 	if err := utils.TemplateWrap(tmpl, w, contentName, context, wrapperName, nil); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -1,9 +1,14 @@
 package movie
 
 import (
+	"database/sql"
+	"errors"
+	"movie_db/db"
 	"net/http"
 	"strings"
 	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
 )
 
 func TestUserRegistration(t *testing.T) {
@@ -24,3 +29,114 @@ func TestUserRegistration(t *testing.T) {
 		})
 	}
 }
+
+// mockDB replaces the DB of handlers with a mock for the test
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	old := db.DB
+	db.DB = conn
+	t.Cleanup(func() {
+		db.DB = old
+		conn.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet DB expectations: %v", err)
+		}
+	})
+	return mock
+}
+
+func TestReplyParent(t *testing.T) {
+	defer func(depth int) { MaxReplyDepth = depth }(MaxReplyDepth)
+	MaxReplyDepth = 2
+	tests := []struct {
+		name       string
+		rows       *sqlmock.Rows
+		wantParent sql.NullInt64
+		wantDepth  int
+		wantAuthor int
+		wantErr    error
+	}{
+		{name: "Top level comment", rows: sqlmock.NewRows([]string{"parentId", "depth", "deleted", "hidden", "userId"}).AddRow(nil, 0, false, false, 7),
+			wantParent: sql.NullInt64{Int64: 5, Valid: true}, wantDepth: 1, wantAuthor: 7},
+		{name: "Reply", rows: sqlmock.NewRows([]string{"parentId", "depth", "deleted", "hidden", "userId"}).AddRow(3, 1, false, false, 7),
+			wantParent: sql.NullInt64{Int64: 5, Valid: true}, wantDepth: 2, wantAuthor: 7},
+		{name: "Too deep is attached higher", rows: sqlmock.NewRows([]string{"parentId", "depth", "deleted", "hidden", "userId"}).AddRow(3, 2, false, false, 7),
+			wantParent: sql.NullInt64{Int64: 3, Valid: true}, wantDepth: 2, wantAuthor: 7},
+		{name: "Deleted", rows: sqlmock.NewRows([]string{"parentId", "depth", "deleted", "hidden", "userId"}).AddRow(nil, 0, true, false, 0),
+			wantErr: errDeletedParent},
+		{name: "Hidden", rows: sqlmock.NewRows([]string{"parentId", "depth", "deleted", "hidden", "userId"}).AddRow(nil, 0, false, true, 7),
+			wantErr: errHiddenParent},
+		{name: "Not found", rows: sqlmock.NewRows([]string{"parentId", "depth", "deleted", "hidden", "userId"}), wantErr: errNoParent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT parentId, depth, deleted, .* FOR SHARE`).WithArgs(5, "1").WillReturnRows(tt.rows)
+			mock.ExpectRollback()
+			tx, err := db.DB.Begin()
+			if err != nil {
+				t.Fatalf("Begin() error = %v", err)
+			}
+			defer tx.Rollback()
+			parent, depth, author, err := replyParent(tx, 5, "1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("replyParent() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if parent != tt.wantParent || depth != tt.wantDepth || author != tt.wantAuthor {
+				t.Errorf("replyParent() = %v, %d, %d, want %v, %d, %d", parent, depth, author, tt.wantParent, tt.wantDepth, tt.wantAuthor)
+			}
+		})
+	}
+}
+
+func TestRemoveComment(t *testing.T) {
+	tests := []struct {
+		name          string
+		found         bool
+		hasReplies    bool
+		wantProcedure string
+		affected      int64
+	}{
+		{name: "Without replies is deleted", found: true, wantProcedure: `CALL DeleteComment`, affected: 1},
+		{name: "With replies is tombstoned", found: true, hasReplies: true, wantProcedure: `CALL TombstoneComment`, affected: 1},
+		{name: "Someone else's", found: true, wantProcedure: `CALL DeleteComment`},
+		{name: "Not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			mock.ExpectBegin()
+			rows := sqlmock.NewRows([]string{"movieId"})
+			if tt.found {
+				rows.AddRow(1)
+			}
+			mock.ExpectQuery(`SELECT movieId FROM comments WHERE commentId = \? FOR UPDATE`).WithArgs("5").WillReturnRows(rows)
+			if tt.found {
+				mock.ExpectQuery(`SELECT EXISTS\(SELECT \* FROM comments WHERE parentId = \?\)`).WithArgs("5").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.hasReplies))
+				mock.ExpectExec(tt.wantProcedure).WithArgs(2, "5").WillReturnResult(sqlmock.NewResult(0, tt.affected))
+			}
+			mock.ExpectRollback()
+			tx, err := db.DB.Begin()
+			if err != nil {
+				t.Fatalf("Begin() error = %v", err)
+			}
+			defer tx.Rollback()
+			_, hasReplies, n, err := removeComment(tx, 2, "5")
+			if err != nil {
+				t.Fatalf("removeComment() error = %v", err)
+			}
+			if hasReplies != tt.hasReplies || n != tt.affected {
+				t.Errorf("removeComment() = %v, %d, want %v, %d", hasReplies, n, tt.hasReplies, tt.affected)
+			}
+		})
+	}
+}
@@ -0,0 +1,487 @@
+package movie
+
+import (
+	"database/sql"
+	"log"
+	"movie_db/db"
+	"movie_db/utils"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxListNameLen        int = 100
+	maxListDescriptionLen int = 2000
+	listSlugBytes         int = 9 //12 characters after base64 encoding
+)
+
+func validVisibility(v string) bool {
+	return v == ListPublic || v == ListUnlisted || v == ListPrivate
+}
+
+// loadList returns list by its slug without entries. Returns sql.ErrNoRows if list doesn't exist.
+// Origin of a fork is filled regardless of its visibility, check it with canSeeOrigin before showing
+func loadList(slug string) (*MovieList, error) {
+	query := `SELECT l.listId, l.slug, l.userId, u.username, l.name, l.description, l.visibility, l.createdDT,
+		f.slug, f.name, f.userId, f.visibility FROM movielists l
+		JOIN users u ON l.userId = u.userId
+		LEFT JOIN movielists f ON l.forkedFromId = f.listId
+		WHERE l.slug = ?`
+	list := &MovieList{}
+	var createdDT time.Time
+	var forkSlug, forkName, forkVisibility sql.NullString
+	var forkUserId sql.NullInt64
+	err := db.DB.QueryRow(query, slug).Scan(&list.ListId, &list.Slug, &list.UserId, &list.Username, &list.Name,
+		&list.Description, &list.Visibility, &createdDT, &forkSlug, &forkName, &forkUserId, &forkVisibility)
+	if err != nil {
+		return nil, err
+	}
+	list.CreatedDT = createdDT.Format(time.DateTime)
+	if forkSlug.Valid {
+		list.ForkedFrom = &MovieList{Slug: forkSlug.String, Name: forkName.String,
+			UserId: int(forkUserId.Int64), Visibility: forkVisibility.String}
+	}
+	return list, nil
+}
+
+func loadListEntries(listId int) ([]ListEntry, error) {
+	query := `SELECT e.movieId, m.title, e.position, e.note FROM movielistentries e
+		JOIN movies m ON e.movieId = m.movieId WHERE e.listId = ? ORDER BY e.position ASC`
+	rows, err := db.DB.Query(query, listId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []ListEntry{}
+	for rows.Next() {
+		entry := ListEntry{}
+		if err := rows.Scan(&entry.MovieId, &entry.Title, &entry.Position, &entry.Note); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// queryLists runs a query selecting listId, slug, userId, username, name and visibility
+func queryLists(query string, args ...any) ([]MovieList, error) {
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lists := []MovieList{}
+	for rows.Next() {
+		list := MovieList{}
+		if err := rows.Scan(&list.ListId, &list.Slug, &list.UserId, &list.Username, &list.Name, &list.Visibility); err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	return lists, rows.Err()
+}
+
+// userLists returns lists of the user. Unlisted and private lists are included only if all is true
+func userLists(userId int, all bool) ([]MovieList, error) {
+	query := `SELECT l.listId, l.slug, l.userId, u.username, l.name, l.visibility FROM movielists l
+		JOIN users u ON l.userId = u.userId
+		WHERE l.userId = ? AND (? OR l.visibility = 'public') ORDER BY l.listId DESC`
+	return queryLists(query, userId, all)
+}
+
+// movieLists returns public lists that include the movie
+func movieLists(movieId int) ([]MovieList, error) {
+	query := `SELECT l.listId, l.slug, l.userId, u.username, l.name, l.visibility FROM movielists l
+		JOIN users u ON l.userId = u.userId
+		JOIN movielistentries e ON e.listId = l.listId
+		WHERE e.movieId = ? AND l.visibility = 'public' ORDER BY l.listId DESC`
+	return queryLists(query, movieId)
+}
+
+// canViewList reports whether the session holder can open the list
+func canViewList(list *MovieList, session *Session) bool {
+	return canView(session, list.UserId, list.Visibility != ListPrivate)
+}
+
+// canSeeOrigin reports whether the session holder may see where the list was forked from.
+// Slug of an unlisted list is its secret, so only public origins are shown to everyone
+func canSeeOrigin(list *MovieList, session *Session) bool {
+	return list.ForkedFrom != nil && canView(session, list.ForkedFrom.UserId, list.ForkedFrom.Visibility == ListPublic)
+}
+
+// ownedList loads the list by slug and checks that it belongs to the session holder.
+// Writes an error response and returns nil on failure.
+func ownedList(w http.ResponseWriter, slug string, session Session) *MovieList {
+	list, err := loadList(slug)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "List not found!", http.StatusNotFound)
+			return nil
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting list from db: %s", err)
+		return nil
+	}
+	if list.UserId != session.UserId {
+		http.Error(w, "Forbidden: not your list!", http.StatusForbidden)
+		return nil
+	}
+	return list
+}
+
+// createList inserts a new list and returns its id and slug
+func createList(tx *sql.Tx, userId int, name, description, visibility string, forkedFromId sql.NullInt64) (int64, string, error) {
+	slug, err := utils.GenerateToken(listSlugBytes)
+	if err != nil {
+		return 0, "", err
+	}
+	query := `INSERT INTO movielists (slug, userId, name, description, visibility, forkedFromId) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, slug, userId, name, description, visibility, forkedFromId)
+	if err != nil {
+		return 0, "", err
+	}
+	listId, err := result.LastInsertId()
+	return listId, slug, err
+}
+
+// validListForm checks name, description and visibility of the list form
+func validListForm(w http.ResponseWriter, r *http.Request) (name, description, visibility string, ok bool) {
+	name = r.PostFormValue("name")
+	description = r.PostFormValue("description")
+	visibility = r.PostFormValue("visibility")
+	if name == "" || utf8.RuneCountInString(name) > maxListNameLen {
+		http.Error(w, "List name must be between 1 and "+strconv.Itoa(maxListNameLen)+" characters!", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(description) > maxListDescriptionLen {
+		http.Error(w, "Description is too long!", http.StatusBadRequest)
+		return
+	}
+	if !validVisibility(visibility) {
+		http.Error(w, "Wrong list visibility!", http.StatusBadRequest)
+		return
+	}
+	return name, description, visibility, true
+}
+
+func (h *Handler) GetListPage(w http.ResponseWriter, r *http.Request) {
+	const wrapperName, contentName string = "index", "list-page"
+	list, err := loadList(r.PathValue("slug"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "List not found!", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error getting list from db: %s", err)
+		return
+	}
+	session := Sessions.GetSessionInfo(r)
+	if !canViewList(list, session) {
+		http.Error(w, "List not found!", http.StatusNotFound)
+		return
+	}
+	if !canSeeOrigin(list, session) {
+		list.ForkedFrom = nil
+	}
+	if list.Entries, err = loadListEntries(list.ListId); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error getting list entries from db: %s", err)
+		return
+	}
+	context := struct {
+		List    *MovieList
+		Session *Session
+		Owner   bool
+	}{List: list, Session: session, Owner: session != nil && session.UserId == list.UserId}
+	if err := utils.TemplateWrap(tmpl, w, contentName, context, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+func (h *Handler) PostList(w http.ResponseWriter, r *http.Request) {
+	name, description, visibility, ok := validListForm(w, r)
+	if !ok {
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in PostList")
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	_, slug, err := createList(tx, session.UserId, name, description, visibility, sql.NullInt64{})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error creating a list: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error commiting transaction: %s", err)
+		return
+	}
+	w.Header().Add("HX-Redirect", "/list/"+slug)
+}
+
+func (h *Handler) UpdateList(w http.ResponseWriter, r *http.Request) {
+	name, description, visibility, ok := validListForm(w, r)
+	if !ok {
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in UpdateList")
+		return
+	}
+	list := ownedList(w, r.PathValue("slug"), session)
+	if list == nil {
+		return
+	}
+	query := `UPDATE movielists SET name = ?, description = ?, visibility = ? WHERE listId = ?`
+	if _, err := db.DB.Exec(query, name, description, visibility, list.ListId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating a list: %s", err)
+		return
+	}
+	w.Header().Add("HX-Redirect", "/list/"+list.Slug)
+}
+
+func (h *Handler) DeleteList(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in DeleteList")
+		return
+	}
+	list := ownedList(w, r.PathValue("slug"), session)
+	if list == nil {
+		return
+	}
+	query := `DELETE FROM movielists WHERE listId = ?`
+	if _, err := db.DB.Exec(query, list.ListId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error deleting a list: %s", err)
+		return
+	}
+	w.Header().Add("HX-Redirect", "/user/"+strconv.Itoa(session.UserId))
+}
+
+// ForkList copies someone else's visible list with all entries into a new private list of the session holder
+func (h *Handler) ForkList(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in ForkList")
+		return
+	}
+	list, err := loadList(r.PathValue("slug"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "List not found!", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting list from db: %s", err)
+		return
+	}
+	if !canViewList(list, &session) {
+		http.Error(w, "List not found!", http.StatusNotFound)
+		return
+	}
+	if list.UserId == session.UserId {
+		http.Error(w, "You can't fork your own list!", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	forkId, slug, err := createList(tx, session.UserId, list.Name, list.Description, ListPrivate,
+		sql.NullInt64{Int64: int64(list.ListId), Valid: true})
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error creating a fork: %s", err)
+		return
+	}
+	query := `INSERT INTO movielistentries (listId, movieId, position, note)
+		SELECT ?, movieId, position, note FROM movielistentries WHERE listId = ?`
+	if _, err := tx.Exec(query, forkId, list.ListId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error copying list entries: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error commiting transaction: %s", err)
+		return
+	}
+	w.Header().Add("HX-Redirect", "/list/"+slug)
+}
+
+func (h *Handler) PostListEntry(w http.ResponseWriter, r *http.Request) {
+	const templateName string = "list-entry-added"
+	movieId, err := strconv.Atoi(r.PostFormValue("movieId"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	note := r.PostFormValue("note")
+	if utf8.RuneCountInString(note) > maxWatchlistNoteLen {
+		http.Error(w, "Note is too long!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in PostListEntry")
+		return
+	}
+	list := ownedList(w, r.PostFormValue("list"), session)
+	if list == nil {
+		return
+	}
+	query := `SELECT EXISTS(SELECT * FROM movies WHERE movieId = ?)`
+	var exists bool
+	if err := db.DB.QueryRow(query, movieId).Scan(&exists); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error checking movie existance in db: %s", err)
+		return
+	}
+	if !exists {
+		http.Error(w, "Movie doesn't exist!", http.StatusBadRequest)
+		return
+	}
+	query = `INSERT IGNORE INTO movielistentries (listId, movieId, position, note)
+		SELECT ?, ?, IFNULL(MAX(position), 0) + 1, ? FROM movielistentries WHERE listId = ?`
+	if _, err := db.DB.Exec(query, list.ListId, movieId, note, list.ListId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error adding movie to a list: %s", err)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, list); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
+
+func (h *Handler) DeleteListEntry(w http.ResponseWriter, r *http.Request) {
+	movieId, err := strconv.Atoi(r.PathValue("movieId"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in DeleteListEntry")
+		return
+	}
+	list := ownedList(w, r.PathValue("slug"), session)
+	if list == nil {
+		return
+	}
+	query := `DELETE FROM movielistentries WHERE listId = ? AND movieId = ?`
+	if _, err := db.DB.Exec(query, list.ListId, movieId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error removing movie from a list: %s", err)
+		return
+	}
+}
+
+func (h *Handler) MoveListEntry(w http.ResponseWriter, r *http.Request) {
+	movieId, err := strconv.Atoi(r.PathValue("movieId"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	direction := r.PostFormValue("direction")
+	if direction != "up" && direction != "down" {
+		http.Error(w, "Wrong direction!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in MoveListEntry")
+		return
+	}
+	list := ownedList(w, r.PathValue("slug"), session)
+	if list == nil {
+		return
+	}
+	if err := moveEntry("movielistentries", "listId", list.ListId, movieId, direction == "up"); err != nil {
+		if err == errEntryNotFound {
+			http.Error(w, "Movie is not in the list!", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error moving list entry: %s", err)
+		return
+	}
+	h.renderListEntries(w, list)
+}
+
+func (h *Handler) UpdateListEntryNote(w http.ResponseWriter, r *http.Request) {
+	movieId, err := strconv.Atoi(r.PathValue("movieId"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	note := r.PostFormValue("note")
+	if utf8.RuneCountInString(note) > maxWatchlistNoteLen {
+		http.Error(w, "Note is too long!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in UpdateListEntryNote")
+		return
+	}
+	list := ownedList(w, r.PathValue("slug"), session)
+	if list == nil {
+		return
+	}
+	query := `UPDATE movielistentries SET note = ? WHERE listId = ? AND movieId = ?`
+	if _, err := db.DB.Exec(query, note, list.ListId, movieId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating list entry note: %s", err)
+		return
+	}
+	h.renderListEntries(w, list)
+}
+
+func (h *Handler) renderListEntries(w http.ResponseWriter, list *MovieList) {
+	const templateName string = "list-entries"
+	var err error
+	if list.Entries, err = loadListEntries(list.ListId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting list entries from db: %s", err)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, struct {
+		List  *MovieList
+		Owner bool
+	}{list, true}); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
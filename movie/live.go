@@ -0,0 +1,143 @@
+package movie
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"movie_db/live"
+	"movie_db/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Limits of live comment connections, per movie and in total
+var (
+	MaxStreamsPerMovie = 200
+	MaxStreams         = 2000
+)
+
+// Kinds of live comment events
+const (
+	commentNew    string = "new"
+	commentEdit   string = "edit"
+	commentDelete string = "delete"
+	commentHide   string = "hide"
+	commentShow   string = "show" //Hidden comment was restored
+)
+
+// CommentEvent is published to viewers of a movie page when its comments change.
+// Events are rendered for every viewer separately, since comment controls depend on the viewer
+type CommentEvent struct {
+	Kind      string
+	Comment   CommentsContext
+	ActorId   int  //Author of the change doesn't get the event, the change is already on their page
+	Tombstone bool //Deleted comment was replaced by a tombstone
+}
+
+// CommentsHub delivers comment events, movieId is the topic
+var CommentsHub *live.Hub[CommentEvent]
+
+// publishComment pushes comment event to the viewers of the movie page
+func publishComment(movieId int, event CommentEvent) {
+	if CommentsHub == nil {
+		return
+	}
+	CommentsHub.Publish(movieId, event)
+}
+
+// streamSession returns the current session of a stream viewer, nil if it ended or the viewer is anonymous
+func streamSession(tokenHash string) *Session {
+	if tokenHash == "" {
+		return nil
+	}
+	session, ok := Sessions.Get(tokenHash)
+	if !ok {
+		return nil
+	}
+	return &session
+}
+
+// GetCommentStream streams comment changes of a movie as Server-Sent Events
+func (h *Handler) GetCommentStream(w http.ResponseWriter, r *http.Request) {
+	const templateName string = "comment-live"
+	const heartbeat time.Duration = 25 * time.Second
+	movieId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	if CommentsHub == nil {
+		http.Error(w, "Live comments are disabled", http.StatusServiceUnavailable)
+		return
+	}
+	sub, err := CommentsHub.Subscribe(movieId)
+	if err != nil {
+		if errors.Is(err, live.ErrTooManySubscribers) {
+			http.Error(w, "Too many live connections, try again later!", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error subscribing to comments: %s", err)
+		return
+	}
+	defer CommentsHub.Unsubscribe(sub)
+	//Session is looked up for every event, so logout, ban or demotion apply to an open stream
+	var tokenHash string
+	if cookie, err := r.Cookie("session_token"); err == nil && cookie.Value != "" {
+		tokenHash = utils.HashToken(cookie.Value)
+	}
+	rc := http.NewResponseController(w)
+	//Stream lives longer than any write timeout of the server
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	if err := live.WriteRetry(w, 5000); err != nil {
+		return
+	}
+	if err := rc.Flush(); err != nil {
+		log.Printf("Error flushing comment stream: %s", err)
+		return
+	}
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	buf := &bytes.Buffer{}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			err = live.WriteComment(w, "ping")
+		case event, ok := <-sub.C:
+			if !ok {
+				//Client fell behind and was dropped, it reconnects and reloads the comments
+				return
+			}
+			session := streamSession(tokenHash)
+			if session != nil && session.UserId == event.ActorId {
+				continue
+			}
+			comment := event.Comment
+			comment.Owner = session != nil && (session.UserId == comment.UserId || session.Admin)
+			comment.CanReply = session != nil && !comment.Deleted
+			//Owners still see their hidden comments
+			if event.Kind == commentHide && comment.Owner {
+				continue
+			}
+			buf.Reset()
+			context := CommentEvent{Kind: event.Kind, Comment: comment, Tombstone: event.Tombstone}
+			if err := tmpl.ExecuteTemplate(buf, templateName, context); err != nil {
+				log.Printf("Error executing template %s: %s", templateName, err)
+				continue
+			}
+			err = live.WriteEvent(w, "comment", buf.String())
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package movie
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"movie_db/blob"
+	"movie_db/db"
+	"movie_db/httpcache"
+	"movie_db/poster"
+	"net/http"
+	"slices"
+	"strconv"
+	"unicode/utf8"
+)
+
+const maxMediaCaptionLen int = 300
+
+var errMediaNotFound = errors.New("media not found")
+
+// mediaLayout returns size limits of the image kind. Backdrops and stills are landscape
+func mediaLayout(kind string) poster.Layout {
+	if kind == MediaPoster {
+		return poster.Portrait
+	}
+	return poster.Landscape
+}
+
+// loadMedia returns images of the movie grouped by kind and ordered by position
+func loadMedia(movieId int) ([]Media, error) {
+	query := `SELECT mm.mediaId, mm.movieId, mm.kind, mm.position, mm.isPrimary, mm.caption, IFNULL(mm.uploaderId, 0),
+		IFNULL(u.username, ''), mm.uploadedDT FROM moviemedia mm LEFT JOIN users u ON mm.uploaderId = u.userId
+		WHERE mm.movieId = ? ORDER BY FIELD(mm.kind, 'poster', 'backdrop', 'still'), mm.position ASC`
+	rows, err := db.DB.Query(query, movieId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	media := []Media{}
+	for rows.Next() {
+		m := Media{}
+		err := rows.Scan(&m.MediaId, &m.MovieId, &m.Kind, &m.Position, &m.Primary, &m.Caption, &m.UploaderId,
+			&m.UploaderName, &m.UploadedDT)
+		if err != nil {
+			return nil, err
+		}
+		media = append(media, m)
+	}
+	return media, rows.Err()
+}
+
+// addMedia stores a processed image and returns its id. First image of a kind becomes primary.
+// Row is committed only after the image is saved, so the gallery never points to missing images
+func addMedia(ctx context.Context, movieId, uploaderId int, kind, caption string, images map[poster.Size][]byte, primary bool) (int, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var position int
+	var hasPrimary bool
+	query := `SELECT IFNULL(MAX(position), 0) + 1, IFNULL(MAX(isPrimary), 0) FROM moviemedia WHERE movieId = ? AND kind = ? FOR UPDATE`
+	if err := tx.QueryRow(query, movieId, kind).Scan(&position, &hasPrimary); err != nil {
+		return 0, err
+	}
+	primary = primary || !hasPrimary
+	if primary {
+		query = `UPDATE moviemedia SET isPrimary = 0 WHERE movieId = ? AND kind = ?`
+		if _, err := tx.Exec(query, movieId, kind); err != nil {
+			return 0, err
+		}
+	}
+	query = `INSERT INTO moviemedia (movieId, kind, position, isPrimary, caption, uploaderId) VALUES (?, ?, ?, ?, ?, NULLIF(?, 0))`
+	result, err := tx.Exec(query, movieId, kind, position, primary, caption, uploaderId)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	mediaId := int(id)
+	if err := Posters.SaveMedia(ctx, movieId, mediaId, images); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		if err := Posters.DeleteMedia(ctx, movieId, mediaId); err != nil {
+			log.Printf("Error deleting images of uncommitted media %d: %s", mediaId, err)
+		}
+		return 0, err
+	}
+	return mediaId, nil
+}
+
+// openPoster returns the primary poster from the gallery, or the poster uploaded before the gallery existed
+func openPoster(ctx context.Context, movieId int, size poster.Size) (io.ReadCloser, blob.Info, error) {
+	var mediaId int
+	query := `SELECT mediaId FROM moviemedia WHERE movieId = ? AND kind = 'poster' AND isPrimary = 1`
+	err := db.DB.QueryRow(query, movieId).Scan(&mediaId)
+	if err == sql.ErrNoRows {
+		return Posters.Open(ctx, movieId, size)
+	}
+	if err != nil {
+		return nil, blob.Info{}, err
+	}
+	return Posters.OpenMedia(ctx, movieId, mediaId, size)
+}
+
+// GetMediaImage serves a movie image. Image of a media id never changes, so it is cached indefinitely
+func (h *Handler) GetMediaImage(w http.ResponseWriter, r *http.Request) {
+	movieId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	mediaId, err := strconv.Atoi(r.PathValue("mediaId"))
+	if err != nil || mediaId < 0 {
+		http.Error(w, "Wrong media id!", http.StatusBadRequest)
+		return
+	}
+	size, err := poster.ParseSize(r.FormValue("size"))
+	if err != nil {
+		http.Error(w, "Wrong image size!", http.StatusBadRequest)
+		return
+	}
+	content, info, err := Posters.OpenMedia(r.Context(), movieId, mediaId, size)
+	if err != nil {
+		if err == blob.ErrNotFound {
+			http.Error(w, "Image not found!", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error opening media: %s", err)
+		return
+	}
+	defer content.Close()
+	if err := httpcache.ServeReader(w, r, info.ETag, info.ModTime, info.ContentType, httpcache.Immutable, content); err != nil {
+		log.Printf("Error serving media: %s", err)
+	}
+}
+
+// GetGallery renders gallery manager of the movie edit form
+func (h *Handler) GetGallery(w http.ResponseWriter, r *http.Request) {
+	movieId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	h.renderGallery(w, movieId)
+}
+
+// PostMedia uploads an image of the kind to the movie gallery
+func (h *Handler) PostMedia(w http.ResponseWriter, r *http.Request) {
+	movieId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in PostMedia")
+		return
+	}
+	var exists bool
+	query := `SELECT EXISTS(SELECT * FROM movies WHERE movieId = ?)`
+	if err := db.DB.QueryRow(query, movieId).Scan(&exists); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Problem with db: %s", err)
+		return
+	}
+	if !exists {
+		http.Error(w, "Movie doesn't exist!", http.StatusBadRequest)
+		return
+	}
+	data, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
+	kind := r.FormValue("kind")
+	if !slices.Contains(MediaKinds, kind) {
+		http.Error(w, "Wrong image type!", http.StatusBadRequest)
+		return
+	}
+	caption := r.FormValue("caption")
+	if utf8.RuneCountInString(caption) > maxMediaCaptionLen {
+		http.Error(w, "Caption is too long!", http.StatusBadRequest)
+		return
+	}
+	layout := mediaLayout(kind)
+	images, err := layout.Process(data)
+	if err != nil {
+		uploadError(w, err, layout)
+		return
+	}
+	if _, err := addMedia(r.Context(), movieId, session.UserId, kind, caption, images, r.FormValue("primary") != ""); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error adding media: %s", err)
+		return
+	}
+	h.renderGallery(w, movieId)
+}
+
+// mediaMovie returns movie of the media, which is needed to render the gallery after a change
+func mediaMovie(mediaId int) (int, error) {
+	var movieId int
+	query := `SELECT movieId FROM moviemedia WHERE mediaId = ?`
+	err := db.DB.QueryRow(query, mediaId).Scan(&movieId)
+	if err == sql.ErrNoRows {
+		return 0, errMediaNotFound
+	}
+	return movieId, err
+}
+
+func (h *Handler) UpdateMediaCaption(w http.ResponseWriter, r *http.Request) {
+	mediaId, err := strconv.Atoi(r.PathValue("mediaId"))
+	if err != nil || mediaId < 0 {
+		http.Error(w, "Wrong media id!", http.StatusBadRequest)
+		return
+	}
+	caption := r.PostFormValue("caption")
+	if utf8.RuneCountInString(caption) > maxMediaCaptionLen {
+		http.Error(w, "Caption is too long!", http.StatusBadRequest)
+		return
+	}
+	movieId, err := mediaMovie(mediaId)
+	if err != nil {
+		mediaError(w, err)
+		return
+	}
+	query := `UPDATE moviemedia SET caption = ? WHERE mediaId = ?`
+	if _, err := db.DB.Exec(query, caption, mediaId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating media caption: %s", err)
+		return
+	}
+	h.renderGallery(w, movieId)
+}
+
+// SetPrimaryMedia makes the image primary for its kind
+func (h *Handler) SetPrimaryMedia(w http.ResponseWriter, r *http.Request) {
+	mediaId, err := strconv.Atoi(r.PathValue("mediaId"))
+	if err != nil || mediaId < 0 {
+		http.Error(w, "Wrong media id!", http.StatusBadRequest)
+		return
+	}
+	movieId, err := mediaMovie(mediaId)
+	if err != nil {
+		mediaError(w, err)
+		return
+	}
+	query := `UPDATE moviemedia mm JOIN moviemedia target ON mm.movieId = target.movieId AND mm.kind = target.kind
+		SET mm.isPrimary = (mm.mediaId = target.mediaId) WHERE target.mediaId = ?`
+	if _, err := db.DB.Exec(query, mediaId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error setting primary media: %s", err)
+		return
+	}
+	h.renderGallery(w, movieId)
+}
+
+// MoveMedia swaps the image with its neighbour of the same kind
+func (h *Handler) MoveMedia(w http.ResponseWriter, r *http.Request) {
+	mediaId, err := strconv.Atoi(r.PathValue("mediaId"))
+	if err != nil || mediaId < 0 {
+		http.Error(w, "Wrong media id!", http.StatusBadRequest)
+		return
+	}
+	direction := r.PostFormValue("direction")
+	if direction != "up" && direction != "down" {
+		http.Error(w, "Wrong direction!", http.StatusBadRequest)
+		return
+	}
+	movieId, err := moveMedia(mediaId, direction == "up")
+	if err != nil {
+		mediaError(w, err)
+		return
+	}
+	h.renderGallery(w, movieId)
+}
+
+// moveMedia swaps positions like moveEntry, within images of the same movie and kind
+func moveMedia(mediaId int, up bool) (int, error) {
+	neighbourQuery := `SELECT mediaId, position FROM moviemedia WHERE movieId = ? AND kind = ? AND position > ? ORDER BY position ASC LIMIT 1`
+	if up {
+		neighbourQuery = `SELECT mediaId, position FROM moviemedia WHERE movieId = ? AND kind = ? AND position < ? ORDER BY position DESC LIMIT 1`
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var movieId, position, neighbourId, neighbourPosition int
+	var kind string
+	query := `SELECT movieId, kind, position FROM moviemedia WHERE mediaId = ? FOR UPDATE`
+	if err := tx.QueryRow(query, mediaId).Scan(&movieId, &kind, &position); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, errMediaNotFound
+		}
+		return 0, err
+	}
+	err = tx.QueryRow(neighbourQuery, movieId, kind, position).Scan(&neighbourId, &neighbourPosition)
+	if err == sql.ErrNoRows {
+		//Image is already first or last
+		return movieId, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	query = `UPDATE moviemedia SET position = ? WHERE mediaId = ?`
+	if _, err := tx.Exec(query, neighbourPosition, mediaId); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(query, position, neighbourId); err != nil {
+		return 0, err
+	}
+	return movieId, tx.Commit()
+}
+
+// DeleteMedia removes the image. If it was primary, the next image of the kind becomes primary
+func (h *Handler) DeleteMedia(w http.ResponseWriter, r *http.Request) {
+	mediaId, err := strconv.Atoi(r.PathValue("mediaId"))
+	if err != nil || mediaId < 0 {
+		http.Error(w, "Wrong media id!", http.StatusBadRequest)
+		return
+	}
+	movieId, err := deleteMedia(mediaId)
+	if err != nil {
+		mediaError(w, err)
+		return
+	}
+	if err := Posters.DeleteMedia(r.Context(), movieId, mediaId); err != nil {
+		log.Printf("Error deleting images of media %d: %s", mediaId, err)
+	}
+	h.renderGallery(w, movieId)
+}
+
+func deleteMedia(mediaId int) (int, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var movieId int
+	var kind string
+	var primary bool
+	query := `SELECT movieId, kind, isPrimary FROM moviemedia WHERE mediaId = ? FOR UPDATE`
+	if err := tx.QueryRow(query, mediaId).Scan(&movieId, &kind, &primary); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, errMediaNotFound
+		}
+		return 0, err
+	}
+	query = `DELETE FROM moviemedia WHERE mediaId = ?`
+	if _, err := tx.Exec(query, mediaId); err != nil {
+		return 0, err
+	}
+	if primary {
+		query = `UPDATE moviemedia SET isPrimary = 1 WHERE movieId = ? AND kind = ? ORDER BY position ASC LIMIT 1`
+		if _, err := tx.Exec(query, movieId, kind); err != nil {
+			return 0, err
+		}
+	}
+	return movieId, tx.Commit()
+}
+
+func mediaError(w http.ResponseWriter, err error) {
+	if err == errMediaNotFound {
+		http.Error(w, "Image not found!", http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	log.Printf("Error changing media: %s", err)
+}
+
+func (h *Handler) renderGallery(w http.ResponseWriter, movieId int) {
+	const templateName string = "media-gallery"
+	media, err := loadMedia(movieId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error loading media: %s", err)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, struct {
+		MovieId int
+		Media   []Media
+		Kinds   []string
+	}{movieId, media, MediaKinds}); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
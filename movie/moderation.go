@@ -0,0 +1,330 @@
+package movie
+
+import (
+	"database/sql"
+	"log"
+	"movie_db/db"
+	"movie_db/utils"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const maxReportReasonLen int = 500
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// logModeration records moderation action. moderatorId 0 means automatic action
+func logModeration(exec execer, commentId, moderatorId, targetUserId int, action, note string) error {
+	query := `INSERT INTO moderationactions (commentId, moderatorId, targetUserId, action, note) VALUES (?, NULLIF(?, 0), NULLIF(?, 0), ?, ?)`
+	_, err := exec.Exec(query, commentId, moderatorId, targetUserId, action, note)
+	return err
+}
+
+// PostReport flags a comment for moderators. Comment is hidden automatically after ReportsToHide reports
+func (h *Handler) PostReport(w http.ResponseWriter, r *http.Request) {
+	const templateName string = "report-sent"
+	commentId, err := strconv.Atoi(r.PathValue("commentId"))
+	if err != nil || commentId < 0 {
+		http.Error(w, "Wrong comment id!", http.StatusBadRequest)
+		return
+	}
+	reason := r.PostFormValue("reason")
+	if reason == "" || utf8.RuneCountInString(reason) > maxReportReasonLen {
+		http.Error(w, "Reason must be between 1 and "+strconv.Itoa(maxReportReasonLen)+" characters!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in PostReport")
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	var authorId sql.NullInt64
+	var hidden, deleted, autoHidden bool
+	var movieId int
+	query := `SELECT userId, hidden, deleted, movieId FROM comments WHERE commentId = ? FOR UPDATE`
+	if err := tx.QueryRow(query, commentId).Scan(&authorId, &hidden, &deleted, &movieId); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Comment not found!", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting comment from db: %s", err)
+		return
+	}
+	if deleted {
+		http.Error(w, "Comment is deleted!", http.StatusBadRequest)
+		return
+	}
+	if authorId.Valid && int(authorId.Int64) == session.UserId {
+		http.Error(w, "You can't report your own comment!", http.StatusBadRequest)
+		return
+	}
+	query = `INSERT IGNORE INTO commentreports (commentId, reporterId, reason) VALUES (?, ?, ?)`
+	if _, err := tx.Exec(query, commentId, session.UserId, reason); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error inserting report into db: %s", err)
+		return
+	}
+	if !hidden {
+		var reports int
+		query = `SELECT COUNT(*) FROM commentreports WHERE commentId = ? AND resolved = 0`
+		if err := tx.QueryRow(query, commentId).Scan(&reports); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error counting reports: %s", err)
+			return
+		}
+		if reports >= ReportsToHide {
+			query = `UPDATE comments SET hidden = 1 WHERE commentId = ?`
+			if _, err := tx.Exec(query, commentId); err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				log.Printf("Error hiding comment: %s", err)
+				return
+			}
+			if err := logModeration(tx, commentId, 0, int(authorId.Int64), "hide", "Hidden automatically after "+strconv.Itoa(reports)+" reports"); err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				log.Printf("Error logging moderation action: %s", err)
+				return
+			}
+			autoHidden = true
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error commiting transaction: %s", err)
+		return
+	}
+	if autoHidden {
+		publishComment(movieId, CommentEvent{Kind: commentHide, Comment: CommentsContext{Comment: Comment{CommentId: commentId, UserId: int(authorId.Int64)}}})
+		message := "Your comment was hidden automatically after several reports"
+		if err := notify(int(authorId.Int64), 0, NotifyModeration, commentId, movieId, message); err != nil {
+			log.Printf("Error creating moderation notification: %s", err)
+		}
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
+
+// GetModerationQueue lists comments with unresolved reports, most reported first
+func (h *Handler) GetModerationQueue(w http.ResponseWriter, r *http.Request) {
+	const wrapperName, contentName string = "index", "moderation-queue"
+	query := `SELECT c.commentId, c.comment, IFNULL(c.userId, 0), IFNULL(u.username, 'DELETED'), c.postedDT, c.movieId, m.title,
+			c.hidden, IFNULL(p.comment, ''), IFNULL(cr.reporterId, 0), IFNULL(ru.username, ''), cr.reason, cr.reportedDT
+		FROM commentreports cr
+		JOIN comments c ON cr.commentId = c.commentId
+		JOIN movies m ON c.movieId = m.movieId
+		LEFT JOIN comments p ON c.parentId = p.commentId
+		LEFT JOIN users u ON c.userId = u.userId
+		LEFT JOIN users ru ON cr.reporterId = ru.userId
+		WHERE cr.resolved = 0
+		ORDER BY (SELECT COUNT(*) FROM commentreports x WHERE x.commentId = c.commentId AND x.resolved = 0) DESC,
+			c.commentId ASC, cr.reportId ASC`
+	rows, err := db.DB.Query(query)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting moderation queue from db: %s", err)
+		return
+	}
+	defer rows.Close()
+	queue := []ReportedComment{}
+	for rows.Next() {
+		comment := ReportedComment{}
+		report := Report{}
+		var postedDT, reportedDT time.Time
+		if err := rows.Scan(&comment.CommentId, &comment.CommentText, &comment.UserId, &comment.Username, &postedDT,
+			&comment.MovieId, &comment.MovieTitle, &comment.Hidden, &comment.ParentText,
+			&report.ReporterId, &report.ReporterName, &report.Reason, &reportedDT); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error scanning a row: %s", err)
+			return
+		}
+		report.ReportedDT = reportedDT.Format(time.DateTime)
+		//Rows are ordered by comment so reports of the same comment are adjacent
+		if n := len(queue); n > 0 && queue[n-1].CommentId == comment.CommentId {
+			queue[n-1].Reports = append(queue[n-1].Reports, report)
+			continue
+		}
+		comment.PostedDT = postedDT.Format(time.DateTime)
+		comment.Reports = []Report{report}
+		queue = append(queue, comment)
+	}
+	context := struct {
+		Queue    []ReportedComment
+		BanUntil string //Default ban duration is one week
+	}{queue, time.Now().Add(7 * 24 * time.Hour).Format("2006-01-02T15:04")}
+	if err := utils.TemplateWrap(tmpl, w, contentName, context, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+// ModerateComment resolves all reports of a comment with one of the actions: dismiss, hide, delete or ban
+func (h *Handler) ModerateComment(w http.ResponseWriter, r *http.Request) {
+	const layout string = "2006-01-02T15:04"
+	commentIdStr := r.PathValue("commentId")
+	commentId, err := strconv.Atoi(commentIdStr)
+	if err != nil || commentId < 0 {
+		http.Error(w, "Wrong comment id!", http.StatusBadRequest)
+		return
+	}
+	action := r.PostFormValue("action")
+	var banUntil time.Time
+	switch action {
+	case "dismiss", "hide", "delete":
+	case "ban":
+		banUntil, err = time.ParseInLocation(layout, r.PostFormValue("banUntil"), time.Local)
+		if err != nil || banUntil.Before(time.Now()) {
+			http.Error(w, "Wrong ban date!", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Wrong moderation action!", http.StatusBadRequest)
+		return
+	}
+	note := r.PostFormValue("note")
+	if utf8.RuneCountInString(note) > maxReportReasonLen {
+		http.Error(w, "Note is too long!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in ModerateComment")
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	var authorId sql.NullInt64
+	var movieId, parentAuthorId int
+	var hidden, held bool
+	comment := Comment{CommentId: commentId}
+	var editedDT sql.NullTime
+	query := `SELECT c.userId, c.movieId, c.hidden, c.comment, c.editedDT, IFNULL(p.userId, 0)
+		FROM comments c LEFT JOIN comments p ON c.parentId = p.commentId WHERE c.commentId = ? FOR UPDATE OF c`
+	if err := tx.QueryRow(query, commentId).Scan(&authorId, &movieId, &hidden, &comment.CommentText, &editedDT, &parentAuthorId); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Comment not found!", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting comment from db: %s", err)
+		return
+	}
+	if action == "ban" && !authorId.Valid {
+		http.Error(w, "Author of the comment doesn't exist!", http.StatusBadRequest)
+		return
+	}
+	//Action is logged first, deletion may remove the comment with its reports
+	if err := logModeration(tx, commentId, session.UserId, int(authorId.Int64), action, note); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error logging moderation action: %s", err)
+		return
+	}
+	var tombstone bool
+	var removed int64
+	switch action {
+	case "dismiss":
+		//Comment held by the filter hasn't notified anyone yet
+		query = `SELECT EXISTS(SELECT * FROM commentreports WHERE commentId = ? AND reporterId IS NULL AND resolved = 0)`
+		if err = tx.QueryRow(query, commentId).Scan(&held); err == nil {
+			query = `UPDATE comments SET hidden = 0 WHERE commentId = ?`
+			_, err = tx.Exec(query, commentId)
+		}
+	case "hide":
+		query = `UPDATE comments SET hidden = 1 WHERE commentId = ?`
+		_, err = tx.Exec(query, commentId)
+	case "delete":
+		_, tombstone, removed, err = removeComment(tx, session.UserId, commentIdStr)
+	case "ban":
+		query = `UPDATE users SET banUntil = ? WHERE userId = ?`
+		if _, err = tx.Exec(query, banUntil.Format(layout), authorId.Int64); err == nil {
+			query = `UPDATE comments SET hidden = 1 WHERE commentId = ?`
+			_, err = tx.Exec(query, commentId)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error applying moderation action %s: %s", action, err)
+		return
+	}
+	query = `UPDATE commentreports SET resolved = 1 WHERE commentId = ?`
+	if _, err := tx.Exec(query, commentId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error resolving reports: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error commiting transaction: %s", err)
+		return
+	}
+	//Sessions are kept in the cache too, so they are ended only once the ban is saved
+	if action == "ban" {
+		if err := SM.KickUser(int(authorId.Int64)); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error kicking user sessions: %s", err)
+			return
+		}
+	}
+	switch action {
+	case "dismiss":
+		//Dismissed reports restore a hidden comment for everyone
+		if hidden {
+			if editedDT.Valid {
+				comment.EditedDT = editedDT.Time.Format(time.DateTime)
+			}
+			publishComment(movieId, CommentEvent{Kind: commentShow, Comment: CommentsContext{Comment: comment}})
+		}
+		if hidden && held && authorId.Valid {
+			notifyComment(int(authorId.Int64), commentId, movieId, parentAuthorId, comment.CommentText)
+		}
+	case "hide", "ban":
+		publishComment(movieId, CommentEvent{Kind: commentHide, Comment: CommentsContext{Comment: Comment{CommentId: commentId, UserId: int(authorId.Int64)}}})
+	case "delete":
+		if removed > 0 {
+			publishRemoval(movieId, commentId, session.UserId, tombstone)
+		}
+	}
+	var message string
+	switch action {
+	case "hide":
+		message = "Your comment was hidden by a moderator"
+	case "delete":
+		message = "Your comment was deleted by a moderator"
+	case "ban":
+		message = "You were banned until " + banUntil.Format(time.DateTime) + " for your comment"
+	default:
+		return
+	}
+	if note != "" {
+		message += ": " + note
+	}
+	//Deleted comment can't be referenced. Moderators stay anonymous
+	if action == "delete" {
+		commentId = 0
+	}
+	if err := notify(int(authorId.Int64), 0, NotifyModeration, commentId, movieId, message); err != nil {
+		log.Printf("Error creating moderation notification: %s", err)
+	}
+}
@@ -0,0 +1,264 @@
+package movie
+
+import (
+	"log"
+	"movie_db/db"
+	"movie_db/format"
+	"movie_db/utils"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const notificationsPerPage int = 20
+
+// notify creates a notification for the user. Users aren't notified about their own actions.
+// Zero actorId, commentId or movieId are stored as NULL
+func notify(userId, actorId int, kind string, commentId, movieId int, message string) error {
+	if userId == 0 || userId == actorId {
+		return nil
+	}
+	query := `INSERT INTO notifications (userId, actorId, kind, commentId, movieId, message)
+		VALUES (?, NULLIF(?, 0), ?, NULLIF(?, 0), NULLIF(?, 0), ?)`
+	_, err := db.DB.Exec(query, userId, actorId, kind, commentId, movieId, message)
+	return err
+}
+
+// notifyMentions notifies existing users with given names, except users in skip
+func notifyMentions(actorId, commentId, movieId int, names []string, skip ...int) error {
+	if len(names) == 0 {
+		return nil
+	}
+	args := make([]any, len(names))
+	for i, name := range names {
+		args[i] = name
+	}
+	query := `SELECT userId FROM users WHERE username IN (?` + strings.Repeat(", ?", len(names)-1) + `)`
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	userIds := []int{}
+	for rows.Next() {
+		var userId int
+		if err := rows.Scan(&userId); err != nil {
+			return err
+		}
+		userIds = append(userIds, userId)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, userId := range userIds {
+		if slices.Contains(skip, userId) {
+			continue
+		}
+		if err := notify(userId, actorId, NotifyMention, commentId, movieId, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyComment notifies the author of the parent comment and mentioned users once a comment is visible.
+// Users already notified about the comment are skipped, so an approved comment doesn't notify twice.
+// Comment is already saved, so failed notifications are only logged
+func notifyComment(actorId, commentId, movieId, parentAuthorId int, text string) {
+	query := `SELECT userId FROM notifications WHERE commentId = ? AND kind IN (?, ?)`
+	rows, err := db.DB.Query(query, commentId, NotifyReply, NotifyMention)
+	if err != nil {
+		log.Printf("Error getting notifications of comment %d: %s", commentId, err)
+		return
+	}
+	defer rows.Close()
+	notified := []int{}
+	for rows.Next() {
+		var userId int
+		if err := rows.Scan(&userId); err != nil {
+			log.Printf("Error scanning a row: %s", err)
+			return
+		}
+		notified = append(notified, userId)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error getting notifications of comment %d: %s", commentId, err)
+		return
+	}
+	if !slices.Contains(notified, parentAuthorId) {
+		if err := notify(parentAuthorId, actorId, NotifyReply, commentId, movieId, ""); err != nil {
+			log.Printf("Error creating reply notification: %s", err)
+		}
+	}
+	if err := notifyMentions(actorId, commentId, movieId, format.Mentions(text), append(notified, parentAuthorId)...); err != nil {
+		log.Printf("Error creating mention notifications: %s", err)
+	}
+}
+
+// addedMentions returns names mentioned in the edited text that weren't mentioned before the edit
+func addedMentions(oldText, newText string) []string {
+	old := format.Mentions(oldText)
+	added := []string{}
+	for _, name := range format.Mentions(newText) {
+		if !slices.ContainsFunc(old, func(o string) bool { return strings.EqualFold(o, name) }) {
+			added = append(added, name)
+		}
+	}
+	return added
+}
+
+// unreadNotifications returns number of unread notifications of the user
+func unreadNotifications(userId int) (int, error) {
+	var unread int
+	query := `SELECT COUNT(*) FROM notifications WHERE userId = ? AND isRead = 0`
+	err := db.DB.QueryRow(query, userId).Scan(&unread)
+	return unread, err
+}
+
+// loadNotifications returns page of user's notifications, newest first, older than lastId. lastId 0 means first page
+func loadNotifications(userId, lastId int) ([]Notification, error) {
+	query := `SELECT n.notificationId, n.kind, IFNULL(n.actorId, 0), IFNULL(a.username, 'DELETED'), IFNULL(n.commentId, 0),
+			IFNULL(n.movieId, 0), IFNULL(m.title, ''), n.message, n.isRead, n.createdDT
+		FROM notifications n
+		LEFT JOIN users a ON n.actorId = a.userId
+		LEFT JOIN movies m ON n.movieId = m.movieId
+		WHERE n.userId = ? AND (? = 0 OR n.notificationId < ?)
+		ORDER BY n.notificationId DESC
+		LIMIT ?`
+	rows, err := db.DB.Query(query, userId, lastId, lastId, notificationsPerPage)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	notifications := []Notification{}
+	for rows.Next() {
+		n := Notification{}
+		var createdDT time.Time
+		if err := rows.Scan(&n.NotificationId, &n.Kind, &n.ActorId, &n.ActorName, &n.CommentId,
+			&n.MovieId, &n.MovieTitle, &n.Message, &n.Read, &createdDT); err != nil {
+			return nil, err
+		}
+		n.CreatedDT = createdDT.Format(time.DateTime)
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+type notificationsContext struct {
+	Notifications []Notification
+	LastId        int //0 if there are no more notifications to load
+}
+
+func newNotificationsContext(notifications []Notification) notificationsContext {
+	context := notificationsContext{Notifications: notifications}
+	if len(notifications) == notificationsPerPage {
+		context.LastId = notifications[len(notifications)-1].NotificationId
+	}
+	return context
+}
+
+func (h *Handler) GetNotificationsPage(w http.ResponseWriter, r *http.Request) {
+	const wrapperName, contentName string = "index", "notifications-page"
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in GetNotificationsPage")
+		return
+	}
+	notifications, err := loadNotifications(session.UserId, 0)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting notifications from db: %s", err)
+		return
+	}
+	if err := utils.TemplateWrap(tmpl, w, contentName, newNotificationsContext(notifications), wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+// GetNotifications returns next page of notifications
+func (h *Handler) GetNotifications(w http.ResponseWriter, r *http.Request) {
+	const templateName string = "notifications"
+	lastId, err := strconv.Atoi(r.PathValue("lastId"))
+	if err != nil || lastId < 0 {
+		http.Error(w, "Wrong last notification id!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in GetNotifications")
+		return
+	}
+	notifications, err := loadNotifications(session.UserId, lastId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting notifications from db: %s", err)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, newNotificationsContext(notifications)); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
+
+// ReadNotification marks one notification as read and renders it again
+func (h *Handler) ReadNotification(w http.ResponseWriter, r *http.Request) {
+	const templateName string = "notification"
+	notificationId, err := strconv.Atoi(r.PathValue("notificationId"))
+	if err != nil || notificationId < 0 {
+		http.Error(w, "Wrong notification id!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in ReadNotification")
+		return
+	}
+	query := `UPDATE notifications SET isRead = 1 WHERE notificationId = ? AND userId = ?`
+	if _, err := db.DB.Exec(query, notificationId, session.UserId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error marking notification as read: %s", err)
+		return
+	}
+	//Page that starts right after the id begins with the notification itself
+	notifications, err := loadNotifications(session.UserId, notificationId+1)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting notification from db: %s", err)
+		return
+	}
+	if len(notifications) == 0 || notifications[0].NotificationId != notificationId {
+		http.Error(w, "Notification not found!", http.StatusBadRequest)
+		return
+	}
+	//Unread counter in the header listens for this event
+	w.Header().Add("HX-Trigger", "notificationsRead")
+	if err := tmpl.ExecuteTemplate(w, templateName, notifications[0]); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
+
+func (h *Handler) ReadAllNotifications(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in ReadAllNotifications")
+		return
+	}
+	query := `UPDATE notifications SET isRead = 1 WHERE userId = ? AND isRead = 0`
+	if _, err := db.DB.Exec(query, session.UserId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error marking notifications as read: %s", err)
+		return
+	}
+	w.Header().Add("HX-Redirect", "/auth/notifications")
+}
@@ -0,0 +1,40 @@
+package movie
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestNotifyComment(t *testing.T) {
+	const insert string = `INSERT INTO notifications \(userId, actorId, kind, commentId, movieId, message\)`
+	tests := []struct {
+		name     string
+		notified []int
+		want     []int //Mentioned users notified, in order
+		reply    bool
+	}{
+		{name: "New comment", reply: true, want: []int{4, 5}},
+		{name: "Approved after an edit", notified: []int{3, 4}, want: []int{5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := mockDB(t)
+			rows := sqlmock.NewRows([]string{"userId"})
+			for _, userId := range tt.notified {
+				rows.AddRow(userId)
+			}
+			mock.ExpectQuery(`SELECT userId FROM notifications WHERE commentId = \? AND kind IN \(\?, \?\)`).
+				WithArgs(9, NotifyReply, NotifyMention).WillReturnRows(rows)
+			if tt.reply {
+				mock.ExpectExec(insert).WithArgs(3, 2, NotifyReply, 9, 1, "").WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			mock.ExpectQuery(`SELECT userId FROM users WHERE username IN \(\?, \?, \?\)`).WithArgs("ann", "bob", "cid").
+				WillReturnRows(sqlmock.NewRows([]string{"userId"}).AddRow(3).AddRow(4).AddRow(5))
+			for _, userId := range tt.want {
+				mock.ExpectExec(insert).WithArgs(userId, 2, NotifyMention, 9, 1, "").WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			notifyComment(2, 9, 1, 3, "@ann @bob and @cid")
+		})
+	}
+}
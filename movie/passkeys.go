@@ -0,0 +1,403 @@
+package movie
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"movie_db/db"
+	"movie_db/utils"
+	"movie_db/webauthn"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// RP is the relying party passkeys are registered for
+var RP *webauthn.RelyingParty
+
+// Purpose of a passkey challenge
+const (
+	PasskeyRegister string = "register"
+	PasskeyLogin    string = "login"
+)
+
+const (
+	maxPasskeys        int   = 10
+	maxNicknameLen     int   = 64
+	maxPasskeyBodySize int64 = 64 << 10
+)
+
+var errInvalidChallenge = errors.New("invalid or expired challenge")
+
+type Passkey struct {
+	ID         string //Credential id in base64url
+	Nickname   string
+	CreatedDT  string
+	LastUsedDT string
+}
+
+// passkeyRequest is a ceremony result sent by static/passkeys.js, binary values are base64url
+type passkeyRequest struct {
+	ID                string `json:"id"`
+	Nickname          string `json:"nickname"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	Remember          bool   `json:"remember"`
+}
+
+func readPasskeyRequest(w http.ResponseWriter, r *http.Request) (*passkeyRequest, bool) {
+	req := &passkeyRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPasskeyBodySize)).Decode(req); err != nil {
+		http.Error(w, "Wrong passkey data!", http.StatusBadRequest)
+		return nil, false
+	}
+	return req, true
+}
+
+// userHandle identifies the user in discoverable credentials
+func userHandle(userId int) []byte {
+	return []byte(strconv.Itoa(userId))
+}
+
+// newChallenge stores the challenge of a ceremony. Registration challenges belong to a user
+func newChallenge(userId int, purpose string) ([]byte, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, err
+	}
+	query := `DELETE FROM passkeychallenges WHERE expiresDT < NOW()`
+	if _, err := db.DB.Exec(query); err != nil {
+		return nil, err
+	}
+	query = `INSERT INTO passkeychallenges (challengeHash, userId, purpose, expiresDT) VALUES (?, ?, ?, ?)`
+	_, err = db.DB.Exec(query, utils.HashToken(webauthn.Encode(challenge)), sql.NullInt64{Int64: int64(userId), Valid: userId != 0},
+		purpose, time.Now().Add(webauthn.Timeout+time.Minute))
+	return challenge, err
+}
+
+// useChallenge consumes the challenge the client signed and returns it with the user it was issued to
+func useChallenge(tx *sql.Tx, clientDataJSON []byte, purpose string) ([]byte, int, error) {
+	challenge, err := webauthn.ClientChallenge(clientDataJSON)
+	if err != nil {
+		return nil, 0, errInvalidChallenge
+	}
+	hash := utils.HashToken(webauthn.Encode(challenge))
+	var userId sql.NullInt64
+	query := `SELECT userId FROM passkeychallenges WHERE challengeHash = ? AND purpose = ? AND expiresDT > NOW() FOR UPDATE`
+	if err := tx.QueryRow(query, hash, purpose).Scan(&userId); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, 0, errInvalidChallenge
+		}
+		return nil, 0, err
+	}
+	query = `DELETE FROM passkeychallenges WHERE challengeHash = ?`
+	if _, err := tx.Exec(query, hash); err != nil {
+		return nil, 0, err
+	}
+	return challenge, int(userId.Int64), nil
+}
+
+func loadPasskeys(userId int) ([]Passkey, error) {
+	query := `SELECT credentialId, nickname, createdDT, lastUsedDT FROM passkeys WHERE userId = ? ORDER BY createdDT`
+	rows, err := db.DB.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	passkeys := []Passkey{}
+	for rows.Next() {
+		p := Passkey{}
+		var id []byte
+		var created time.Time
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&id, &p.Nickname, &created, &lastUsed); err != nil {
+			return nil, err
+		}
+		p.ID = webauthn.Encode(id)
+		p.CreatedDT = created.Format(time.DateTime)
+		if lastUsed.Valid {
+			p.LastUsedDT = lastUsed.Time.Format(time.DateTime)
+		}
+		passkeys = append(passkeys, p)
+	}
+	return passkeys, rows.Err()
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing JSON: %s", err)
+	}
+}
+
+func (h *Handler) GetPasskeysPage(w http.ResponseWriter, r *http.Request) {
+	const wrapperName, contentName string = "index", "passkeys-page"
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in GetPasskeysPage")
+		return
+	}
+	passkeys, err := loadPasskeys(session.UserId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error loading passkeys: %s", err)
+		return
+	}
+	if err := utils.TemplateWrap(tmpl, w, contentName, passkeys, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+// PasskeyCreationOptions starts registration of a passkey for the current user
+func (h *Handler) PasskeyCreationOptions(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in PasskeyCreationOptions")
+		return
+	}
+	query := `SELECT credentialId FROM passkeys WHERE userId = ?`
+	rows, err := db.DB.Query(query, session.UserId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting passkeys: %s", err)
+		return
+	}
+	defer rows.Close()
+	exclude := [][]byte{}
+	for rows.Next() {
+		var id []byte
+		if err := rows.Scan(&id); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error scanning passkey: %s", err)
+			return
+		}
+		exclude = append(exclude, id)
+	}
+	if len(exclude) >= maxPasskeys {
+		http.Error(w, "You can have at most "+strconv.Itoa(maxPasskeys)+" passkeys!", http.StatusBadRequest)
+		return
+	}
+	challenge, err := newChallenge(session.UserId, PasskeyRegister)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error creating passkey challenge: %s", err)
+		return
+	}
+	user := webauthn.User{ID: userHandle(session.UserId), Name: session.Username, DisplayName: session.Username}
+	writeJSON(w, RP.CreationOptions(user, challenge, exclude))
+}
+
+// PostPasskey verifies and saves a created passkey
+func (h *Handler) PostPasskey(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in PostPasskey")
+		return
+	}
+	req, ok := readPasskeyRequest(w, r)
+	if !ok {
+		return
+	}
+	if utf8.RuneCountInString(req.Nickname) > maxNicknameLen {
+		http.Error(w, "Name must be at most "+strconv.Itoa(maxNicknameLen)+" characters!", http.StatusBadRequest)
+		return
+	}
+	if req.Nickname == "" {
+		req.Nickname = "Passkey"
+	}
+	clientData, err1 := webauthn.Decode(req.ClientDataJSON)
+	attestation, err2 := webauthn.Decode(req.AttestationObject)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "Wrong passkey data!", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	challenge, userId, err := useChallenge(tx, clientData, PasskeyRegister)
+	if err == errInvalidChallenge || (err == nil && userId != session.UserId) {
+		http.Error(w, "Registration expired, try again!", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error using passkey challenge: %s", err)
+		return
+	}
+	cred, err := RP.VerifyRegistration(challenge, clientData, attestation)
+	if err != nil {
+		http.Error(w, "Passkey was rejected!", http.StatusBadRequest)
+		log.Printf("Error verifying passkey registration of user %d: %s", session.UserId, err)
+		return
+	}
+	var exists bool
+	query := `SELECT EXISTS(SELECT * FROM passkeys WHERE credentialId = ?)`
+	if err := tx.QueryRow(query, cred.ID).Scan(&exists); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking passkey existance in db: %s", err)
+		return
+	}
+	if exists {
+		http.Error(w, "This passkey is already registered!", http.StatusBadRequest)
+		return
+	}
+	query = `INSERT INTO passkeys (credentialId, userId, publicKey, signCount, nickname) VALUES (?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, cred.ID, session.UserId, cred.PublicKey, cred.SignCount, req.Nickname); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error inserting passkey: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error committing passkey: %s", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *Handler) RenamePasskey(w http.ResponseWriter, r *http.Request) {
+	id, err := webauthn.Decode(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Wrong passkey id!", http.StatusBadRequest)
+		return
+	}
+	nickname := r.PostFormValue("nickname")
+	if nickname == "" || utf8.RuneCountInString(nickname) > maxNicknameLen {
+		http.Error(w, "Name must be 1 to "+strconv.Itoa(maxNicknameLen)+" characters!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in RenamePasskey")
+		return
+	}
+	query := `UPDATE passkeys SET nickname = ? WHERE credentialId = ? AND userId = ?`
+	if _, err := db.DB.Exec(query, nickname, id, session.UserId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error renaming passkey: %s", err)
+		return
+	}
+	w.Header().Add("HX-Redirect", "/auth/account/passkeys")
+}
+
+func (h *Handler) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	id, err := webauthn.Decode(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Wrong passkey id!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in DeletePasskey")
+		return
+	}
+	query := `DELETE FROM passkeys WHERE credentialId = ? AND userId = ?`
+	if _, err := db.DB.Exec(query, id, session.UserId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error deleting passkey: %s", err)
+		return
+	}
+	w.Header().Add("HX-Redirect", "/auth/account/passkeys")
+}
+
+// PasskeyLoginOptions starts a login where the user picks any passkey of the site
+func (h *Handler) PasskeyLoginOptions(w http.ResponseWriter, r *http.Request) {
+	challenge, err := newChallenge(0, PasskeyLogin)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error creating passkey challenge: %s", err)
+		return
+	}
+	writeJSON(w, RP.RequestOptions(challenge, nil))
+}
+
+// LoginPasskey logs in with a passkey signature. User verification of the authenticator counts as the second factor
+func (h *Handler) LoginPasskey(w http.ResponseWriter, r *http.Request) {
+	const rejected string = "Passkey was rejected!"
+	req, ok := readPasskeyRequest(w, r)
+	if !ok {
+		return
+	}
+	id, err1 := webauthn.Decode(req.ID)
+	clientData, err2 := webauthn.Decode(req.ClientDataJSON)
+	authData, err3 := webauthn.Decode(req.AuthenticatorData)
+	signature, err4 := webauthn.Decode(req.Signature)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		http.Error(w, "Wrong passkey data!", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	challenge, _, err := useChallenge(tx, clientData, PasskeyLogin)
+	if err == errInvalidChallenge {
+		http.Error(w, "Login expired, try again!", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error using passkey challenge: %s", err)
+		return
+	}
+	session := Session{MFA: true, Remember: req.Remember}
+	cred := webauthn.Credential{ID: id}
+	banUntil := time.Time{}
+	query := `SELECT p.publicKey, p.signCount, u.userId, u.username, u.admin, u.totpSecret IS NOT NULL, u.banUntil FROM passkeys p
+		JOIN users u ON p.userId = u.userId WHERE p.credentialId = ? FOR UPDATE`
+	if err := tx.QueryRow(query, id).Scan(&cred.PublicKey, &cred.SignCount, &session.UserId, &session.Username,
+		&session.Admin, &session.TwoFactor, &banUntil); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, rejected, http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting passkey: %s", err)
+		return
+	}
+	signCount, err := RP.VerifyAssertion(challenge, cred, clientData, authData, signature)
+	if err != nil {
+		http.Error(w, rejected, http.StatusUnauthorized)
+		log.Printf("Error verifying passkey of user %d: %s", session.UserId, err)
+		return
+	}
+	if banUntil.After(time.Now()) {
+		http.Error(w, "You are banned until "+banUntil.Format(time.DateTime), http.StatusForbidden)
+		return
+	}
+	query = `UPDATE passkeys SET signCount = ?, lastUsedDT = NOW() WHERE credentialId = ?`
+	if _, err := tx.Exec(query, signCount, id); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating passkey: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error committing passkey login: %s", err)
+		return
+	}
+	if err := logIn(w, r, session); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error creating a session: %s", err)
+		return
+	}
+}
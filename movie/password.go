@@ -0,0 +1,372 @@
+package movie
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"movie_db/db"
+	"movie_db/mail"
+	"movie_db/utils"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Mail sends password reset and email verification links
+var Mail mail.Mailer
+
+// BaseURL is the public address of the site used in links sent by email, without trailing slash
+var BaseURL string
+
+// Purpose of a user token
+const (
+	TokenReset  string = "reset"
+	TokenVerify string = "verify"
+	TokenLogin  string = "login" //Password was checked, second factor is pending
+)
+
+const (
+	resetTokenLifetime  time.Duration = time.Hour
+	verifyTokenLifetime time.Duration = 24 * time.Hour
+	mailCooldown        time.Duration = 5 * time.Minute //Minimal time between emails of one purpose to a user
+	mailTimeout         time.Duration = 30 * time.Second
+)
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+type accountContext struct {
+	Session
+	Email        string
+	PendingEmail string
+	PasswordSet  bool //False for accounts created with single sign-on until a password is set
+}
+
+type messageContext struct {
+	Title string
+	Text  string
+}
+
+// createToken replaces tokens of the purpose with a new one. Only hash of the token is stored
+func createToken(userId int, purpose, email string, lifetime time.Duration) (string, error) {
+	token, err := utils.GenerateToken(sessionTokenLength)
+	if err != nil {
+		return "", err
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	query := `DELETE FROM usertokens WHERE userId = ? AND purpose = ?`
+	if _, err := tx.Exec(query, userId, purpose); err != nil {
+		return "", err
+	}
+	query = `INSERT INTO usertokens (tokenHash, userId, purpose, email, expiresDT) VALUES (?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, utils.HashToken(token), userId, purpose, sql.NullString{String: email, Valid: email != ""},
+		time.Now().Add(lifetime)); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// useToken consumes a valid token inside the transaction, so it works only once
+func useToken(tx *sql.Tx, token, purpose string) (userId int, email string, err error) {
+	var nullEmail sql.NullString
+	query := `SELECT userId, email FROM usertokens WHERE tokenHash = ? AND purpose = ? AND expiresDT > NOW() FOR UPDATE`
+	if err := tx.QueryRow(query, utils.HashToken(token), purpose).Scan(&userId, &nullEmail); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, "", errInvalidToken
+		}
+		return 0, "", err
+	}
+	query = `DELETE FROM usertokens WHERE tokenHash = ?`
+	if _, err := tx.Exec(query, utils.HashToken(token)); err != nil {
+		return 0, "", err
+	}
+	return userId, nullEmail.String, nil
+}
+
+// checkToken reports whether the token is valid without consuming it
+func checkToken(token, purpose string) (bool, error) {
+	var valid bool
+	query := `SELECT EXISTS(SELECT * FROM usertokens WHERE tokenHash = ? AND purpose = ? AND expiresDT > NOW())`
+	err := db.DB.QueryRow(query, utils.HashToken(token), purpose).Scan(&valid)
+	return valid, err
+}
+
+// recentToken reports whether a token of the purpose was sent to the user within mailCooldown
+func recentToken(userId int, purpose string) (bool, error) {
+	var recent bool
+	query := `SELECT EXISTS(SELECT * FROM usertokens WHERE userId = ? AND purpose = ? AND createdDT > ?)`
+	err := db.DB.QueryRow(query, userId, purpose, time.Now().Add(-mailCooldown)).Scan(&recent)
+	return recent, err
+}
+
+// sendMail delivers in background, so response time doesn't reveal whether an email was sent
+func sendMail(m mail.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+		if err := Mail.Send(ctx, m); err != nil {
+			log.Printf("Error sending mail: %s", err)
+		}
+	}()
+}
+
+func tokenLink(path, token string) string {
+	return BaseURL + path + "?token=" + url.QueryEscape(token)
+}
+
+func renderMessage(w http.ResponseWriter, title, text string) {
+	const wrapperName, contentName string = "index", "message-page"
+	if err := utils.TemplateWrap(tmpl, w, contentName, messageContext{title, text}, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+// ChangeEmail sends a verification link to the new address. The address is saved once the link is opened.
+// Empty address removes the email from the account
+func (h *Handler) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	email := r.PostFormValue("email")
+	if email != "" && !mail.ValidAddress(email) {
+		http.Error(w, "Email address is not valid!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in ChangeEmail")
+		return
+	}
+	valid, err := checkPassword(session.UserId, r.PostFormValue("password"))
+	if err == errNoPassword {
+		http.Error(w, noPasswordMessage, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking password: %s", err)
+		return
+	}
+	if !valid {
+		http.Error(w, "Password is wrong!", http.StatusBadRequest)
+		return
+	}
+	if email == "" {
+		query := `UPDATE users SET email = NULL WHERE userId = ?`
+		if _, err := db.DB.Exec(query, session.UserId); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error removing email: %s", err)
+			return
+		}
+		query = `DELETE FROM usertokens WHERE userId = ? AND purpose IN (?, ?)`
+		if _, err := db.DB.Exec(query, session.UserId, TokenReset, TokenVerify); err != nil {
+			log.Printf("Error deleting tokens of user %d: %s", session.UserId, err)
+		}
+		w.Header().Add("HX-Redirect", "/auth/account")
+		return
+	}
+	recent, err := recentToken(session.UserId, TokenVerify)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking recent tokens: %s", err)
+		return
+	}
+	if recent {
+		http.Error(w, "Verification email was sent recently, try again in a few minutes!", http.StatusTooManyRequests)
+		return
+	}
+	token, err := createToken(session.UserId, TokenVerify, email, verifyTokenLifetime)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error creating verification token: %s", err)
+		return
+	}
+	sendMail(mail.Message{
+		To:      email,
+		Subject: "Confirm your email",
+		Body: "Hello " + session.Username + ",\n\nopen the link to use this address for your Movie DB account:\n" +
+			tokenLink("/email/verify", token) + "\n\nThe link works for 24 hours. If you didn't ask for it, ignore this email.",
+	})
+	w.Write([]byte("Verification link was sent to " + email + "."))
+}
+
+// VerifyEmail saves the address from a verification link. Address verified by another account meanwhile is rejected
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	userId, email, err := useToken(tx, r.FormValue("token"), TokenVerify)
+	if err == errInvalidToken {
+		renderMessage(w, "Email not confirmed", "The link is invalid or expired. Request a new one in account settings.")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error using verification token: %s", err)
+		return
+	}
+	var taken bool
+	query := `SELECT EXISTS(SELECT * FROM users WHERE email = ? AND userId <> ?)`
+	if err := tx.QueryRow(query, email, userId).Scan(&taken); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking email existance in db: %s", err)
+		return
+	}
+	if taken {
+		renderMessage(w, "Email not confirmed", "This address is already used by another account.")
+		return
+	}
+	query = `UPDATE users SET email = ? WHERE userId = ?`
+	if _, err := tx.Exec(query, email, userId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating email: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error committing email verification: %s", err)
+		return
+	}
+	renderMessage(w, "Email confirmed", "You can now use "+email+" to reset your password.")
+}
+
+func (h *Handler) GetForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	const wrapperName, contentName string = "index", "forgot-password"
+	if err := utils.TemplateWrap(tmpl, w, contentName, nil, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+// ForgotPassword sends a reset link to the verified email of the account found by username or email.
+// Response is the same whether an account was found or not
+func (h *Handler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	const response string = "If the account has a confirmed email, a reset link was sent to it."
+	login := r.PostFormValue("login")
+	if login == "" {
+		http.Error(w, "Username or email can't be empty!", http.StatusBadRequest)
+		return
+	}
+	var userId int
+	var username, email string
+	query := `SELECT userId, username, email FROM users WHERE (username = ? OR email = ?) AND email IS NOT NULL LIMIT 1`
+	if err := db.DB.QueryRow(query, login, login).Scan(&userId, &username, &email); err != nil {
+		if err != sql.ErrNoRows {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error getting user from db: %s", err)
+			return
+		}
+		w.Write([]byte(response))
+		return
+	}
+	recent, err := recentToken(userId, TokenReset)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking recent tokens: %s", err)
+		return
+	}
+	if recent {
+		w.Write([]byte(response))
+		return
+	}
+	token, err := createToken(userId, TokenReset, "", resetTokenLifetime)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error creating reset token: %s", err)
+		return
+	}
+	sendMail(mail.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: "Hello " + username + ",\n\nopen the link to set a new password for your Movie DB account:\n" +
+			tokenLink("/password/reset", token) + "\n\nThe link works for one hour and only once. If you didn't ask for it, ignore this email.",
+	})
+	w.Write([]byte(response))
+}
+
+func (h *Handler) GetResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	const wrapperName, contentName string = "index", "reset-password"
+	token := r.FormValue("token")
+	valid, err := checkToken(token, TokenReset)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking reset token: %s", err)
+		return
+	}
+	if !valid {
+		renderMessage(w, "Password not reset", "The link is invalid or expired. Request a new one.")
+		return
+	}
+	//Token isn't leaked to other sites through the Referer header
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := utils.TemplateWrap(tmpl, w, contentName, token, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+// ResetPassword sets a new password with a reset token and logs out all sessions of the user
+func (h *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	password := r.PostFormValue("password")
+	if password == "" {
+		http.Error(w, "Password can't be empty!", http.StatusBadRequest)
+		return
+	}
+	if password != r.PostFormValue("confirmPassword") {
+		http.Error(w, "Passwords don't match!", http.StatusBadRequest)
+		return
+	}
+	if !utils.PasswordAnalysis(password) {
+		http.Error(w, "Password doesn't meet the requirements!", http.StatusBadRequest)
+		return
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error hashing password: %s", err)
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	userId, _, err := useToken(tx, r.PostFormValue("token"), TokenReset)
+	if err == errInvalidToken {
+		http.Error(w, "The link is invalid or expired, request a new one!", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error using reset token: %s", err)
+		return
+	}
+	query := `UPDATE users SET password = ?, passwordSet = 1 WHERE userId = ?`
+	if _, err := tx.Exec(query, hashedPassword, userId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating password: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error committing password reset: %s", err)
+		return
+	}
+	if err := SM.KickUser(userId); err != nil {
+		log.Printf("Error kicking user sessions: %s", err)
+	}
+	log.Printf("User %d reset their password", userId)
+	w.Header().Add("HX-Redirect", "/login")
+}
@@ -0,0 +1,47 @@
+package movie
+
+import (
+	"database/sql"
+	"errors"
+	"movie_db/db"
+)
+
+var errEntryNotFound = errors.New("entry not found")
+
+// moveEntry swaps a movie entry of an ordered table (watchlist, list entries) with its upper or lower neighbour.
+// Table and owner column names are never taken from user input.
+func moveEntry(table, ownerColumn string, ownerId, movieId int, up bool) error {
+	neighbourQuery := `SELECT movieId, position FROM ` + table + ` WHERE ` + ownerColumn + ` = ? AND position > ? ORDER BY position ASC LIMIT 1`
+	if up {
+		neighbourQuery = `SELECT movieId, position FROM ` + table + ` WHERE ` + ownerColumn + ` = ? AND position < ? ORDER BY position DESC LIMIT 1`
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var position, neighbourId, neighbourPosition int
+	query := `SELECT position FROM ` + table + ` WHERE ` + ownerColumn + ` = ? AND movieId = ? FOR UPDATE`
+	if err := tx.QueryRow(query, ownerId, movieId).Scan(&position); err != nil {
+		if err == sql.ErrNoRows {
+			return errEntryNotFound
+		}
+		return err
+	}
+	err = tx.QueryRow(neighbourQuery, ownerId, position).Scan(&neighbourId, &neighbourPosition)
+	if err == sql.ErrNoRows {
+		//Entry is already first or last
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	query = `UPDATE ` + table + ` SET position = ? WHERE ` + ownerColumn + ` = ? AND movieId = ?`
+	if _, err := tx.Exec(query, neighbourPosition, ownerId, movieId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(query, position, ownerId, neighbourId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,304 @@
+package movie
+
+import (
+	"cmp"
+	"database/sql"
+	"log"
+	"movie_db/blob"
+	"movie_db/db"
+	"movie_db/httpcache"
+	"movie_db/poster"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayNameLen int = 50
+	maxBioLen         int = 1000
+	maxFavorites      int = 5
+	activityLimit     int = 10
+	profileGenres     int = 8 //Genres shown in the breakdown, the rest are omitted
+)
+
+// noAvatar is the placeholder for users without an avatar, relative to the static directory
+const noAvatar string = "img/no-avatar.svg"
+
+func profileStats(userId int) (ProfileStats, error) {
+	stats := ProfileStats{}
+	query := `SELECT COUNT(*), IFNULL(AVG(rating), 0) FROM movierating WHERE userId = ?`
+	if err := db.DB.QueryRow(query, userId).Scan(&stats.Ratings, &stats.AverageRating); err != nil {
+		return stats, err
+	}
+	query = `SELECT COUNT(*) FROM comments WHERE userId = ? AND deleted = 0 AND hidden = 0`
+	if err := db.DB.QueryRow(query, userId).Scan(&stats.Comments); err != nil {
+		return stats, err
+	}
+	query = `SELECT IFNULL(m.genres, '') FROM movierating r JOIN movies m ON r.movieId = m.movieId WHERE r.userId = ?`
+	rows, err := db.DB.Query(query, userId)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		movie := Movie{}
+		if err := rows.Scan(&movie.Genres); err != nil {
+			return stats, err
+		}
+		for _, genre := range movie.SplitGenresString() {
+			if genre != "" && genre != "(no genres listed)" {
+				counts[genre]++
+			}
+		}
+	}
+	for genre, count := range counts {
+		stats.Genres = append(stats.Genres, GenreCount{genre, count})
+	}
+	slices.SortFunc(stats.Genres, func(a, b GenreCount) int {
+		return cmp.Or(b.Count-a.Count, cmp.Compare(a.Genre, b.Genre))
+	})
+	if len(stats.Genres) > profileGenres {
+		stats.Genres = stats.Genres[:profileGenres]
+	}
+	return stats, rows.Err()
+}
+
+// recentActivity returns latest ratings and visible comments of the user
+func recentActivity(userId int) ([]Activity, error) {
+	query := `(SELECT 'rating' AS kind, r.movieId, m.title, r.rating, '' AS text, r.timeStamp AS dt
+			FROM movierating r JOIN movies m ON r.movieId = m.movieId WHERE r.userId = ?)
+		UNION ALL
+		(SELECT 'comment', c.movieId, m.title, 0, c.comment, c.postedDT
+			FROM comments c JOIN movies m ON c.movieId = m.movieId WHERE c.userId = ? AND c.deleted = 0 AND c.hidden = 0)
+		ORDER BY dt DESC LIMIT ?`
+	rows, err := db.DB.Query(query, userId, userId, activityLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	activity := []Activity{}
+	for rows.Next() {
+		a := Activity{}
+		var dt time.Time
+		if err := rows.Scan(&a.Kind, &a.MovieId, &a.MovieTitle, &a.Rating, &a.Text, &dt); err != nil {
+			return nil, err
+		}
+		a.DT = dt.Format(time.DateTime)
+		activity = append(activity, a)
+	}
+	return activity, rows.Err()
+}
+
+func favoriteMovies(userId int) ([]Movie, error) {
+	query := `SELECT m.movieId, m.title FROM favoritemovies f JOIN movies m ON f.movieId = m.movieId
+		WHERE f.userId = ? ORDER BY f.position ASC`
+	rows, err := db.DB.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	movies := []Movie{}
+	for rows.Next() {
+		m := Movie{}
+		if err := rows.Scan(&m.ID, &m.Title); err != nil {
+			return nil, err
+		}
+		movies = append(movies, m)
+	}
+	return movies, rows.Err()
+}
+
+// GetAvatar serves user avatar. Query parameter size selects full avatar or thumbnail.
+// Users without an avatar are redirected to the placeholder image
+func (h *Handler) GetAvatar(w http.ResponseWriter, r *http.Request) {
+	//Pages add avatar version to the address, so a new avatar shows up right away
+	const cacheControl string = "public, max-age=3600"
+	userId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || userId < 0 {
+		http.Error(w, "Wrong user id!", http.StatusBadRequest)
+		return
+	}
+	size, err := poster.ParseSize(r.FormValue("size"))
+	if err != nil {
+		http.Error(w, "Wrong avatar size!", http.StatusBadRequest)
+		return
+	}
+	content, info, err := Posters.OpenAvatar(r.Context(), userId, size)
+	if err != nil {
+		if err != blob.ErrNotFound {
+			log.Printf("Error opening avatar: %s", err)
+		}
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		http.Redirect(w, r, Static.URL(noAvatar), http.StatusFound)
+		return
+	}
+	defer content.Close()
+	if err := httpcache.ServeReader(w, r, info.ETag, info.ModTime, info.ContentType, cacheControl, content); err != nil {
+		log.Printf("Error serving avatar: %s", err)
+	}
+}
+
+func (h *Handler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	displayName := r.PostFormValue("displayName")
+	if utf8.RuneCountInString(displayName) > maxDisplayNameLen {
+		http.Error(w, "Display name must be at most "+strconv.Itoa(maxDisplayNameLen)+" characters!", http.StatusBadRequest)
+		return
+	}
+	bio := r.PostFormValue("bio")
+	if utf8.RuneCountInString(bio) > maxBioLen {
+		http.Error(w, "Bio must be at most "+strconv.Itoa(maxBioLen)+" characters!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in UpdateProfile")
+		return
+	}
+	query := `UPDATE users SET displayName = ?, bio = ? WHERE userId = ?`
+	if _, err := db.DB.Exec(query, displayName, bio, session.UserId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating profile: %s", err)
+		return
+	}
+	w.Header().Add("HX-Redirect", "/user/"+strconv.Itoa(session.UserId))
+}
+
+func (h *Handler) UpdateAvatar(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in UpdateAvatar")
+		return
+	}
+	data, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
+	images, err := poster.Square.Process(data)
+	if err != nil {
+		uploadError(w, err, poster.Square)
+		return
+	}
+	if err := Posters.SaveAvatar(r.Context(), session.UserId, images); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error saving avatar: %s", err)
+		return
+	}
+	query := `UPDATE users SET avatarVersion = avatarVersion + 1 WHERE userId = ?`
+	if _, err := db.DB.Exec(query, session.UserId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating avatar version: %s", err)
+		return
+	}
+	w.Header().Add("HX-Redirect", "/user/"+strconv.Itoa(session.UserId))
+}
+
+func (h *Handler) DeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in DeleteAvatar")
+		return
+	}
+	query := `UPDATE users SET avatarVersion = 0 WHERE userId = ?`
+	if _, err := db.DB.Exec(query, session.UserId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error resetting avatar version: %s", err)
+		return
+	}
+	if err := Posters.DeleteAvatar(r.Context(), session.UserId); err != nil {
+		log.Printf("Error deleting avatar of user %d: %s", session.UserId, err)
+	}
+	w.Header().Add("HX-Redirect", "/user/"+strconv.Itoa(session.UserId))
+}
+
+// PostFavorite adds the movie to the end of user's favorites
+func (h *Handler) PostFavorite(w http.ResponseWriter, r *http.Request) {
+	movieId, err := strconv.Atoi(r.PostFormValue("movieId"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in PostFavorite")
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	var count, position int
+	query := `SELECT COUNT(*), IFNULL(MAX(position), 0) + 1 FROM favoritemovies WHERE userId = ? FOR UPDATE`
+	if err := tx.QueryRow(query, session.UserId).Scan(&count, &position); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error counting favorites: %s", err)
+		return
+	}
+	if count >= maxFavorites {
+		http.Error(w, "You can have at most "+strconv.Itoa(maxFavorites)+" favorite movies!", http.StatusBadRequest)
+		return
+	}
+	query = `INSERT IGNORE INTO favoritemovies (userId, movieId, position) SELECT ?, movieId, ? FROM movies WHERE movieId = ?`
+	result, err := tx.Exec(query, session.UserId, position, movieId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error adding favorite: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error committing favorite: %s", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		w.Write([]byte("Already in favorites."))
+		return
+	}
+	w.Write([]byte("Added to favorites."))
+}
+
+func (h *Handler) DeleteFavorite(w http.ResponseWriter, r *http.Request) {
+	movieId, err := strconv.Atoi(r.PathValue("movieId"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in DeleteFavorite")
+		return
+	}
+	query := `DELETE FROM favoritemovies WHERE userId = ? AND movieId = ?`
+	if _, err := db.DB.Exec(query, session.UserId, movieId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error deleting favorite: %s", err)
+		return
+	}
+}
+
+// loadProfile fills profile sections of the user page. Failures leave a section empty
+func loadProfile(userId int) (ProfileStats, []Activity, []Movie) {
+	stats, err := profileStats(userId)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error getting profile stats: %s", err)
+	}
+	activity, err := recentActivity(userId)
+	if err != nil {
+		log.Printf("Error getting recent activity: %s", err)
+	}
+	favorites, err := favoriteMovies(userId)
+	if err != nil {
+		log.Printf("Error getting favorite movies: %s", err)
+	}
+	return stats, activity, favorites
+}
@@ -0,0 +1,104 @@
+package movie
+
+import (
+	"database/sql"
+	"log"
+	"movie_db/db"
+	"net/http"
+	"strconv"
+)
+
+// PostReaction sets user's upvote or downvote on a comment. Repeating the same reaction removes it
+func (h *Handler) PostReaction(w http.ResponseWriter, r *http.Request) {
+	const templateName string = "comment-reactions"
+	commentId, err := strconv.Atoi(r.PathValue("commentId"))
+	if err != nil || commentId < 0 {
+		http.Error(w, "Wrong comment id!", http.StatusBadRequest)
+		return
+	}
+	var reaction int
+	switch r.PostFormValue("reaction") {
+	case "up":
+		reaction = 1
+	case "down":
+		reaction = -1
+	default:
+		http.Error(w, "Wrong reaction!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in PostReaction")
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	var deleted bool
+	query := `SELECT deleted FROM comments WHERE commentId = ? FOR UPDATE`
+	if err := tx.QueryRow(query, commentId).Scan(&deleted); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Comment not found!", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting comment from db: %s", err)
+		return
+	}
+	if deleted {
+		http.Error(w, "Can't react to a deleted comment!", http.StatusBadRequest)
+		return
+	}
+	var current int
+	query = `SELECT reaction FROM commentreactions WHERE userId = ? AND commentId = ?`
+	if err := tx.QueryRow(query, session.UserId, commentId).Scan(&current); err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting reaction from db: %s", err)
+		return
+	}
+	if current == reaction {
+		query = `DELETE FROM commentreactions WHERE userId = ? AND commentId = ?`
+		_, err = tx.Exec(query, session.UserId, commentId)
+		reaction = 0
+	} else {
+		query = `INSERT INTO commentreactions (userId, commentId, reaction) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE reaction = ?`
+		_, err = tx.Exec(query, session.UserId, commentId, reaction, reaction)
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error saving reaction: %s", err)
+		return
+	}
+	//Counters are kept on comments so sorting by score doesn't aggregate reactions
+	query = `UPDATE comments SET
+		upvotes = (SELECT COUNT(*) FROM commentreactions WHERE commentId = ? AND reaction = 1),
+		downvotes = (SELECT COUNT(*) FROM commentreactions WHERE commentId = ? AND reaction = -1)
+		WHERE commentId = ?`
+	if _, err := tx.Exec(query, commentId, commentId, commentId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating reaction counters: %s", err)
+		return
+	}
+	comment := CommentsContext{Comment: Comment{CommentId: commentId}, UserReaction: reaction}
+	query = `SELECT upvotes, downvotes FROM comments WHERE commentId = ?`
+	if err := tx.QueryRow(query, commentId).Scan(&comment.Upvotes, &comment.Downvotes); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting reaction counters: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error commiting transaction: %s", err)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, comment); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
@@ -0,0 +1,197 @@
+package movie
+
+import (
+	"database/sql"
+	"log"
+	"movie_db/db"
+	"movie_db/utils"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxUserAgentLen int = 255
+
+type sessionsContext struct {
+	UserId   int
+	Username string
+	Admin    bool   //Sessions of another user opened by an admin
+	Base     string //Address of the page, actions are relative to it
+	Sessions []DeviceSession
+}
+
+// ClientIP is the address the request came from
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// withClient sets the device of the request on a new session
+func withClient(r *http.Request, s Session) Session {
+	s.IP = ClientIP(r)
+	s.UserAgent = r.UserAgent()
+	if len(s.UserAgent) > maxUserAgentLen {
+		s.UserAgent = strings.ToValidUTF8(s.UserAgent[:maxUserAgentLen], "")
+	}
+	return s
+}
+
+func (h *Handler) renderSessions(w http.ResponseWriter, ctx sessionsContext, currentId int) {
+	const wrapperName, contentName string = "index", "sessions-page"
+	sessions, err := SM.List(ctx.UserId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error listing sessions: %s", err)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].Id == currentId
+	}
+	ctx.Sessions = sessions
+	if err := utils.TemplateWrap(tmpl, w, contentName, ctx, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+// logOutSession ends one session of the user. Logging out the session of the request also removes its cookie
+func logOutSession(w http.ResponseWriter, r *http.Request, current Session, userId int, redirect string) {
+	sessionId, err := strconv.Atoi(r.PathValue("sessionId"))
+	if err != nil || sessionId < 0 {
+		http.Error(w, "Wrong session id!", http.StatusBadRequest)
+		return
+	}
+	found, err := SM.DeleteById(userId, sessionId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error deleting session: %s", err)
+		return
+	}
+	if !found {
+		http.Error(w, "Session not found!", http.StatusNotFound)
+		return
+	}
+	if sessionId == current.Id {
+		clearSessionCookie(w)
+		redirect = "/"
+	}
+	w.Header().Add("HX-Redirect", redirect)
+}
+
+func (h *Handler) GetSessionsPage(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in GetSessionsPage")
+		return
+	}
+	ctx := sessionsContext{UserId: session.UserId, Username: session.Username, Base: "/auth/account/sessions"}
+	h.renderSessions(w, ctx, session.Id)
+}
+
+func (h *Handler) LogoutSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in LogoutSession")
+		return
+	}
+	logOutSession(w, r, session, session.UserId, "/auth/account/sessions")
+}
+
+// LogoutEverywhere ends all sessions of the user, including the current one
+func (h *Handler) LogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in LogoutEverywhere")
+		return
+	}
+	if err := SM.KickUser(session.UserId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error kicking user sessions: %s", err)
+		return
+	}
+	clearSessionCookie(w)
+	w.Header().Add("HX-Redirect", "/")
+}
+
+// userIdFromPath reads the user of admin session pages. Unknown users are reported as not found
+func userIdFromPath(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	userId, err := strconv.Atoi(r.PathValue("userId"))
+	if err != nil || userId < 0 {
+		http.Error(w, "Wrong user id!", http.StatusBadRequest)
+		return 0, "", false
+	}
+	var username string
+	query := `SELECT username FROM users WHERE userId = ?`
+	if err := db.DB.QueryRow(query, userId).Scan(&username); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found!", http.StatusNotFound)
+			return 0, "", false
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting user from db: %s", err)
+		return 0, "", false
+	}
+	return userId, username, true
+}
+
+func (h *Handler) GetUserSessions(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in GetUserSessions")
+		return
+	}
+	userId, username, ok := userIdFromPath(w, r)
+	if !ok {
+		return
+	}
+	ctx := sessionsContext{UserId: userId, Username: username, Admin: true, Base: "/admin/user/" + strconv.Itoa(userId) + "/sessions"}
+	h.renderSessions(w, ctx, session.Id)
+}
+
+func (h *Handler) LogoutUserSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in LogoutUserSession")
+		return
+	}
+	userId, _, ok := userIdFromPath(w, r)
+	if !ok {
+		return
+	}
+	logOutSession(w, r, session, userId, "/admin/user/"+strconv.Itoa(userId)+"/sessions")
+}
+
+// LogoutUser ends all sessions of a user without banning
+func (h *Handler) LogoutUser(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in LogoutUser")
+		return
+	}
+	userId, _, ok := userIdFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := SM.KickUser(userId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error kicking user sessions: %s", err)
+		return
+	}
+	if userId == session.UserId {
+		clearSessionCookie(w)
+		w.Header().Add("HX-Redirect", "/")
+		return
+	}
+	w.Header().Add("HX-Redirect", "/admin/user/"+strconv.Itoa(userId)+"/sessions")
+}
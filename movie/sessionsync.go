@@ -0,0 +1,126 @@
+package movie
+
+import (
+	"math"
+	"time"
+)
+
+// PollInterval is how often sessions changed by other instances are read from DB
+var PollInterval = 2 * time.Second
+
+// ChangeRetention is how long recorded session changes are kept. Instance which couldn't poll
+// for longer reads all sessions again
+var ChangeRetention = time.Hour
+
+// changeWindow is how long recorded changes are read again. Ids are taken when a change is inserted,
+// so a change committed later than one with a higher id is found by the next polls of the window
+const changeWindow time.Duration = 10 * time.Second
+
+// changed records a change of sessions of the user for other instances
+func (sm *SessionManager) changed(userId int) error {
+	query := `INSERT INTO sessionchanges(userId) VALUES(?)`
+	_, err := sm.DB.Exec(query, userId)
+	return err
+}
+
+// sync replaces the cache with all sessions from DB
+func (sm *SessionManager) sync() error {
+	defer sm.pollMu.Unlock()
+	sm.pollMu.Lock()
+	return sm.load()
+}
+
+// load must be called with pollMu held. Changes recorded while sessions are read are applied by the next poll
+func (sm *SessionManager) load() error {
+	start := time.Now()
+	//Only changes within the window are read. They are committed before sessions are read, so already seen in them
+	_, _, recent, err := sm.changes(math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	var last int64
+	query := `SELECT COALESCE(MAX(changeId), 0) FROM sessionchanges`
+	if err := sm.DB.QueryRow(query).Scan(&last); err != nil {
+		return err
+	}
+	sessions, err := sm.readSessions(sessionsQuery)
+	if err != nil {
+		return err
+	}
+	sm.Cache.Reassign(sessions)
+	sm.lastChange, sm.recent, sm.lastPoll = last, recent, start
+	return nil
+}
+
+// Poll applies changes made by other instances to the cache. Sessions of users with recorded changes
+// are read again and renewals flushed by other instances extend expiry of cached sessions
+func (sm *SessionManager) Poll() error {
+	defer sm.pollMu.Unlock()
+	sm.pollMu.Lock()
+	if time.Since(sm.lastPoll) > ChangeRetention {
+		return sm.load()
+	}
+	start := time.Now()
+	users, last, recent, err := sm.changes(sm.lastChange)
+	if err != nil {
+		return err
+	}
+	for userId := range users {
+		sessions, err := sm.readSessions(sessionsQuery+` AND s.userId = ?`, userId)
+		if err != nil {
+			return err
+		}
+		sm.Cache.ReplaceUser(userId, sessions)
+	}
+	//Renewals are written up to a flush interval after the request, so the window overlaps the previous poll
+	if err := sm.readActivity(sm.lastPoll.Add(-2 * FlushInterval)); err != nil {
+		return err
+	}
+	sm.lastChange, sm.recent, sm.lastPoll = last, recent, start
+	return nil
+}
+
+// changes returns users with changes after the given id or within changeWindow which weren't applied yet,
+// id of the last change and ids of changes within the window
+func (sm *SessionManager) changes(after int64) (map[int]struct{}, int64, map[int64]struct{}, error) {
+	query := `SELECT changeId, userId FROM sessionchanges WHERE changeId > ? OR createdDT >= NOW() - INTERVAL ? SECOND`
+	rows, err := sm.DB.Query(query, after, int(changeWindow.Seconds()))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer rows.Close()
+	users := make(map[int]struct{})
+	recent := make(map[int64]struct{})
+	last := sm.lastChange
+	for rows.Next() {
+		var changeId int64
+		var userId int
+		if err := rows.Scan(&changeId, &userId); err != nil {
+			return nil, 0, nil, err
+		}
+		recent[changeId] = struct{}{}
+		if _, ok := sm.recent[changeId]; !ok {
+			users[userId] = struct{}{}
+		}
+		last = max(last, changeId)
+	}
+	return users, last, recent, rows.Err()
+}
+
+func (sm *SessionManager) readActivity(since time.Time) error {
+	query := `SELECT tokenHash, lastSeenDT, expirationDT, ip FROM sessions WHERE lastSeenDT > ?`
+	rows, err := sm.DB.Query(query, since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		a := activity{}
+		if err := rows.Scan(&hash, &a.LastSeen, &a.Expires, &a.IP); err != nil {
+			return err
+		}
+		sm.Cache.Seen(hash, a)
+	}
+	return rows.Err()
+}
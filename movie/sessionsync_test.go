@@ -0,0 +1,133 @@
+package movie
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const (
+	changesQuery  string = `SELECT changeId, userId FROM sessionchanges WHERE changeId > \? OR createdDT >= NOW\(\) - INTERVAL \? SECOND`
+	activityQuery string = `SELECT tokenHash, lastSeenDT, expirationDT, ip FROM sessions WHERE lastSeenDT > \?`
+)
+
+// sessionRows returns rows of sessionsQuery with a session for each of the hashes of the user
+func sessionRows(userId int, hashes ...string) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"tokenHash", "expirationDT", "userId", "username", "admin", "twoFactor",
+		"sessionId", "createdDT", "lastSeenDT", "ip", "userAgent", "remember", "mfa"})
+	now := time.Now().Truncate(time.Second)
+	for i, hash := range hashes {
+		rows.AddRow(hash, now.Add(time.Hour), userId, "user", false, false, i+1, now, now, "10.0.0.1", "Firefox", false, false)
+	}
+	return rows
+}
+
+func changeRows(changes ...[2]int) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"changeId", "userId"})
+	for _, c := range changes {
+		rows.AddRow(c[0], c[1])
+	}
+	return rows
+}
+
+func TestInitSync(t *testing.T) {
+	sm, mock := mockSessions(t)
+	sm.Cache.Create(Session{UserId: 3, Expires: time.Now().Add(time.Hour)}, "stale")
+	mock.ExpectQuery(changesQuery).WithArgs(int64(math.MaxInt64), 10).WillReturnRows(changeRows([2]int{7, 1}))
+	mock.ExpectQuery(`SELECT COALESCE\(MAX\(changeId\), 0\) FROM sessionchanges`).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(8))
+	mock.ExpectQuery(`SELECT s.tokenHash, .* WHERE s.expirationDT > NOW\(\)$`).WillReturnRows(sessionRows(1, "a", "b"))
+	sm.InitSync()
+	if len(sm.Cache.Sessions) != 2 {
+		t.Fatalf("InitSync() cached %d sessions, want 2", len(sm.Cache.Sessions))
+	}
+	if s, ok := sm.Cache.Get("a"); !ok || s.UserId != 1 {
+		t.Errorf("InitSync() cached a = %+v, %v, want session of user 1", s, ok)
+	}
+	if _, ok := sm.recent[7]; sm.lastChange != 8 || !ok || sm.lastPoll.IsZero() {
+		t.Errorf("InitSync() lastChange = %d, recent = %v, lastPoll = %v, want 8, [7] and poll time", sm.lastChange, sm.recent, sm.lastPoll)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	sm, mock := mockSessions(t)
+	sm.lastChange, sm.recent, sm.lastPoll = 3, map[int64]struct{}{3: {}}, time.Now()
+	sm.Cache.Create(Session{UserId: 1, Id: 1, LastSeen: time.Now().Add(-time.Hour), Expires: time.Now().Add(time.Hour)}, "a")
+	sm.Cache.Create(Session{UserId: 2, Id: 1, Expires: time.Now().Add(time.Hour)}, "b")
+	mock.ExpectQuery(changesQuery).WithArgs(int64(3), 10).WillReturnRows(changeRows([2]int{3, 1}, [2]int{4, 2}))
+	mock.ExpectQuery(`SELECT s.tokenHash, .* AND s.userId = \?`).WithArgs(2).WillReturnRows(sessionRows(2, "c"))
+	seen := time.Now().Truncate(time.Second)
+	mock.ExpectQuery(activityQuery).WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"tokenHash", "lastSeenDT", "expirationDT", "ip"}).AddRow("a", seen, seen.Add(24*time.Hour), "10.0.0.9"))
+	if err := sm.Poll(); err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+	if _, ok := sm.Cache.Get("b"); ok {
+		t.Error("Poll() kept a session removed by another instance")
+	}
+	if _, ok := sm.Cache.Get("c"); !ok {
+		t.Error("Poll() didn't cache a session created by another instance")
+	}
+	if s, _ := sm.Cache.Get("a"); !s.LastSeen.Equal(seen) || s.IP != "10.0.0.9" {
+		t.Errorf("Poll() cached a = %+v, want renewal from another instance", s)
+	}
+	if sm.lastChange != 4 {
+		t.Errorf("Poll() lastChange = %d, want 4", sm.lastChange)
+	}
+}
+
+func TestPollOutOfOrder(t *testing.T) {
+	sm, mock := mockSessions(t)
+	sm.lastChange, sm.recent, sm.lastPoll = 3, map[int64]struct{}{3: {}}, time.Now()
+	sm.Cache.Create(Session{UserId: 1, Expires: time.Now().Add(time.Hour)}, "a")
+	noActivity := sqlmock.NewRows([]string{"tokenHash", "lastSeenDT", "expirationDT", "ip"})
+	//Change 4 got its id first but is committed after change 5
+	mock.ExpectQuery(changesQuery).WithArgs(int64(3), 10).WillReturnRows(changeRows([2]int{3, 1}, [2]int{5, 2}))
+	mock.ExpectQuery(`SELECT s.tokenHash, .* AND s.userId = \?`).WithArgs(2).WillReturnRows(sessionRows(2, "b"))
+	mock.ExpectQuery(activityQuery).WithArgs(sqlmock.AnyArg()).WillReturnRows(noActivity)
+	mock.ExpectQuery(changesQuery).WithArgs(int64(5), 10).WillReturnRows(changeRows([2]int{3, 1}, [2]int{4, 1}, [2]int{5, 2}))
+	mock.ExpectQuery(`SELECT s.tokenHash, .* AND s.userId = \?`).WithArgs(1).WillReturnRows(sessionRows(1))
+	mock.ExpectQuery(activityQuery).WithArgs(sqlmock.AnyArg()).WillReturnRows(noActivity)
+	for i := range 2 {
+		if err := sm.Poll(); err != nil {
+			t.Fatalf("Poll() %d error = %v", i+1, err)
+		}
+	}
+	if _, ok := sm.Cache.Get("a"); ok {
+		t.Error("Poll() missed a change committed out of order")
+	}
+	if _, ok := sm.Cache.Get("b"); !ok {
+		t.Error("Poll() lost a session of an applied change")
+	}
+	if _, ok := sm.recent[4]; sm.lastChange != 5 || !ok {
+		t.Errorf("Poll() lastChange = %d, recent = %v, want 5 and change 4 applied", sm.lastChange, sm.recent)
+	}
+}
+
+func TestPollAfterRetention(t *testing.T) {
+	sm, mock := mockSessions(t)
+	sm.lastChange, sm.lastPoll = 3, time.Now().Add(-2*ChangeRetention)
+	sm.Cache.Create(Session{UserId: 1, Expires: time.Now().Add(time.Hour)}, "a")
+	mock.ExpectQuery(changesQuery).WithArgs(int64(math.MaxInt64), 10).WillReturnRows(changeRows())
+	mock.ExpectQuery(`SELECT COALESCE\(MAX\(changeId\), 0\) FROM sessionchanges`).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(40))
+	mock.ExpectQuery(`SELECT s.tokenHash, .* WHERE s.expirationDT > NOW\(\)$`).WillReturnRows(sessionRows(2, "b"))
+	if err := sm.Poll(); err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+	if _, ok := sm.Cache.Get("a"); ok || sm.lastChange != 40 {
+		t.Errorf("Poll() kept a = %v, lastChange = %d, want full sync up to 40", ok, sm.lastChange)
+	}
+}
+
+func TestShrinkChanges(t *testing.T) {
+	sm, mock := mockSessions(t)
+	mock.ExpectExec(`DELETE FROM sessions WHERE expirationDT < NOW\(\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM sessionchanges WHERE createdDT < NOW\(\) - INTERVAL \? SECOND`).
+		WithArgs(int(ChangeRetention.Seconds())).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := sm.Shrink(); err != nil {
+		t.Fatalf("Shrink() error = %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package movie
+
+import (
+	"movie_db/db"
+	"movie_db/filter"
+	"time"
+)
+
+// CommentFilter checks new comments for spam and abuse. Empty pipeline disables filtering
+var CommentFilter filter.Pipeline
+
+// checkComment runs CommentFilter over a new or edited comment of the user. Edits aren't new posts,
+// so only filters of the text are run for them, without rate and duplicate checks
+func checkComment(userId int, text string, edit bool) (filter.Result, error) {
+	allow := filter.Result{Verdict: filter.Allow}
+	pipeline := CommentFilter
+	if edit {
+		pipeline = CommentFilter.Content()
+	}
+	if len(pipeline) == 0 {
+		return allow, nil
+	}
+	in := filter.Input{Text: text, Now: time.Now()}
+	//Ages are computed by db so they don't depend on time zones of db and app
+	var accountAge int64
+	query := `SELECT TIMESTAMPDIFF(SECOND, registerDate, NOW()) FROM users WHERE userId = ?`
+	if err := db.DB.QueryRow(query, userId).Scan(&accountAge); err != nil {
+		return allow, err
+	}
+	in.AccountAge = time.Duration(accountAge) * time.Second
+	if lookback := pipeline.Lookback(); lookback > 0 {
+		query = `SELECT comment, TIMESTAMPDIFF(SECOND, postedDT, NOW()) FROM comments
+			WHERE userId = ? AND postedDT >= NOW() - INTERVAL ? SECOND
+			ORDER BY commentId DESC LIMIT 100`
+		rows, err := db.DB.Query(query, userId, int(lookback.Seconds()))
+		if err != nil {
+			return allow, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var post filter.Post
+			var age int64
+			if err := rows.Scan(&post.Text, &age); err != nil {
+				return allow, err
+			}
+			post.PostedAt = in.Now.Add(-time.Duration(age) * time.Second)
+			in.Recent = append(in.Recent, post)
+		}
+		if err := rows.Err(); err != nil {
+			return allow, err
+		}
+	}
+	return pipeline.Check(in), nil
+}
+
+// holdComment hides a comment flagged by the filter and puts it into the moderation queue.
+// Report without a reporter stands for the filter
+func holdComment(exec execer, commentId, authorId int, reason string) error {
+	query := `UPDATE comments SET hidden = 1 WHERE commentId = ?`
+	if _, err := exec.Exec(query, commentId); err != nil {
+		return err
+	}
+	query = `INSERT INTO commentreports (commentId, reporterId, reason) VALUES (?, NULL, ?)`
+	if _, err := exec.Exec(query, commentId, reason); err != nil {
+		return err
+	}
+	return logModeration(exec, commentId, 0, authorId, "hide", "Held by spam filter: "+reason)
+}
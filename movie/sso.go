@@ -0,0 +1,481 @@
+package movie
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"movie_db/db"
+	"movie_db/mail"
+	"movie_db/oidc"
+	"movie_db/utils"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Providers are OpenID Connect identity providers users can log in with, in order of login buttons
+var Providers []*oidc.Provider
+
+const (
+	oidcStateLifetime time.Duration = 10 * time.Minute
+	maxUsernameLen    int           = 32
+)
+
+var (
+	errIdentityTaken = errors.New("identity is linked to another account")
+	usernameChars    = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+)
+
+type identity struct {
+	Provider   string
+	Label      string
+	Linked     bool
+	Email      string
+	CreatedDT  string
+	LastUsedDT string
+}
+
+// oidcState is an authorization request waiting for the provider to redirect back.
+// UserId is set when a logged in user links an identity
+type oidcState struct {
+	Provider string
+	Nonce    string
+	Verifier string
+	UserId   int
+}
+
+func findProvider(name string) *oidc.Provider {
+	for _, p := range Providers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// setStateCookie binds the authorization request to the browser which started it. The cookie must be
+// sent on the redirect from the provider, which is a cross-site navigation. Zero expires removes the cookie
+func setStateCookie(w http.ResponseWriter, state string, expires time.Time) {
+	if expires.IsZero() {
+		state, expires = "", time.Now().Add(-time.Hour)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc_state",
+		Value:    state,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/login/oidc",
+	})
+}
+
+// startAuthRequest saves a new authorization request and sends the browser to the provider
+func startAuthRequest(w http.ResponseWriter, r *http.Request, p *oidc.Provider, userId int) {
+	ar, err := p.NewAuthRequest(r.Context())
+	if err != nil {
+		http.Error(w, "Login provider is unavailable, try again later!", http.StatusBadGateway)
+		log.Printf("Error starting login with %s: %s", p.Name, err)
+		return
+	}
+	query := `DELETE FROM oidcstates WHERE expiresDT < NOW()`
+	if _, err := db.DB.Exec(query); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error deleting expired login states: %s", err)
+		return
+	}
+	expires := time.Now().Add(oidcStateLifetime)
+	query = `INSERT INTO oidcstates (stateHash, provider, nonce, verifier, userId, expiresDT) VALUES (?, ?, ?, ?, ?, ?)`
+	if _, err := db.DB.Exec(query, utils.HashToken(ar.State), p.Name, ar.Nonce, ar.Verifier,
+		sql.NullInt64{Int64: int64(userId), Valid: userId != 0}, expires); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error saving login state: %s", err)
+		return
+	}
+	setStateCookie(w, ar.State, expires)
+	http.Redirect(w, r, ar.URL, http.StatusFound)
+}
+
+// useState removes the authorization request, so the provider response can be used once
+func useState(tx *sql.Tx, state string) (*oidcState, error) {
+	s := &oidcState{}
+	var userId sql.NullInt64
+	query := `SELECT provider, nonce, verifier, userId FROM oidcstates WHERE stateHash = ? AND expiresDT > NOW() FOR UPDATE`
+	if err := tx.QueryRow(query, utils.HashToken(state)).Scan(&s.Provider, &s.Nonce, &s.Verifier, &userId); err != nil {
+		return nil, err
+	}
+	s.UserId = int(userId.Int64)
+	query = `DELETE FROM oidcstates WHERE stateHash = ?`
+	_, err := tx.Exec(query, utils.HashToken(state))
+	return s, err
+}
+
+// newUsername makes a free valid username from claims of the provider
+func newUsername(tx *sql.Tx, claims *oidc.Claims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = usernameChars.ReplaceAllString(base, "")
+	if len(base) < 3 {
+		base = "user"
+	}
+	base = base[:min(len(base), maxUsernameLen-5)]
+	for i := 0; i < 10; i++ {
+		username := base
+		if i > 0 {
+			//3 random bytes are 4 characters allowed in usernames
+			suffix, err := utils.GenerateToken(3)
+			if err != nil {
+				return "", err
+			}
+			username += "_" + suffix
+		}
+		var exists bool
+		query := `SELECT EXISTS(SELECT * FROM users WHERE username = ?)`
+		if err := tx.QueryRow(query, username).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists && utils.UsernameAnalysis(username) {
+			return username, nil
+		}
+	}
+	return "", errors.New("no free username for " + base)
+}
+
+// ssoUser finds the account of the identity. Identity is linked to an account with the same verified
+// email, otherwise a new account is created. Accounts created here have a random password,
+// which can be replaced through password reset
+func ssoUser(tx *sql.Tx, provider string, claims *oidc.Claims) (int, error) {
+	var userId int
+	query := `SELECT userId FROM useridentities WHERE provider = ? AND subject = ?`
+	err := tx.QueryRow(query, provider, claims.Subject).Scan(&userId)
+	if err == nil {
+		query = `UPDATE useridentities SET lastUsedDT = NOW(), email = ? WHERE provider = ? AND subject = ?`
+		_, err = tx.Exec(query, identityEmail(claims), provider, claims.Subject)
+		return userId, err
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+	email := ""
+	if claims.EmailVerified && mail.ValidAddress(claims.Email) {
+		email = claims.Email
+	}
+	if email != "" {
+		query = `SELECT userId FROM users WHERE email = ?`
+		err = tx.QueryRow(query, email).Scan(&userId)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+	}
+	if userId == 0 {
+		if userId, err = createSSOUser(tx, claims, email); err != nil {
+			return 0, err
+		}
+	}
+	return userId, linkIdentity(tx, userId, provider, claims)
+}
+
+func createSSOUser(tx *sql.Tx, claims *oidc.Claims, email string) (int, error) {
+	username, err := newUsername(tx, claims)
+	if err != nil {
+		return 0, err
+	}
+	password, err := utils.GenerateToken(sessionTokenLength)
+	if err != nil {
+		return 0, err
+	}
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+	//Random password keeps the column unique, passwordSet = 0 lets the user choose a real one without knowing it
+	query := `INSERT INTO users (username, password, email, passwordSet) VALUES (?, ?, ?, 0)`
+	result, err := tx.Exec(query, username, hash, sql.NullString{String: email, Valid: email != ""})
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// identityEmail is the address shown with a linked identity
+func identityEmail(claims *oidc.Claims) sql.NullString {
+	return sql.NullString{String: claims.Email, Valid: mail.ValidAddress(claims.Email)}
+}
+
+// linkIdentity fails with errIdentityTaken when the identity or another identity of the provider is already linked
+func linkIdentity(tx *sql.Tx, userId int, provider string, claims *oidc.Claims) error {
+	var exists bool
+	query := `SELECT EXISTS(SELECT * FROM useridentities WHERE provider = ? AND (subject = ? OR userId = ?))`
+	if err := tx.QueryRow(query, provider, claims.Subject, userId).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return errIdentityTaken
+	}
+	query = `INSERT INTO useridentities (provider, subject, userId, email, lastUsedDT) VALUES (?, ?, ?, ?, NOW())`
+	_, err := tx.Exec(query, provider, claims.Subject, userId, identityEmail(claims))
+	return err
+}
+
+// renderSSORedirect sends the browser on with a same-site navigation. Session cookie is SameSite=Strict
+// and browsers don't send it on a redirect chain which started on the provider site
+func renderSSORedirect(w http.ResponseWriter, target string) {
+	const wrapperName, contentName string = "index", "sso-redirect"
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := utils.TemplateWrap(tmpl, w, contentName, target, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+// LoginOIDC sends the browser to the provider to log in
+func (h *Handler) LoginOIDC(w http.ResponseWriter, r *http.Request) {
+	p := findProvider(r.PathValue("provider"))
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	startAuthRequest(w, r, p, 0)
+}
+
+// OIDCCallback completes login or linking when the provider redirects back with an authorization code
+func (h *Handler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	const failed string = "Login failed"
+	p := findProvider(r.PathValue("provider"))
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie("oidc_state")
+	if err != nil || state == "" || cookie.Value != state {
+		renderMessage(w, failed, "Login expired or was started in another browser, try again.")
+		return
+	}
+	setStateCookie(w, "", time.Time{})
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	s, err := useState(tx, state)
+	if err == sql.ErrNoRows || (err == nil && s.Provider != p.Name) {
+		renderMessage(w, failed, "Login expired, try again.")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error using login state: %s", err)
+		return
+	}
+	//State is spent even when the provider reports an error
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error committing login state: %s", err)
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		if e == "access_denied" {
+			renderMessage(w, failed, "Login was cancelled.")
+			return
+		}
+		renderMessage(w, failed, p.Label+" couldn't log you in, try again later.")
+		log.Printf("Error from login provider %s: %s %s", p.Name, e, r.URL.Query().Get("error_description"))
+		return
+	}
+	claims, err := p.Exchange(r.Context(), r.URL.Query().Get("code"), s.Verifier, s.Nonce)
+	if err != nil {
+		renderMessage(w, failed, p.Label+" couldn't log you in, try again later.")
+		log.Printf("Error exchanging code of %s: %s", p.Name, err)
+		return
+	}
+
+	tx, err = db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	if s.UserId != 0 {
+		err := linkIdentity(tx, s.UserId, p.Name, claims)
+		if err == errIdentityTaken {
+			renderMessage(w, "Linking failed", "This "+p.Label+" account is already linked to a Movie DB account, or yours already has a "+p.Label+" account linked.")
+			return
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error linking identity: %s", err)
+			return
+		}
+		renderSSORedirect(w, "/auth/account/sso")
+		return
+	}
+	userId, err := ssoUser(tx, p.Name, claims)
+	if err == errIdentityTaken {
+		//Account with the same email already has another identity of this provider
+		renderMessage(w, failed, "Your Movie DB account is linked to another "+p.Label+" account.")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting user of identity: %s", err)
+		return
+	}
+	session := Session{UserId: userId}
+	banUntil := time.Time{}
+	var twoFactor bool
+	query := `SELECT username, admin, banUntil, totpSecret IS NOT NULL FROM users WHERE userId = ?`
+	if err := tx.QueryRow(query, userId).Scan(&session.Username, &session.Admin, &banUntil, &twoFactor); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting user from db: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error committing identity: %s", err)
+		return
+	}
+	if banUntil.After(time.Now()) {
+		renderMessage(w, failed, "You are banned until "+banUntil.Format(time.DateTime))
+		return
+	}
+	if twoFactor {
+		//Session is created after the second step
+		token, err := createLoginChallenge(userId, false)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error creating login challenge: %s", err)
+			return
+		}
+		setChallengeCookie(w, token, time.Now().Add(loginChallengeLifetime))
+		renderSSORedirect(w, "/login/2fa")
+		return
+	}
+	if err := logIn(w, r, session); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error creating a session: %s", err)
+		return
+	}
+	renderSSORedirect(w, "/")
+}
+
+func (h *Handler) GetSSOPage(w http.ResponseWriter, r *http.Request) {
+	const wrapperName, contentName string = "index", "sso-page"
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in GetSSOPage")
+		return
+	}
+	linked := map[string]identity{}
+	query := `SELECT provider, IFNULL(email, ''), createdDT, lastUsedDT FROM useridentities WHERE userId = ?`
+	rows, err := db.DB.Query(query, session.UserId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting identities: %s", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		i := identity{Linked: true}
+		var created time.Time
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&i.Provider, &i.Email, &created, &lastUsed); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error scanning identity: %s", err)
+			return
+		}
+		i.CreatedDT = created.Format(time.DateTime)
+		if lastUsed.Valid {
+			i.LastUsedDT = lastUsed.Time.Format(time.DateTime)
+		}
+		linked[i.Provider] = i
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error reading identities: %s", err)
+		return
+	}
+	identities := []identity{}
+	for _, p := range Providers {
+		i, ok := linked[p.Name]
+		if !ok {
+			i.Provider = p.Name
+		}
+		i.Label = p.Label
+		identities = append(identities, i)
+	}
+	if err := utils.TemplateWrap(tmpl, w, contentName, identities, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+// LinkOIDC starts login with the provider to link the identity to the current account
+func (h *Handler) LinkOIDC(w http.ResponseWriter, r *http.Request) {
+	p := findProvider(r.PathValue("provider"))
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in LinkOIDC")
+		return
+	}
+	startAuthRequest(w, r, p, session.UserId)
+}
+
+// UnlinkOIDC removes the identity. Password is required, so nobody is left without a way to log in
+func (h *Handler) UnlinkOIDC(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in UnlinkOIDC")
+		return
+	}
+	ok, err := checkPassword(session.UserId, r.PostFormValue("password"))
+	if err == errNoPassword {
+		http.Error(w, noPasswordMessage, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking password: %s", err)
+		return
+	}
+	if !ok {
+		http.Error(w, "Wrong password!", http.StatusUnauthorized)
+		return
+	}
+	query := `DELETE FROM useridentities WHERE userId = ? AND provider = ?`
+	if _, err := db.DB.Exec(query, session.UserId, r.PathValue("provider")); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error unlinking identity: %s", err)
+		return
+	}
+	w.Header().Add("HX-Redirect", "/auth/account/sso")
+}
+
+// ssoProviderLinks are the login buttons of configured providers
+func ssoProviderLinks() []identity {
+	links := make([]identity, 0, len(Providers))
+	for _, p := range Providers {
+		links = append(links, identity{Provider: p.Name, Label: p.Label})
+	}
+	return links
+}
@@ -0,0 +1,410 @@
+package movie
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"movie_db/db"
+	"movie_db/qr"
+	"movie_db/totp"
+	"movie_db/utils"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RequireAdmin2FA denies admin routes to admins without two-factor authentication
+var RequireAdmin2FA bool
+
+const (
+	totpIssuer             string        = "Movie DB"
+	recoveryCodeCount      int           = 10
+	loginChallengeLifetime time.Duration = 5 * time.Minute
+	maxLoginAttempts       int           = 5 //Wrong codes before the password must be entered again
+)
+
+type twoFactorContext struct {
+	Enabled      bool
+	Required     bool
+	Secret       string
+	QR           template.URL
+	RecoveryLeft int
+}
+
+// setChallengeCookie keeps the login challenge between password and code steps. Zero expires removes the cookie
+func setChallengeCookie(w http.ResponseWriter, token string, expires time.Time) {
+	if expires.IsZero() {
+		token, expires = "", time.Now().Add(-time.Hour)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "login_challenge",
+		Value:    token,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		Path:     "/login/2fa",
+	})
+}
+
+// createLoginChallenge replaces login challenges of the user with a new one. Remember me of the password
+// step is kept with the challenge, so the session is created with it after the second step
+func createLoginChallenge(userId int, remember bool) (string, error) {
+	token, err := utils.GenerateToken(sessionTokenLength)
+	if err != nil {
+		return "", err
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	query := `DELETE FROM usertokens WHERE userId = ? AND purpose = ?`
+	if _, err := tx.Exec(query, userId, TokenLogin); err != nil {
+		return "", err
+	}
+	query = `INSERT INTO usertokens (tokenHash, userId, purpose, remember, expiresDT) VALUES (?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(query, utils.HashToken(token), userId, TokenLogin, remember, time.Now().Add(loginChallengeLifetime)); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// replaceRecoveryCodes stores hashes of new codes instead of the old ones and returns the codes
+func replaceRecoveryCodes(tx *sql.Tx, userId int) ([]string, error) {
+	codes, err := totp.RecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	query := `DELETE FROM recoverycodes WHERE userId = ?`
+	if _, err := tx.Exec(query, userId); err != nil {
+		return nil, err
+	}
+	query = `INSERT INTO recoverycodes (userId, codeHash) VALUES (?, ?)`
+	for _, code := range codes {
+		if _, err := tx.Exec(query, userId, utils.HashToken(totp.NormalizeRecoveryCode(code))); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code, which is spent.
+// Accepted TOTP step is saved, so the same code can't be used again
+func checkSecondFactor(tx *sql.Tx, userId int, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	var secret sql.NullString
+	var last int64
+	query := `SELECT totpSecret, totpLastCounter FROM users WHERE userId = ? FOR UPDATE`
+	if err := tx.QueryRow(query, userId).Scan(&secret, &last); err != nil {
+		return false, err
+	}
+	if !secret.Valid {
+		return false, nil
+	}
+	if len(code) == totp.Digits {
+		step, ok := totp.Verify(secret.String, code, time.Now(), last)
+		if !ok {
+			return false, nil
+		}
+		query = `UPDATE users SET totpLastCounter = ? WHERE userId = ?`
+		_, err := tx.Exec(query, step, userId)
+		return err == nil, err
+	}
+	query = `DELETE FROM recoverycodes WHERE userId = ? AND codeHash = ?`
+	result, err := tx.Exec(query, userId, utils.HashToken(totp.NormalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (h *Handler) GetLoginTwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	const wrapperName, contentName string = "index", "login-2fa"
+	if err := utils.TemplateWrap(tmpl, w, contentName, nil, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+// LoginTwoFactor is the second login step. Session is created once the code of the challenged user is accepted
+func (h *Handler) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	const expired string = "Login expired, enter your password again!"
+	cookie, err := r.Cookie("login_challenge")
+	if err != nil || cookie.Value == "" {
+		http.Error(w, expired, http.StatusUnauthorized)
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	session := Session{TwoFactor: true, MFA: true}
+	var attempts int
+	query := `SELECT t.userId, t.attempts, t.remember, u.username, u.admin FROM usertokens t JOIN users u ON t.userId = u.userId
+		WHERE t.tokenHash = ? AND t.purpose = ? AND t.expiresDT > NOW() FOR UPDATE`
+	if err := tx.QueryRow(query, utils.HashToken(cookie.Value), TokenLogin).Scan(&session.UserId, &attempts,
+		&session.Remember, &session.Username, &session.Admin); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, expired, http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting login challenge: %s", err)
+		return
+	}
+	ok, err := checkSecondFactor(tx, session.UserId, r.PostFormValue("code"))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking second factor: %s", err)
+		return
+	}
+	if ok || attempts+1 >= maxLoginAttempts {
+		query = `DELETE FROM usertokens WHERE tokenHash = ?`
+	} else {
+		query = `UPDATE usertokens SET attempts = attempts + 1 WHERE tokenHash = ?`
+	}
+	if _, err := tx.Exec(query, utils.HashToken(cookie.Value)); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating login challenge: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error committing login challenge: %s", err)
+		return
+	}
+	if !ok {
+		if attempts+1 >= maxLoginAttempts {
+			http.Error(w, "Too many wrong codes, enter your password again!", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Wrong code!", http.StatusUnauthorized)
+		return
+	}
+	if err := logIn(w, r, session); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error creating a session: %s", err)
+		return
+	}
+	setChallengeCookie(w, "", time.Time{})
+	w.Header().Add("HX-Redirect", "/")
+}
+
+// GetTwoFactorPage shows the state of two-factor authentication. When it's disabled,
+// a new secret is shown with a QR code for an authenticator app
+func (h *Handler) GetTwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	const wrapperName, contentName string = "index", "two-factor-page"
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in GetTwoFactorPage")
+		return
+	}
+	ctx := twoFactorContext{Required: RequireAdmin2FA && session.Admin}
+	query := `SELECT totpSecret IS NOT NULL, (SELECT COUNT(*) FROM recoverycodes WHERE userId = ?) FROM users WHERE userId = ?`
+	if err := db.DB.QueryRow(query, session.UserId, session.UserId).Scan(&ctx.Enabled, &ctx.RecoveryLeft); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting two-factor state: %s", err)
+		return
+	}
+	if !ctx.Enabled {
+		secret, err := totp.NewSecret()
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error generating TOTP secret: %s", err)
+			return
+		}
+		code, err := qr.Encode(totp.URI(totpIssuer, session.Username, secret))
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error encoding QR code: %s", err)
+			return
+		}
+		ctx.Secret = secret
+		ctx.QR = template.URL("data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(code.SVG(4))))
+	}
+	if err := utils.TemplateWrap(tmpl, w, contentName, ctx, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+// EnableTwoFactor saves the secret once the user proves the authenticator app has it, and returns recovery codes
+func (h *Handler) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	secret := r.PostFormValue("secret")
+	step, valid := totp.Verify(secret, strings.TrimSpace(r.PostFormValue("code")), time.Now(), 0)
+	if !valid {
+		http.Error(w, "Wrong code, check the time on your device!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in EnableTwoFactor")
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	query := `UPDATE users SET totpSecret = ?, totpLastCounter = ? WHERE userId = ? AND totpSecret IS NULL`
+	result, err := tx.Exec(query, secret, step, session.UserId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error enabling two-factor authentication: %s", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Two-factor authentication is already enabled!", http.StatusBadRequest)
+		return
+	}
+	codes, err := replaceRecoveryCodes(tx, session.UserId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error saving recovery codes: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error committing two-factor authentication: %s", err)
+		return
+	}
+	if err := SM.SetTwoFactor(session.UserId, true); err != nil {
+		log.Printf("Error recording session change of user %d: %s", session.UserId, err)
+	}
+	if err := rotateSession(w, r, session, true); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error rotating session token: %s", err)
+		return
+	}
+	h.renderRecoveryCodes(w, codes)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after a code check
+func (h *Handler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in RegenerateRecoveryCodes")
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	valid, err := checkSecondFactor(tx, session.UserId, r.PostFormValue("code"))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking second factor: %s", err)
+		return
+	}
+	if !valid {
+		http.Error(w, "Wrong code!", http.StatusBadRequest)
+		return
+	}
+	codes, err := replaceRecoveryCodes(tx, session.UserId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error saving recovery codes: %s", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error committing recovery codes: %s", err)
+		return
+	}
+	h.renderRecoveryCodes(w, codes)
+}
+
+// DisableTwoFactor needs both password and a code. Admins can't disable it when the policy requires it
+func (h *Handler) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in DisableTwoFactor")
+		return
+	}
+	if RequireAdmin2FA && session.Admin {
+		http.Error(w, "Two-factor authentication is required for admins!", http.StatusForbidden)
+		return
+	}
+	valid, err := checkPassword(session.UserId, r.PostFormValue("password"))
+	if err == errNoPassword {
+		http.Error(w, noPasswordMessage, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking password: %s", err)
+		return
+	}
+	if !valid {
+		http.Error(w, "Password is wrong!", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error starting transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+	valid, err = checkSecondFactor(tx, session.UserId, r.PostFormValue("code"))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking second factor: %s", err)
+		return
+	}
+	if !valid {
+		http.Error(w, "Wrong code!", http.StatusBadRequest)
+		return
+	}
+	queries := []string{
+		`UPDATE users SET totpSecret = NULL, totpLastCounter = 0 WHERE userId = ?`,
+		`DELETE FROM recoverycodes WHERE userId = ?`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, session.UserId); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error disabling two-factor authentication: %s", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error committing two-factor authentication: %s", err)
+		return
+	}
+	if err := SM.SetTwoFactor(session.UserId, false); err != nil {
+		log.Printf("Error recording session change of user %d: %s", session.UserId, err)
+	}
+	if err := rotateSession(w, r, session, false); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error rotating session token: %s", err)
+		return
+	}
+	w.Header().Add("HX-Redirect", "/auth/account/2fa")
+}
+
+func (h *Handler) renderRecoveryCodes(w http.ResponseWriter, codes []string) {
+	const templateName string = "recovery-codes"
+	if err := tmpl.ExecuteTemplate(w, templateName, codes); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
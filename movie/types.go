@@ -2,7 +2,9 @@ package movie
 
 import (
 	"database/sql"
+	"errors"
 	"log"
+	"movie_db/utils"
 	"net/http"
 	"strings"
 	"sync"
@@ -18,6 +20,9 @@ var Sessions *SessionsStore
 
 var SM *SessionManager
 
+// MaxReplyDepth is how deep comment replies nest. Replies to the deepest comments become its siblings
+var MaxReplyDepth = 3
+
 type Movie struct {
 	ID           int    `json:"id"`
 	Title        string `json:"title"`
@@ -51,6 +56,44 @@ type User struct {
 	Admin        bool
 	Banned       bool
 	BanUntil     string
+	//Privacy settings
+	WatchlistPublic bool
+	DiaryPublic     bool
+	//Profile
+	DisplayName   string
+	Bio           string
+	AvatarVersion int //Changes with every avatar upload to bust caches, 0 if user has no avatar
+}
+
+// Name shown on profile, username if display name is not set
+func (u *User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
+}
+
+// Statistics of user activity shown on profile
+type ProfileStats struct {
+	Ratings       int
+	AverageRating float32
+	Comments      int
+	Genres        []GenreCount //Genres of rated movies, most frequent first
+}
+
+type GenreCount struct {
+	Genre string
+	Count int
+}
+
+// Recent rating or comment of a user
+type Activity struct {
+	Kind       string //rating or comment
+	MovieId    int
+	MovieTitle string
+	Rating     float32
+	Text       string
+	DT         string
 }
 
 type Comment struct {
@@ -60,37 +103,221 @@ type Comment struct {
 	PostedDT    string
 	Username    string
 	MovieId     string
+	ParentId    int //0 for top-level comments
+	Depth       int
+	Deleted     bool   //Tombstone left in place of a deleted comment that has replies
+	EditedDT    string //Empty if comment was never edited
+}
+
+// Prior version of an edited comment
+type CommentRevision struct {
+	RevisionId  int
+	CommentText string
+	EditorId    int
+	EditorName  string
+	EditorRole  string //owner or admin
+	RevisedDT   string
 }
 
 type CommentsContext struct {
 	Comment
-	Last  bool
-	Owner bool //Comment owned by user
+	Last         bool
+	Owner        bool //Comment owned by user
+	Replies      int
+	CanReply     bool
+	Upvotes      int
+	Downvotes    int
+	UserReaction int    //1 upvoted, -1 downvoted, 0 no reaction from the viewer
+	Sort         string //Sort order the comment was loaded with
+	Score        int    //Sort key used for pagination
+	Hidden       bool   //Hidden by moderation, text is shown only to the author and admins
+}
+
+// ReportsToHide is the number of unresolved reports after which a comment is hidden automatically
+var ReportsToHide = 5
+
+type Report struct {
+	ReporterId   int //0 if comment was held by the spam filter
+	ReporterName string
+	Reason       string
+	ReportedDT   string
+}
+
+// Comment in moderation queue with all its unresolved reports
+type ReportedComment struct {
+	Comment
+	MovieTitle string
+	ParentText string //Text of the comment being replied to, for context
+	Hidden     bool
+	Reports    []Report
+}
+
+// Kinds of notifications
+const (
+	NotifyMention    string = "mention"
+	NotifyReply      string = "reply"
+	NotifyModeration string = "moderation"
+)
+
+type Notification struct {
+	NotificationId int
+	Kind           string
+	ActorId        int
+	ActorName      string
+	CommentId      int
+	MovieId        int
+	MovieTitle     string
+	Message        string
+	Read           bool
+	CreatedDT      string
+}
+
+// Kinds of movie images
+const (
+	MediaPoster   string = "poster"
+	MediaBackdrop string = "backdrop"
+	MediaStill    string = "still"
+)
+
+var MediaKinds = []string{MediaPoster, MediaBackdrop, MediaStill}
+
+// Image of a movie. Primary image is the one shown for its kind, e.g. the poster of the movie
+type Media struct {
+	MediaId      int
+	MovieId      int
+	Kind         string
+	Position     int
+	Primary      bool
+	Caption      string
+	UploaderId   int //0 if uploader was deleted
+	UploaderName string
+	UploadedDT   string
+}
+
+// Sort orders of top-level comments
+var CommentSorts = []string{"newest", "top", "controversial"}
+
+type WatchlistEntry struct {
+	MovieId  int
+	Title    string
+	Position int
+	Note     string
+	AddedDT  string
+}
+
+type DiaryEntry struct {
+	EntryId     int
+	MovieId     int
+	Title       string
+	WatchedDate string
+	Rewatch     bool
+	Rating      float32
+	Rated       bool //Rating is optional for a diary entry
+}
+
+// Visibility of a user movie list
+const (
+	ListPublic   string = "public"
+	ListUnlisted string = "unlisted"
+	ListPrivate  string = "private"
+)
+
+type MovieList struct {
+	ListId      int
+	Slug        string
+	UserId      int
+	Username    string
+	Name        string
+	Description string
+	Visibility  string
+	ForkedFrom  *MovieList //nil if list is not a fork, the origin was deleted or is hidden from the viewer
+	CreatedDT   string
+	Entries     []ListEntry
+}
+
+type ListEntry struct {
+	MovieId  int
+	Title    string
+	Position int
+	Note     string
 }
 
 type Session struct {
-	UserId   int
-	Username string
-	Admin    bool
-	Expires  time.Time
+	UserId    int
+	Username  string
+	Admin     bool
+	Expires   time.Time
+	TwoFactor bool //Account has two-factor authentication enabled
+	//Device of the session, shown to the user
+	Id        int //Identifies the session on pages instead of the secret token
+	CreatedDT time.Time
+	LastSeen  time.Time
+	IP        string
+	UserAgent string
+	Remember  bool //Logged in with remember me, the session lasts longer
+	MFA       bool //Login was verified with a second factor or a passkey
+}
+
+// SessionPolicy limits session lifetime. Session ends after Idle without requests
+// or Absolute after login, whichever comes first
+type SessionPolicy struct {
+	Idle     time.Duration
+	Absolute time.Duration
+}
+
+// Expires is the end of a session created and last used at given times
+func (p SessionPolicy) Expires(created, lastSeen time.Time) time.Time {
+	idle, absolute := lastSeen.Add(p.Idle), created.Add(p.Absolute)
+	if absolute.Before(idle) {
+		return absolute
+	}
+	return idle
+}
+
+var (
+	DefaultSessions  = SessionPolicy{Idle: 24 * time.Hour, Absolute: 7 * 24 * time.Hour}
+	RememberSessions = SessionPolicy{Idle: 30 * 24 * time.Hour, Absolute: 90 * 24 * time.Hour}
+)
+
+// Policy is the lifetime policy of the session
+func (s Session) Policy() SessionPolicy {
+	if s.Remember {
+		return RememberSessions
+	}
+	return DefaultSessions
 }
 
-// Session store is session cache
+// Session of a user as listed on sessions page
+type DeviceSession struct {
+	Id         int
+	CreatedDT  string
+	LastSeenDT string
+	ExpiresDT  string
+	IP         string
+	UserAgent  string
+	Current    bool //Session of the request
+}
+
+// Session store is session cache. Sessions are keyed by hash of the token, as in DB
 type SessionsStore struct {
 	Sessions map[string]Session
 	mu       sync.RWMutex
 }
 
-func (ss *SessionsStore) Create(s Session, token string) {
+func (ss *SessionsStore) Create(s Session, hash string) {
 	defer ss.mu.Unlock()
 	ss.mu.Lock()
-	ss.Sessions[token] = s
+	ss.Sessions[hash] = s
 }
 
-func (ss *SessionsStore) Get(token string) (Session, bool) {
+// Get returns a session which hasn't expired
+func (ss *SessionsStore) Get(hash string) (Session, bool) {
 	defer ss.mu.RUnlock()
 	ss.mu.RLock()
-	s, ok := ss.Sessions[token]
+	s, ok := ss.Sessions[hash]
+	if ok && time.Now().After(s.Expires) {
+		return Session{}, false
+	}
 	return s, ok
 }
 
@@ -103,7 +330,7 @@ func (ss *SessionsStore) GetSessionInfo(r *http.Request) *Session {
 	if err != nil || cookie.Value == "" {
 		return nil
 	}
-	session, ok := ss.Get(cookie.Value)
+	session, ok := ss.Get(utils.HashToken(cookie.Value))
 	if !ok {
 		return nil
 	}
@@ -124,10 +351,69 @@ func (ss *SessionsStore) KickUser(userId int) {
 	}
 }
 
-func (ss *SessionsStore) Delete(token string) {
+// Rename updates username in all sessions of the user
+func (ss *SessionsStore) Rename(userId int, username string) {
+	defer ss.mu.Unlock()
+	ss.mu.Lock()
+	for k, v := range ss.Sessions {
+		if v.UserId == userId {
+			v.Username = username
+			ss.Sessions[k] = v
+		}
+	}
+}
+
+// SetTwoFactor updates two-factor state in all sessions of the user
+func (ss *SessionsStore) SetTwoFactor(userId int, enabled bool) {
+	defer ss.mu.Unlock()
+	ss.mu.Lock()
+	for k, v := range ss.Sessions {
+		if v.UserId == userId {
+			v.TwoFactor = enabled
+			ss.Sessions[k] = v
+		}
+	}
+}
+
+// Seen updates last activity and renewed expiry of a session. Older activity, e.g. read from DB, is ignored
+func (ss *SessionsStore) Seen(hash string, a activity) {
+	defer ss.mu.Unlock()
+	ss.mu.Lock()
+	if v, ok := ss.Sessions[hash]; ok && a.LastSeen.After(v.LastSeen) {
+		v.LastSeen, v.IP, v.Expires = a.LastSeen, a.IP, a.Expires
+		ss.Sessions[hash] = v
+	}
+}
+
+// Move keeps the session under a new key after token rotation. mfa marks the session as verified with a second factor
+func (ss *SessionsStore) Move(oldHash, newHash string, mfa bool) {
+	defer ss.mu.Unlock()
+	ss.mu.Lock()
+	if v, ok := ss.Sessions[oldHash]; ok {
+		delete(ss.Sessions, oldHash)
+		v.MFA = v.MFA || mfa
+		ss.Sessions[newHash] = v
+	}
+}
+
+func (ss *SessionsStore) Delete(hash string) {
+	defer ss.mu.Unlock()
+	ss.mu.Lock()
+	delete(ss.Sessions, hash)
+}
+
+// ReplaceUser sets sessions of the user to the given ones, as read from DB
+func (ss *SessionsStore) ReplaceUser(userId int, sessions map[string]Session) {
 	defer ss.mu.Unlock()
 	ss.mu.Lock()
-	delete(ss.Sessions, token)
+	for k, v := range ss.Sessions {
+		if v.UserId == userId {
+			delete(ss.Sessions, k)
+		}
+	}
+	for k, v := range sessions {
+		ss.Sessions[k] = v
+	}
 }
 
 func (ss *SessionsStore) Wipe() {
@@ -162,28 +448,202 @@ func NewSessionsStore() *SessionsStore {
 	}
 }
 
-// Session manager manages sessions in remote DB and cache, where remote db data has priority
+// Session manager manages sessions in remote DB and cache, where remote db data has priority.
+// Only SHA-256 hashes of tokens are stored, so tokens can't be read from DB or its backups.
+// Every change of sessions of a user is recorded in DB, so other instances sharing the DB can Poll for it
 type SessionManager struct {
 	DB    *sql.DB
 	Cache *SessionsStore
+
+	mu      sync.Mutex
+	pending map[string]activity //Renewals not written to DB yet, by token hash
+
+	pollMu     sync.Mutex
+	lastChange int64              //Last change applied to the cache
+	recent     map[int64]struct{} //Applied changes within changeWindow, read again by every poll
+	lastPoll   time.Time          //Last successful poll or full sync
+}
+
+// activity of a session renewed by a request
+type activity struct {
+	LastSeen time.Time
+	Expires  time.Time
+	IP       string
 }
 
+var errNoSession = errors.New("session not found")
+
+// FlushInterval is how often renewed sessions are written to DB. Requests in between only update the cache
+var FlushInterval = 30 * time.Second
+
+// Create saves a new session. Expiry is set by the policy of the session
 func (sm *SessionManager) Create(s Session, token string) error {
-	query := `INSERT INTO sessions(token, expirationDT, userId) VALUES(?, ?, ?)`
-	if _, err := sm.DB.Exec(query, token, s.Expires, s.UserId); err != nil {
+	s.CreatedDT = time.Now().Truncate(time.Second)
+	s.LastSeen = s.CreatedDT
+	s.Expires = s.Policy().Expires(s.CreatedDT, s.LastSeen)
+	hash := utils.HashToken(token)
+	query := `INSERT INTO sessions(tokenHash, expirationDT, userId, createdDT, lastSeenDT, ip, userAgent, remember, mfa)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := sm.DB.Exec(query, hash, s.Expires, s.UserId, s.CreatedDT, s.LastSeen, s.IP, s.UserAgent, s.Remember, s.MFA)
+	if err != nil {
 		return err
 	}
-	sm.Cache.Create(s, token)
-	return nil
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	s.Id = int(id)
+	sm.Cache.Create(s, hash)
+	return sm.changed(s.UserId)
+}
+
+// Seen renews the session after a request. Cache is updated at once, DB on the next Flush
+func (sm *SessionManager) Seen(token string, s Session, ip string) {
+	now := time.Now()
+	if now.Sub(s.LastSeen) < time.Second && ip == s.IP {
+		return
+	}
+	hash := utils.HashToken(token)
+	a := activity{LastSeen: now, Expires: s.Policy().Expires(s.CreatedDT, now), IP: ip}
+	sm.Cache.Seen(hash, a)
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.pending == nil {
+		sm.pending = make(map[string]activity)
+	}
+	sm.pending[hash] = a
+}
+
+// Flush writes renewals to DB. Each session is written once however many requests it made since the last flush
+func (sm *SessionManager) Flush() error {
+	sm.mu.Lock()
+	pending := sm.pending
+	sm.pending = nil
+	sm.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := sm.writeActivity(pending)
+	if err != nil {
+		//Kept for the next flush unless renewed again meanwhile
+		sm.mu.Lock()
+		if sm.pending == nil {
+			sm.pending = make(map[string]activity)
+		}
+		for hash, a := range pending {
+			if _, ok := sm.pending[hash]; !ok {
+				sm.pending[hash] = a
+			}
+		}
+		sm.mu.Unlock()
+	}
+	return err
+}
+
+func (sm *SessionManager) writeActivity(pending map[string]activity) error {
+	tx, err := sm.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `UPDATE sessions SET lastSeenDT = ?, expirationDT = ?, ip = ? WHERE tokenHash = ?`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for hash, a := range pending {
+		if _, err := stmt.Exec(a.LastSeen, a.Expires, a.IP, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 func (sm *SessionManager) Delete(token string) error {
-	query := `DELETE FROM sessions WHERE token = ?`
-	if _, err := sm.DB.Exec(query, token); err != nil {
+	hash := utils.HashToken(token)
+	var userId int
+	query := `SELECT userId FROM sessions WHERE tokenHash = ?`
+	if err := sm.DB.QueryRow(query, hash).Scan(&userId); err != nil {
+		if err == sql.ErrNoRows {
+			sm.Cache.Delete(hash)
+			return nil
+		}
 		return err
 	}
-	sm.Cache.Delete(token)
-	return nil
+	return sm.deleteHash(userId, hash)
+}
+
+func (sm *SessionManager) deleteHash(userId int, hash string) error {
+	query := `DELETE FROM sessions WHERE tokenHash = ?`
+	if _, err := sm.DB.Exec(query, hash); err != nil {
+		return err
+	}
+	sm.Cache.Delete(hash)
+	return sm.changed(userId)
+}
+
+// Rotate replaces the token of a session and returns the new one. Session keeps its id, device and expiry.
+// mfa is set when the user has just verified a second factor in the session
+func (sm *SessionManager) Rotate(userId int, token string, mfa bool) (string, error) {
+	newToken, err := utils.GenerateToken(sessionTokenLength)
+	if err != nil {
+		return "", err
+	}
+	oldHash, newHash := utils.HashToken(token), utils.HashToken(newToken)
+	query := `UPDATE sessions SET tokenHash = ?, mfa = mfa OR ? WHERE tokenHash = ?`
+	result, err := sm.DB.Exec(query, newHash, mfa, oldHash)
+	if err != nil {
+		return "", err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return "", errors.Join(err, errNoSession)
+	}
+	sm.Cache.Move(oldHash, newHash, mfa)
+	sm.mu.Lock()
+	if a, ok := sm.pending[oldHash]; ok {
+		delete(sm.pending, oldHash)
+		sm.pending[newHash] = a
+	}
+	sm.mu.Unlock()
+	return newToken, sm.changed(userId)
+}
+
+// DeleteById logs out a session of the user. Reports false when the user has no such session
+func (sm *SessionManager) DeleteById(userId, sessionId int) (bool, error) {
+	var hash string
+	query := `SELECT tokenHash FROM sessions WHERE sessionId = ? AND userId = ?`
+	if err := sm.DB.QueryRow(query, sessionId, userId).Scan(&hash); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, sm.deleteHash(userId, hash)
+}
+
+// List returns active sessions of the user, most recently used first
+func (sm *SessionManager) List(userId int) ([]DeviceSession, error) {
+	query := `SELECT sessionId, createdDT, lastSeenDT, expirationDT, ip, userAgent FROM sessions
+		WHERE userId = ? AND expirationDT > NOW() ORDER BY lastSeenDT DESC`
+	rows, err := sm.DB.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []DeviceSession{}
+	for rows.Next() {
+		s := DeviceSession{}
+		var created, lastSeen, expires time.Time
+		if err := rows.Scan(&s.Id, &created, &lastSeen, &expires, &s.IP, &s.UserAgent); err != nil {
+			return nil, err
+		}
+		s.CreatedDT = created.Format(time.DateTime)
+		s.LastSeenDT = lastSeen.Format(time.DateTime)
+		s.ExpiresDT = expires.Format(time.DateTime)
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
 }
 
 func (sm *SessionManager) KickUser(userId int) error {
@@ -192,45 +652,73 @@ func (sm *SessionManager) KickUser(userId int) error {
 		return err
 	}
 	sm.Cache.KickUser(userId)
-	return nil
+	return sm.changed(userId)
+}
+
+// Rename updates cached sessions after username change. Usernames are not stored in the sessions table
+func (sm *SessionManager) Rename(userId int, username string) error {
+	sm.Cache.Rename(userId, username)
+	return sm.changed(userId)
+}
+
+// SetTwoFactor updates cached sessions after two-factor authentication is enabled or disabled
+func (sm *SessionManager) SetTwoFactor(userId int, enabled bool) error {
+	sm.Cache.SetTwoFactor(userId, enabled)
+	return sm.changed(userId)
+}
+
+// sessionsQuery selects cached fields of sessions, conditions are appended by callers
+const sessionsQuery string = `SELECT s.tokenHash, s.expirationDT, s.userId, u.username, u.admin, u.totpSecret IS NOT NULL,
+	s.sessionId, s.createdDT, s.lastSeenDT, s.ip, s.userAgent, s.remember, s.mfa
+	FROM sessions s JOIN users u ON s.userId = u.userId WHERE s.expirationDT > NOW()`
+
+func (sm *SessionManager) readSessions(query string, args ...any) (map[string]Session, error) {
+	rows, err := sm.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := make(map[string]Session)
+	for rows.Next() {
+		session := Session{}
+		var hash string
+		err := rows.Scan(&hash, &session.Expires, &session.UserId, &session.Username, &session.Admin, &session.TwoFactor,
+			&session.Id, &session.CreatedDT, &session.LastSeen, &session.IP, &session.UserAgent, &session.Remember, &session.MFA)
+		if err != nil {
+			return nil, err
+		}
+		sessions[hash] = session
+	}
+	return sessions, rows.Err()
 }
 
 // Sync sessions on startup. Sync will block until completed to prevent drift
 func (sm *SessionManager) InitSync() {
 	const retryTime time.Duration = 10
-	query := `SELECT s.token, s.expirationDT, s.userId, u.username, u.admin FROM sessions s JOIN users u ON s.userId = u.userId`
-MainLoop:
 	for {
-		rows, err := sm.DB.Query(query)
-		if err != nil {
-			log.Printf("Error retrieving sessions from a DB: %s", err)
-			time.Sleep(retryTime * time.Second)
-			continue
-		}
-		newMap := make(map[string]Session)
-		defer rows.Close()
-		for rows.Next() {
-			session := Session{}
-			var token string
-			err := rows.Scan(&token, &session.Expires, &session.UserId, &session.Username, &session.Admin)
-			if err != nil {
-				log.Printf("Error scanning a row from DB result (sessions): %s", err)
-				time.Sleep(retryTime * time.Second)
-				continue MainLoop
-			}
-			newMap[token] = session
+		err := sm.sync()
+		if err == nil {
+			break
 		}
-		sm.Cache.Reassign(newMap)
-		break
+		log.Printf("Error retrieving sessions from a DB: %s", err)
+		time.Sleep(retryTime * time.Second)
 	}
 }
 
-// Shrink checks and removes expired sessions
+// Shrink checks and removes expired sessions. Pending renewals are written first, so renewed sessions stay
 func (sm *SessionManager) Shrink() error {
+	if err := sm.Flush(); err != nil {
+		return err
+	}
 	query := `DELETE FROM sessions WHERE expirationDT < NOW()`
 	if _, err := sm.DB.Exec(query); err != nil {
 		return err
 	}
 	sm.Cache.Shrink()
+	//Cutoff is computed by DB, as createdDT is set by its clock
+	query = `DELETE FROM sessionchanges WHERE createdDT < NOW() - INTERVAL ? SECOND`
+	if _, err := sm.DB.Exec(query, int(ChangeRetention.Seconds())); err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,275 @@
+package movie
+
+import (
+	"database/sql"
+	"errors"
+	"movie_db/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// mockSessions returns a session manager with an empty cache and a mocked DB
+func mockSessions(t *testing.T) (*SessionManager, sqlmock.Sqlmock) {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet DB expectations: %v", err)
+		}
+	})
+	return &SessionManager{DB: conn, Cache: NewSessionsStore()}, mock
+}
+
+func TestSessionManagerSeen(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		lastSeen time.Time
+		ip       string
+		want     bool
+	}{
+		{name: "Renewed", lastSeen: now.Add(-time.Minute), ip: "10.0.0.1", want: true},
+		{name: "Same second is skipped", lastSeen: now, ip: "10.0.0.1"},
+		{name: "New IP in the same second", lastSeen: now, ip: "10.0.0.2", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, _ := mockSessions(t)
+			hash := utils.HashToken("token")
+			s := Session{UserId: 1, CreatedDT: now.Add(-time.Hour), LastSeen: tt.lastSeen, IP: "10.0.0.1", Expires: now.Add(time.Hour)}
+			sm.Cache.Create(s, hash)
+			sm.Seen("token", s, tt.ip)
+			_, pending := sm.pending[hash]
+			if pending != tt.want {
+				t.Fatalf("Seen() pending = %v, want %v", pending, tt.want)
+			}
+			cached, _ := sm.Cache.Get(hash)
+			if renewed := cached.LastSeen.After(tt.lastSeen); renewed != tt.want {
+				t.Errorf("Seen() renewed cache = %v, want %v", renewed, tt.want)
+			}
+			if tt.want && (cached.IP != tt.ip || !cached.Expires.Equal(DefaultSessions.Expires(s.CreatedDT, cached.LastSeen))) {
+				t.Errorf("Seen() cached = %+v, want ip %s and renewed expiry", cached, tt.ip)
+			}
+		})
+	}
+}
+
+func TestSessionManagerFlush(t *testing.T) {
+	sm, mock := mockSessions(t)
+	if err := sm.Flush(); err != nil {
+		t.Fatalf("Flush() without renewals error = %v", err)
+	}
+	a := activity{LastSeen: time.Now(), Expires: time.Now().Add(time.Hour), IP: "10.0.0.1"}
+	sm.pending = map[string]activity{"hash": a}
+	mock.ExpectBegin()
+	mock.ExpectPrepare(`UPDATE sessions SET lastSeenDT = \?, expirationDT = \?, ip = \? WHERE tokenHash = \?`).
+		ExpectExec().WithArgs(a.LastSeen, a.Expires, a.IP, "hash").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := sm.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if len(sm.pending) != 0 {
+		t.Errorf("Flush() left %d renewals pending", len(sm.pending))
+	}
+}
+
+func TestSessionManagerDeleteById(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		want    bool
+		wantErr bool
+	}{
+		{name: "Own session", want: true},
+		{name: "Other user's or missing", err: sql.ErrNoRows},
+		{name: "DB error", err: errors.New("connection lost"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, mock := mockSessions(t)
+			sm.Cache.Create(Session{UserId: 1, Id: 4, Expires: time.Now().Add(time.Hour)}, "hash")
+			query := mock.ExpectQuery(`SELECT tokenHash FROM sessions WHERE sessionId = \? AND userId = \?`).WithArgs(4, 1)
+			if tt.err != nil {
+				query.WillReturnError(tt.err)
+			} else {
+				query.WillReturnRows(sqlmock.NewRows([]string{"tokenHash"}).AddRow("hash"))
+				mock.ExpectExec(`DELETE FROM sessions WHERE tokenHash = \?`).WithArgs("hash").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO sessionchanges\(userId\) VALUES\(\?\)`).WithArgs(1).WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			got, err := sm.DeleteById(1, 4)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DeleteById() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("DeleteById() = %v, want %v", got, tt.want)
+			}
+			if _, cached := sm.Cache.Get("hash"); cached == tt.want {
+				t.Errorf("DeleteById() cached = %v, want %v", cached, !tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionManagerList(t *testing.T) {
+	sm, mock := mockSessions(t)
+	created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+	lastSeen, expires := created.Add(time.Hour), created.Add(25*time.Hour)
+	rows := sqlmock.NewRows([]string{"sessionId", "createdDT", "lastSeenDT", "expirationDT", "ip", "userAgent"}).
+		AddRow(7, created, lastSeen, expires, "10.0.0.1", "Firefox").
+		AddRow(3, created, created, expires, "10.0.0.2", "Safari")
+	mock.ExpectQuery(`SELECT sessionId, .* FROM sessions\s+WHERE userId = \? AND expirationDT > NOW\(\) ORDER BY lastSeenDT DESC`).
+		WithArgs(1).WillReturnRows(rows)
+	got, err := sm.List(1)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	want := []DeviceSession{
+		{Id: 7, CreatedDT: "2024-05-01 10:00:00", LastSeenDT: "2024-05-01 11:00:00", ExpiresDT: "2024-05-02 11:00:00", IP: "10.0.0.1", UserAgent: "Firefox"},
+		{Id: 3, CreatedDT: "2024-05-01 10:00:00", LastSeenDT: "2024-05-01 10:00:00", ExpiresDT: "2024-05-02 11:00:00", IP: "10.0.0.2", UserAgent: "Safari"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("List() returned %d sessions, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("List()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSessionPolicyExpires(t *testing.T) {
+	created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		session  Session
+		lastSeen time.Time
+		want     time.Time
+	}{
+		{name: "Idle limit", lastSeen: created.Add(time.Hour), want: created.Add(25 * time.Hour)},
+		{name: "Absolute limit", lastSeen: created.Add(6*24*time.Hour + 12*time.Hour), want: created.Add(7 * 24 * time.Hour)},
+		{name: "Remember me idle limit", session: Session{Remember: true}, lastSeen: created.Add(time.Hour),
+			want: created.Add(30*24*time.Hour + time.Hour)},
+		{name: "Remember me absolute limit", session: Session{Remember: true}, lastSeen: created.Add(80 * 24 * time.Hour),
+			want: created.Add(90 * 24 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.session.Policy().Expires(created, tt.lastSeen); !got.Equal(tt.want) {
+				t.Errorf("Expires() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionManagerFlushCoalesces(t *testing.T) {
+	sm, mock := mockSessions(t)
+	now := time.Now()
+	s := Session{UserId: 1, CreatedDT: now.Add(-time.Hour), LastSeen: now.Add(-time.Hour), IP: "10.0.0.1", Expires: now.Add(time.Hour)}
+	hash := utils.HashToken("token")
+	sm.Cache.Create(s, hash)
+	sm.Seen("token", s, "10.0.0.1")
+	sm.Seen("token", s, "10.0.0.2")
+	last := sm.pending[hash]
+	mock.ExpectBegin()
+	mock.ExpectPrepare(`UPDATE sessions SET lastSeenDT = \?, expirationDT = \?, ip = \? WHERE tokenHash = \?`).
+		ExpectExec().WithArgs(last.LastSeen, last.Expires, "10.0.0.2", hash).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := sm.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+}
+
+func TestSessionManagerFlushRequeues(t *testing.T) {
+	sm, mock := mockSessions(t)
+	failed := activity{LastSeen: time.Now().Add(-time.Minute), IP: "10.0.0.1"}
+	sm.pending = map[string]activity{"a": failed, "b": failed}
+	mock.ExpectBegin().WillReturnError(errors.New("connection lost"))
+	if err := sm.Flush(); err == nil {
+		t.Fatal("Flush() error = nil, want an error")
+	}
+	if len(sm.pending) != 2 || sm.pending["a"] != failed || sm.pending["b"] != failed {
+		t.Errorf("Flush() pending = %v, want failed renewals kept", sm.pending)
+	}
+}
+
+func TestSessionManagerCreateStoresHash(t *testing.T) {
+	sm, mock := mockSessions(t)
+	hash := utils.HashToken("token")
+	if hash == "token" || len(hash) != 64 {
+		t.Fatalf("HashToken() = %q, want a SHA-256 hex digest", hash)
+	}
+	mock.ExpectExec(`INSERT INTO sessions\(tokenHash, .*\)`).
+		WithArgs(hash, sqlmock.AnyArg(), 1, sqlmock.AnyArg(), sqlmock.AnyArg(), "10.0.0.1", "Firefox", false, false).
+		WillReturnResult(sqlmock.NewResult(9, 1))
+	mock.ExpectExec(`INSERT INTO sessionchanges\(userId\) VALUES\(\?\)`).WithArgs(1).WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := sm.Create(Session{UserId: 1, IP: "10.0.0.1", UserAgent: "Firefox"}, "token"); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, ok := sm.Cache.Get("token"); ok {
+		t.Error("Create() cached the session under the raw token")
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "session_token", Value: "token"})
+	if s := sm.Cache.GetSessionInfo(r); s == nil || s.Id != 9 {
+		t.Errorf("GetSessionInfo() = %+v, want session 9", s)
+	}
+}
+
+func TestSessionManagerRotate(t *testing.T) {
+	tests := []struct {
+		name     string
+		affected int64
+		mfa      bool
+		wantErr  error
+	}{
+		{name: "Rotated", affected: 1},
+		{name: "Rotated after second factor", affected: 1, mfa: true},
+		{name: "Missing session", wantErr: errNoSession},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, mock := mockSessions(t)
+			oldHash := utils.HashToken("token")
+			sm.Cache.Create(Session{UserId: 1, Id: 4, Expires: time.Now().Add(time.Hour)}, oldHash)
+			a := activity{LastSeen: time.Now(), IP: "10.0.0.1"}
+			sm.pending = map[string]activity{oldHash: a}
+			mock.ExpectExec(`UPDATE sessions SET tokenHash = \?, mfa = mfa OR \? WHERE tokenHash = \?`).
+				WithArgs(sqlmock.AnyArg(), tt.mfa, oldHash).WillReturnResult(sqlmock.NewResult(0, tt.affected))
+			if tt.wantErr == nil {
+				mock.ExpectExec(`INSERT INTO sessionchanges\(userId\) VALUES\(\?\)`).WithArgs(1).WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			token, err := sm.Rotate(1, "token", tt.mfa)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Rotate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if _, ok := sm.Cache.Get(oldHash); !ok {
+					t.Error("Rotate() dropped the cached session of a failed rotation")
+				}
+				return
+			}
+			if token == "" || token == "token" {
+				t.Fatalf("Rotate() = %q, want a new token", token)
+			}
+			newHash := utils.HashToken(token)
+			if _, ok := sm.Cache.Get(oldHash); ok {
+				t.Error("Rotate() kept the old token valid")
+			}
+			s, ok := sm.Cache.Get(newHash)
+			if !ok || s.Id != 4 || s.MFA != tt.mfa {
+				t.Errorf("Rotate() cached = %+v, %v, want session 4 with MFA %v", s, ok, tt.mfa)
+			}
+			if sm.pending[newHash] != a {
+				t.Errorf("Rotate() didn't move the pending renewal to the new token")
+			}
+		})
+	}
+}
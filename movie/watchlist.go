@@ -0,0 +1,418 @@
+package movie
+
+import (
+	"database/sql"
+	"log"
+	"movie_db/db"
+	"movie_db/utils"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const maxWatchlistNoteLen int = 500
+
+// Context for the watchlist-button template
+type watchlistButton struct {
+	MovieId     int
+	InWatchlist bool
+}
+
+// canView reports whether the list of user with ownerId can be seen by the session holder
+func canView(session *Session, ownerId int, public bool) bool {
+	if public {
+		return true
+	}
+	return session != nil && (session.UserId == ownerId || session.Admin)
+}
+
+// loadWatchlist returns user's watchlist ordered by position
+func loadWatchlist(userId int) ([]WatchlistEntry, error) {
+	query := `SELECT w.movieId, m.title, w.position, w.note, w.addedDT FROM watchlist w
+		JOIN movies m ON w.movieId = m.movieId WHERE w.userId = ? ORDER BY w.position ASC`
+	rows, err := db.DB.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []WatchlistEntry{}
+	for rows.Next() {
+		entry := WatchlistEntry{}
+		var addedDT time.Time
+		if err := rows.Scan(&entry.MovieId, &entry.Title, &entry.Position, &entry.Note, &addedDT); err != nil {
+			return nil, err
+		}
+		entry.AddedDT = addedDT.Format(time.DateTime)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// loadDiary returns user's diary entries, latest first
+func loadDiary(userId int) ([]DiaryEntry, error) {
+	query := `SELECT d.entryId, d.movieId, m.title, d.watchedDate, d.rewatch, d.rating FROM watchdiary d
+		JOIN movies m ON d.movieId = m.movieId WHERE d.userId = ? ORDER BY d.watchedDate DESC, d.entryId DESC`
+	rows, err := db.DB.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []DiaryEntry{}
+	for rows.Next() {
+		entry := DiaryEntry{}
+		var watchedDate time.Time
+		var rating sql.NullFloat64
+		if err := rows.Scan(&entry.EntryId, &entry.MovieId, &entry.Title, &watchedDate, &entry.Rewatch, &rating); err != nil {
+			return nil, err
+		}
+		entry.WatchedDate = watchedDate.Format(time.DateOnly)
+		entry.Rating, entry.Rated = float32(rating.Float64), rating.Valid
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// inWatchlist reports whether the movie is in user's watchlist
+func inWatchlist(userId, movieId int) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS(SELECT * FROM watchlist WHERE userId = ? AND movieId = ?)`
+	err := db.DB.QueryRow(query, userId, movieId).Scan(&exists)
+	return exists, err
+}
+
+func (h *Handler) PostWatchlist(w http.ResponseWriter, r *http.Request) {
+	const templateName string = "watchlist-button"
+	movieId, err := strconv.Atoi(r.PostFormValue("movieId"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	note := r.PostFormValue("note")
+	if utf8.RuneCountInString(note) > maxWatchlistNoteLen {
+		http.Error(w, "Note is too long!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in PostWatchlist")
+		return
+	}
+	query := `SELECT EXISTS(SELECT * FROM movies WHERE movieId = ?)`
+	var exists bool
+	if err := db.DB.QueryRow(query, movieId).Scan(&exists); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error checking movie existance in db: %s", err)
+		return
+	}
+	if !exists {
+		http.Error(w, "Movie doesn't exist!", http.StatusBadRequest)
+		return
+	}
+	query = `INSERT IGNORE INTO watchlist (userId, movieId, position, note)
+		SELECT ?, ?, IFNULL(MAX(position), 0) + 1, ? FROM watchlist WHERE userId = ?`
+	if _, err := db.DB.Exec(query, session.UserId, movieId, note, session.UserId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error adding movie to watchlist: %s", err)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, watchlistButton{movieId, true}); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
+
+func (h *Handler) DeleteWatchlist(w http.ResponseWriter, r *http.Request) {
+	const templateName string = "watchlist-button"
+	movieId, err := strconv.Atoi(r.PathValue("movieId"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in DeleteWatchlist")
+		return
+	}
+	query := `DELETE FROM watchlist WHERE userId = ? AND movieId = ?`
+	if _, err := db.DB.Exec(query, session.UserId, movieId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error removing movie from watchlist: %s", err)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, watchlistButton{movieId, false}); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
+
+// MoveWatchlistEntry swaps the entry with its upper or lower neighbour
+func (h *Handler) MoveWatchlistEntry(w http.ResponseWriter, r *http.Request) {
+	const templateName string = "watchlist-entries"
+	movieId, err := strconv.Atoi(r.PathValue("movieId"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	direction := r.PostFormValue("direction")
+	if direction != "up" && direction != "down" {
+		http.Error(w, "Wrong direction!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in MoveWatchlistEntry")
+		return
+	}
+	if err := moveEntry("watchlist", "userId", session.UserId, movieId, direction == "up"); err != nil {
+		if err == errEntryNotFound {
+			http.Error(w, "Movie is not in your watchlist!", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error moving watchlist entry: %s", err)
+		return
+	}
+	h.renderWatchlistEntries(w, session.UserId, templateName)
+}
+
+func (h *Handler) UpdateWatchlistNote(w http.ResponseWriter, r *http.Request) {
+	const templateName string = "watchlist-entries"
+	movieId, err := strconv.Atoi(r.PathValue("movieId"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	note := r.PostFormValue("note")
+	if utf8.RuneCountInString(note) > maxWatchlistNoteLen {
+		http.Error(w, "Note is too long!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in UpdateWatchlistNote")
+		return
+	}
+	query := `UPDATE watchlist SET note = ? WHERE userId = ? AND movieId = ?`
+	if _, err := db.DB.Exec(query, note, session.UserId, movieId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating watchlist note: %s", err)
+		return
+	}
+	h.renderWatchlistEntries(w, session.UserId, templateName)
+}
+
+func (h *Handler) renderWatchlistEntries(w http.ResponseWriter, userId int, templateName string) {
+	entries, err := loadWatchlist(userId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error loading watchlist: %s", err)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, struct {
+		Entries []WatchlistEntry
+		Owner   bool
+	}{entries, true}); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
+
+func (h *Handler) GetWatchlistPage(w http.ResponseWriter, r *http.Request) {
+	const wrapperName, contentName string = "index", "watchlist-page"
+	userId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || userId < 0 {
+		http.Error(w, "Wrong user id!", http.StatusBadRequest)
+		return
+	}
+	user := &User{Id: userId}
+	query := `SELECT username, watchlistPublic FROM users WHERE userId = ?`
+	if err := db.DB.QueryRow(query, userId).Scan(&user.Username, &user.WatchlistPublic); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found!", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error getting user from db: %s", err)
+		return
+	}
+	session := Sessions.GetSessionInfo(r)
+	if !canView(session, userId, user.WatchlistPublic) {
+		http.Error(w, "This watchlist is private!", http.StatusForbidden)
+		return
+	}
+	entries, err := loadWatchlist(userId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error loading watchlist: %s", err)
+		return
+	}
+	context := struct {
+		User    *User
+		Entries []WatchlistEntry
+		Owner   bool
+	}{User: user, Entries: entries, Owner: session != nil && session.UserId == userId}
+	if err := utils.TemplateWrap(tmpl, w, contentName, context, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+func (h *Handler) PostDiaryEntry(w http.ResponseWriter, r *http.Request) {
+	const templateName string = "diary-logged"
+	movieId, err := strconv.Atoi(r.PostFormValue("movieId"))
+	if err != nil || movieId < 0 {
+		http.Error(w, "Wrong movie id!", http.StatusBadRequest)
+		return
+	}
+	watchedDate := time.Now()
+	if v := r.PostFormValue("watchedDate"); v != "" {
+		watchedDate, err = time.ParseInLocation(time.DateOnly, v, time.Local)
+		if err != nil || watchedDate.After(time.Now()) {
+			http.Error(w, "Wrong watch date!", http.StatusBadRequest)
+			return
+		}
+	}
+	var rating sql.NullFloat64
+	if v := r.PostFormValue("rating"); v != "" {
+		rating.Float64, err = strconv.ParseFloat(v, 32)
+		if err != nil || rating.Float64 < 0.0 || rating.Float64 > 5.0 {
+			http.Error(w, "Wrong rating!", http.StatusBadRequest)
+			return
+		}
+		rating.Valid = true
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in PostDiaryEntry")
+		return
+	}
+	query := `SELECT EXISTS(SELECT * FROM movies WHERE movieId = ?)`
+	var exists bool
+	if err := db.DB.QueryRow(query, movieId).Scan(&exists); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error checking movie existance in db: %s", err)
+		return
+	}
+	if !exists {
+		http.Error(w, "Movie doesn't exist!", http.StatusBadRequest)
+		return
+	}
+	//Any earlier log of the same movie makes this one a rewatch
+	rewatch := r.PostFormValue("rewatch") != ""
+	if !rewatch {
+		query = `SELECT EXISTS(SELECT * FROM watchdiary WHERE userId = ? AND movieId = ? AND watchedDate <= ?)`
+		if err := db.DB.QueryRow(query, session.UserId, movieId, watchedDate.Format(time.DateOnly)).Scan(&rewatch); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Printf("Error checking previous diary entries: %s", err)
+			return
+		}
+	}
+	query = `INSERT INTO watchdiary (userId, movieId, watchedDate, rewatch, rating) VALUES (?, ?, ?, ?, ?)`
+	if _, err := db.DB.Exec(query, session.UserId, movieId, watchedDate.Format(time.DateOnly), rewatch, rating); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error inserting diary entry into db: %s", err)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, templateName, struct {
+		WatchedDate string
+		Rewatch     bool
+	}{watchedDate.Format(time.DateOnly), rewatch}); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template %s: %s", templateName, err)
+		return
+	}
+}
+
+func (h *Handler) DeleteDiaryEntry(w http.ResponseWriter, r *http.Request) {
+	entryId, err := strconv.Atoi(r.PathValue("entryId"))
+	if err != nil || entryId < 0 {
+		http.Error(w, "Wrong entry id!", http.StatusBadRequest)
+		return
+	}
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in DeleteDiaryEntry")
+		return
+	}
+	query := `DELETE FROM watchdiary WHERE entryId = ? AND userId = ?`
+	result, err := db.DB.Exec(query, entryId, session.UserId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error deleting diary entry: %s", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Diary entry doesn't exist or you are not the author!", http.StatusBadRequest)
+		return
+	}
+}
+
+func (h *Handler) GetDiaryPage(w http.ResponseWriter, r *http.Request) {
+	const wrapperName, contentName string = "index", "diary-page"
+	userId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || userId < 0 {
+		http.Error(w, "Wrong user id!", http.StatusBadRequest)
+		return
+	}
+	user := &User{Id: userId}
+	query := `SELECT username, diaryPublic FROM users WHERE userId = ?`
+	if err := db.DB.QueryRow(query, userId).Scan(&user.Username, &user.DiaryPublic); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found!", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("Error getting user from db: %s", err)
+		return
+	}
+	session := Sessions.GetSessionInfo(r)
+	if !canView(session, userId, user.DiaryPublic) {
+		http.Error(w, "This diary is private!", http.StatusForbidden)
+		return
+	}
+	entries, err := loadDiary(userId)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error loading diary: %s", err)
+		return
+	}
+	context := struct {
+		User    *User
+		Entries []DiaryEntry
+		Owner   bool
+	}{User: user, Entries: entries, Owner: session != nil && session.UserId == userId}
+	if err := utils.TemplateWrap(tmpl, w, contentName, context, wrapperName, nil); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error wrapping template %s with template %s: %s", contentName, wrapperName, err)
+		return
+	}
+}
+
+func (h *Handler) UpdatePrivacy(w http.ResponseWriter, r *http.Request) {
+	session, ok := r.Context().Value(S).(Session)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting session from context in UpdatePrivacy")
+		return
+	}
+	watchlistPublic := r.PostFormValue("watchlistPublic") != ""
+	diaryPublic := r.PostFormValue("diaryPublic") != ""
+	query := `UPDATE users SET watchlistPublic = ?, diaryPublic = ? WHERE userId = ?`
+	if _, err := db.DB.Exec(query, watchlistPublic, diaryPublic, session.UserId); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error updating privacy settings: %s", err)
+		return
+	}
+	w.Header().Add("HX-Redirect", "/user/"+strconv.Itoa(session.UserId))
+}
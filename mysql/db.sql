@@ -19,6 +19,55 @@
 CREATE DATABASE IF NOT EXISTS `movies` /*!40100 DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci */ /*!80016 DEFAULT ENCRYPTION='N' */;
 USE `movies`;
 
+-- Dumping structure for table movies.comment_revisions
+CREATE TABLE IF NOT EXISTS `comment_revisions` (
+  `revisionId` int unsigned NOT NULL AUTO_INCREMENT,
+  `commentId` int unsigned NOT NULL,
+  `comment` varchar(1000) NOT NULL DEFAULT '',
+  `editorId` int unsigned DEFAULT NULL,
+  `editorRole` enum('owner','admin') NOT NULL DEFAULT 'owner',
+  `revisedDT` datetime NOT NULL DEFAULT (now()),
+  PRIMARY KEY (`revisionId`),
+  KEY `commentId` (`commentId`),
+  KEY `FK_comment_revisions_users` (`editorId`),
+  CONSTRAINT `FK_comment_revisions_comments` FOREIGN KEY (`commentId`) REFERENCES `comments` (`commentId`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `FK_comment_revisions_users` FOREIGN KEY (`editorId`) REFERENCES `users` (`userId`) ON DELETE SET NULL ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
+-- Dumping structure for table movies.commentreactions
+CREATE TABLE IF NOT EXISTS `commentreactions` (
+  `userId` int unsigned NOT NULL,
+  `commentId` int unsigned NOT NULL,
+  `reaction` tinyint NOT NULL,
+  `timeStamp` datetime NOT NULL DEFAULT (now()),
+  UNIQUE KEY `userId_commentId` (`userId`,`commentId`) USING BTREE,
+  KEY `commentId_reaction` (`commentId`,`reaction`) USING BTREE,
+  CONSTRAINT `FK_commentreactions_comments` FOREIGN KEY (`commentId`) REFERENCES `comments` (`commentId`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `FK_commentreactions_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
+-- Dumping structure for table movies.commentreports
+CREATE TABLE IF NOT EXISTS `commentreports` (
+  `reportId` int unsigned NOT NULL AUTO_INCREMENT,
+  `commentId` int unsigned NOT NULL,
+  `reporterId` int unsigned DEFAULT NULL COMMENT 'NULL if reported by the spam filter',
+  `reason` varchar(500) NOT NULL DEFAULT '',
+  `reportedDT` datetime NOT NULL DEFAULT (now()),
+  `resolved` tinyint(1) NOT NULL DEFAULT (0),
+  PRIMARY KEY (`reportId`),
+  UNIQUE KEY `commentId_reporterId` (`commentId`,`reporterId`) USING BTREE,
+  KEY `resolved_commentId` (`resolved`,`commentId`),
+  KEY `FK_commentreports_users` (`reporterId`),
+  CONSTRAINT `FK_commentreports_comments` FOREIGN KEY (`commentId`) REFERENCES `comments` (`commentId`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `FK_commentreports_users` FOREIGN KEY (`reporterId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
 -- Dumping structure for table movies.comments
 CREATE TABLE IF NOT EXISTS `comments` (
   `commentId` int unsigned NOT NULL AUTO_INCREMENT,
@@ -26,16 +75,41 @@ CREATE TABLE IF NOT EXISTS `comments` (
   `userId` int unsigned DEFAULT NULL,
   `comment` varchar(1000) NOT NULL DEFAULT '',
   `postedDT` datetime NOT NULL DEFAULT (now()),
+  `parentId` int unsigned DEFAULT NULL,
+  `depth` tinyint unsigned NOT NULL DEFAULT '0',
+  `deleted` tinyint(1) NOT NULL DEFAULT (0),
+  `editedDT` datetime DEFAULT NULL,
+  `upvotes` int unsigned NOT NULL DEFAULT '0',
+  `downvotes` int unsigned NOT NULL DEFAULT '0',
+  `hidden` tinyint(1) NOT NULL DEFAULT (0),
   PRIMARY KEY (`commentId`),
   UNIQUE KEY `commentId` (`commentId`),
   KEY `FK_comments_movies` (`movieId`),
   KEY `userId` (`userId`),
+  KEY `parentId` (`parentId`),
   CONSTRAINT `FK_comments_movies` FOREIGN KEY (`movieId`) REFERENCES `movies` (`movieId`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `FK_comments_parent` FOREIGN KEY (`parentId`) REFERENCES `comments` (`commentId`) ON DELETE SET NULL ON UPDATE CASCADE,
   CONSTRAINT `FK_comments_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE SET NULL ON UPDATE CASCADE
 ) ENGINE=InnoDB AUTO_INCREMENT=125 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
 
 -- Data exporting was unselected.
 
+-- Dumping structure for table movies.dataexports
+CREATE TABLE IF NOT EXISTS `dataexports` (
+  `exportId` int unsigned NOT NULL AUTO_INCREMENT,
+  `userId` int unsigned NOT NULL,
+  `status` enum('pending','ready','failed') NOT NULL DEFAULT 'pending',
+  `size` bigint unsigned NOT NULL DEFAULT '0',
+  `requestedDT` datetime NOT NULL DEFAULT (now()),
+  `expiresDT` datetime DEFAULT NULL,
+  PRIMARY KEY (`exportId`),
+  KEY `userId` (`userId`),
+  KEY `expiresDT` (`expiresDT`),
+  CONSTRAINT `FK_dataexports_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
 -- Dumping structure for procedure movies.DeleteComment
 DELIMITER //
 CREATE PROCEDURE `DeleteComment`(
@@ -55,10 +129,72 @@ BEGIN
 END//
 DELIMITER ;
 
+-- Dumping structure for table movies.favoritemovies
+CREATE TABLE IF NOT EXISTS `favoritemovies` (
+  `userId` int unsigned NOT NULL,
+  `movieId` int unsigned NOT NULL,
+  `position` int unsigned NOT NULL DEFAULT '0',
+  UNIQUE KEY `userId_movieId` (`userId`,`movieId`) USING BTREE,
+  KEY `userId_position` (`userId`,`position`),
+  KEY `FK_favoritemovies_movies` (`movieId`),
+  CONSTRAINT `FK_favoritemovies_movies` FOREIGN KEY (`movieId`) REFERENCES `movies` (`movieId`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `FK_favoritemovies_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
 -- Dumping structure for procedure movies.GetComments
 DELIMITER //
 CREATE PROCEDURE `GetComments`(
 	IN `movieId` INT,
+	IN `viewerId` INT,
+	IN `sortBy` VARCHAR(16),
+	IN `lastScore` INT,
+	IN `lastCommentId` INT,
+	IN `n` INT
+)
+BEGIN
+	WITH s AS (
+		SELECT *,
+			CASE sortBy
+				WHEN 'top' THEN CAST(comments.upvotes AS SIGNED) - CAST(comments.downvotes AS SIGNED)
+				WHEN 'controversial' THEN LEAST(comments.upvotes, comments.downvotes) * 100000 + comments.upvotes + comments.downvotes
+				ELSE 0
+			END AS score
+		FROM comments
+		WHERE comments.movieId = movieId AND comments.parentId IS NULL
+	), c AS (
+		SELECT *
+		FROM s
+		WHERE IF(lastCommentID = 0, TRUE, s.score < lastScore OR (s.score = lastScore AND s.commentId < lastCommentId))
+		ORDER BY s.score DESC, s.commentId DESC
+		LIMIT n
+	)
+	SELECT c.comment,
+		 	 c.postedDT,
+		 	 c.userId,
+		 	 c.commentId,
+		 	 IFNULL(users.username, 'DELETED'),
+		 	 c.depth,
+		 	 c.deleted,
+		 	 (SELECT COUNT(*) FROM comments r WHERE r.parentId = c.commentId),
+		 	 c.editedDT,
+		 	 c.upvotes,
+		 	 c.downvotes,
+		 	 IFNULL((SELECT cr.reaction FROM commentreactions cr WHERE cr.commentId = c.commentId AND cr.userId = viewerId), 0),
+		 	 c.hidden,
+		 	 c.score
+	FROM c
+	LEFT JOIN users ON c.userId = users.userId
+	ORDER BY c.score DESC, c.commentId DESC;
+END//
+DELIMITER ;
+
+-- Dumping structure for procedure movies.GetReplies
+DELIMITER //
+CREATE PROCEDURE `GetReplies`(
+	IN `parentId` INT,
+	IN `viewerId` INT,
 	IN `lastCommentId` INT,
 	IN `n` INT
 )
@@ -66,17 +202,27 @@ BEGIN
 	WITH c AS (
 		SELECT *
 		FROM comments
-		WHERE comments.movieId = movieId AND IF(lastCommentID = 0, TRUE, comments.commentId < lastCommentId)
-		ORDER BY commentId DESC
+		WHERE comments.parentId = parentId AND comments.commentId > lastCommentId
+		ORDER BY commentId ASC
 		LIMIT n
 	)
 	SELECT c.comment,
 		 	 c.postedDT,
 		 	 c.userId,
 		 	 c.commentId,
-		 	 IFNULL(users.username, 'DELETED')
+		 	 IFNULL(users.username, 'DELETED'),
+		 	 c.depth,
+		 	 c.deleted,
+		 	 (SELECT COUNT(*) FROM comments r WHERE r.parentId = c.commentId),
+		 	 c.editedDT,
+		 	 c.upvotes,
+		 	 c.downvotes,
+		 	 IFNULL((SELECT cr.reaction FROM commentreactions cr WHERE cr.commentId = c.commentId AND cr.userId = viewerId), 0),
+		 	 c.hidden,
+		 	 c.movieId
 	FROM c
-	LEFT JOIN users ON c.userId = users.userId;
+	LEFT JOIN users ON c.userId = users.userId
+	ORDER BY c.commentId ASC;
 END//
 DELIMITER ;
 
@@ -96,6 +242,7 @@ BEGIN
 	FROM comments c
 	JOIN movies m ON c.movieId = m.movieId
 	JOIN users u ON c.userId = u.userId
+	WHERE c.deleted = 0 AND c.hidden = 0
 	ORDER BY commentId DESC
 	LIMIT n;
 END//
@@ -138,6 +285,80 @@ BEGIN
 END//
 DELIMITER ;
 
+-- Dumping structure for table movies.moderationactions
+CREATE TABLE IF NOT EXISTS `moderationactions` (
+  `actionId` int unsigned NOT NULL AUTO_INCREMENT,
+  `commentId` int unsigned DEFAULT NULL,
+  `moderatorId` int unsigned DEFAULT NULL,
+  `targetUserId` int unsigned DEFAULT NULL,
+  `action` enum('dismiss','hide','delete','ban') NOT NULL,
+  `note` varchar(500) NOT NULL DEFAULT '',
+  `actionDT` datetime NOT NULL DEFAULT (now()),
+  PRIMARY KEY (`actionId`),
+  KEY `commentId` (`commentId`),
+  KEY `FK_moderationactions_moderator` (`moderatorId`),
+  KEY `FK_moderationactions_target` (`targetUserId`),
+  CONSTRAINT `FK_moderationactions_comments` FOREIGN KEY (`commentId`) REFERENCES `comments` (`commentId`) ON DELETE SET NULL ON UPDATE CASCADE,
+  CONSTRAINT `FK_moderationactions_moderator` FOREIGN KEY (`moderatorId`) REFERENCES `users` (`userId`) ON DELETE SET NULL ON UPDATE CASCADE,
+  CONSTRAINT `FK_moderationactions_target` FOREIGN KEY (`targetUserId`) REFERENCES `users` (`userId`) ON DELETE SET NULL ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
+-- Dumping structure for table movies.movielistentries
+CREATE TABLE IF NOT EXISTS `movielistentries` (
+  `listId` int unsigned NOT NULL,
+  `movieId` int unsigned NOT NULL,
+  `position` int unsigned NOT NULL DEFAULT '0',
+  `note` varchar(500) NOT NULL DEFAULT '',
+  UNIQUE KEY `listId_movieId` (`listId`,`movieId`) USING BTREE,
+  KEY `listId_position` (`listId`,`position`),
+  KEY `FK_movielistentries_movies` (`movieId`),
+  CONSTRAINT `FK_movielistentries_movielists` FOREIGN KEY (`listId`) REFERENCES `movielists` (`listId`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `FK_movielistentries_movies` FOREIGN KEY (`movieId`) REFERENCES `movies` (`movieId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
+-- Dumping structure for table movies.movielists
+CREATE TABLE IF NOT EXISTS `movielists` (
+  `listId` int unsigned NOT NULL AUTO_INCREMENT,
+  `slug` varchar(16) NOT NULL,
+  `userId` int unsigned NOT NULL,
+  `name` varchar(100) NOT NULL,
+  `description` varchar(2000) NOT NULL DEFAULT '',
+  `visibility` enum('public','unlisted','private') NOT NULL DEFAULT 'public',
+  `forkedFromId` int unsigned DEFAULT NULL,
+  `createdDT` datetime NOT NULL DEFAULT (now()),
+  PRIMARY KEY (`listId`),
+  UNIQUE KEY `slug` (`slug`),
+  KEY `userId` (`userId`),
+  KEY `FK_movielists_forked` (`forkedFromId`),
+  CONSTRAINT `FK_movielists_forked` FOREIGN KEY (`forkedFromId`) REFERENCES `movielists` (`listId`) ON DELETE SET NULL ON UPDATE CASCADE,
+  CONSTRAINT `FK_movielists_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
+-- Dumping structure for table movies.moviemedia
+CREATE TABLE IF NOT EXISTS `moviemedia` (
+  `mediaId` int unsigned NOT NULL AUTO_INCREMENT,
+  `movieId` int unsigned NOT NULL,
+  `kind` enum('poster','backdrop','still') NOT NULL,
+  `position` int unsigned NOT NULL DEFAULT '0',
+  `isPrimary` tinyint(1) NOT NULL DEFAULT '0',
+  `caption` varchar(300) NOT NULL DEFAULT '',
+  `uploaderId` int unsigned DEFAULT NULL,
+  `uploadedDT` datetime NOT NULL DEFAULT (now()),
+  PRIMARY KEY (`mediaId`),
+  KEY `movieId_kind_position` (`movieId`,`kind`,`position`),
+  KEY `FK_moviemedia_uploader` (`uploaderId`),
+  CONSTRAINT `FK_moviemedia_movies` FOREIGN KEY (`movieId`) REFERENCES `movies` (`movieId`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `FK_moviemedia_uploader` FOREIGN KEY (`uploaderId`) REFERENCES `users` (`userId`) ON DELETE SET NULL ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
 -- Dumping structure for table movies.movierating
 CREATE TABLE IF NOT EXISTS `movierating` (
   `userId` int unsigned NOT NULL,
@@ -165,13 +386,114 @@ CREATE TABLE IF NOT EXISTS `movies` (
 
 -- Data exporting was unselected.
 
+-- Dumping structure for table movies.notifications
+CREATE TABLE IF NOT EXISTS `notifications` (
+  `notificationId` int unsigned NOT NULL AUTO_INCREMENT,
+  `userId` int unsigned NOT NULL,
+  `actorId` int unsigned DEFAULT NULL,
+  `kind` enum('mention','reply','moderation') NOT NULL,
+  `commentId` int unsigned DEFAULT NULL,
+  `movieId` int unsigned DEFAULT NULL,
+  `message` varchar(500) NOT NULL DEFAULT '',
+  `isRead` tinyint(1) NOT NULL DEFAULT '0',
+  `createdDT` datetime NOT NULL DEFAULT (now()),
+  PRIMARY KEY (`notificationId`),
+  KEY `userId_isRead` (`userId`,`isRead`),
+  KEY `FK_notifications_actor` (`actorId`),
+  KEY `FK_notifications_comments` (`commentId`),
+  KEY `FK_notifications_movies` (`movieId`),
+  CONSTRAINT `FK_notifications_actor` FOREIGN KEY (`actorId`) REFERENCES `users` (`userId`) ON DELETE SET NULL ON UPDATE CASCADE,
+  CONSTRAINT `FK_notifications_comments` FOREIGN KEY (`commentId`) REFERENCES `comments` (`commentId`) ON DELETE SET NULL ON UPDATE CASCADE,
+  CONSTRAINT `FK_notifications_movies` FOREIGN KEY (`movieId`) REFERENCES `movies` (`movieId`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `FK_notifications_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
+-- Dumping structure for table movies.oidcstates
+CREATE TABLE IF NOT EXISTS `oidcstates` (
+  `stateHash` char(64) NOT NULL,
+  `provider` varchar(32) NOT NULL,
+  `nonce` varchar(64) NOT NULL,
+  `verifier` varchar(64) NOT NULL,
+  `userId` int unsigned DEFAULT NULL,
+  `expiresDT` datetime NOT NULL,
+  PRIMARY KEY (`stateHash`),
+  KEY `expiresDT` (`expiresDT`),
+  KEY `FK_oidcstates_users` (`userId`),
+  CONSTRAINT `FK_oidcstates_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
+-- Dumping structure for table movies.passkeychallenges
+CREATE TABLE IF NOT EXISTS `passkeychallenges` (
+  `challengeHash` char(64) NOT NULL,
+  `userId` int unsigned DEFAULT NULL,
+  `purpose` enum('register','login') NOT NULL,
+  `expiresDT` datetime NOT NULL,
+  PRIMARY KEY (`challengeHash`),
+  KEY `expiresDT` (`expiresDT`),
+  KEY `FK_passkeychallenges_users` (`userId`),
+  CONSTRAINT `FK_passkeychallenges_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
+-- Dumping structure for table movies.passkeys
+CREATE TABLE IF NOT EXISTS `passkeys` (
+  `credentialId` varbinary(255) NOT NULL,
+  `userId` int unsigned NOT NULL,
+  `publicKey` blob NOT NULL,
+  `signCount` int unsigned NOT NULL DEFAULT '0',
+  `nickname` varchar(64) NOT NULL DEFAULT '',
+  `createdDT` datetime NOT NULL DEFAULT (now()),
+  `lastUsedDT` datetime DEFAULT NULL,
+  PRIMARY KEY (`credentialId`),
+  KEY `FK_passkeys_users` (`userId`),
+  CONSTRAINT `FK_passkeys_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
+-- Dumping structure for table movies.recoverycodes
+CREATE TABLE IF NOT EXISTS `recoverycodes` (
+  `userId` int unsigned NOT NULL,
+  `codeHash` char(64) NOT NULL,
+  PRIMARY KEY (`userId`,`codeHash`),
+  CONSTRAINT `FK_recoverycodes_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
+-- Dumping structure for table movies.sessionchanges
+CREATE TABLE IF NOT EXISTS `sessionchanges` (
+  `changeId` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `userId` int unsigned NOT NULL,
+  `createdDT` datetime NOT NULL DEFAULT (now()),
+  PRIMARY KEY (`changeId`),
+  KEY `createdDT` (`createdDT`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
 -- Dumping structure for table movies.sessions
 CREATE TABLE IF NOT EXISTS `sessions` (
-  `token` varchar(64) NOT NULL,
+  `tokenHash` char(64) NOT NULL,
+  `sessionId` int unsigned NOT NULL AUTO_INCREMENT,
   `expirationDT` datetime NOT NULL,
   `userId` int unsigned NOT NULL DEFAULT (0),
-  PRIMARY KEY (`token`),
-  UNIQUE KEY `token` (`token`),
+  `createdDT` datetime NOT NULL DEFAULT (now()),
+  `lastSeenDT` datetime NOT NULL DEFAULT (now()),
+  `ip` varchar(45) NOT NULL DEFAULT '',
+  `userAgent` varchar(255) NOT NULL DEFAULT '',
+  `remember` tinyint(1) NOT NULL DEFAULT (0),
+  `mfa` tinyint(1) NOT NULL DEFAULT (0),
+  PRIMARY KEY (`tokenHash`),
+  KEY `expirationDT` (`expirationDT`),
+  KEY `lastSeenDT` (`lastSeenDT`),
+  UNIQUE KEY `tokenHash` (`tokenHash`),
+  UNIQUE KEY `sessionId` (`sessionId`),
   KEY `userId` (`userId`),
   CONSTRAINT `userIdFK` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
@@ -194,11 +516,46 @@ BEGIN
 		WHERE users.userId = userId
 	)
 	UPDATE comments c
-	SET c.comment = comment
-	WHERE c.commentId = commentId AND (c.userId = userId OR (SELECT admin FROM a) = 1);
+	SET c.comment = comment, c.editedDT = NOW()
+	WHERE c.commentId = commentId AND c.deleted = 0 AND (c.userId = userId OR (SELECT admin FROM a) = 1);
 END//
 DELIMITER ;
 
+-- Dumping structure for procedure movies.TombstoneComment
+DELIMITER //
+CREATE PROCEDURE `TombstoneComment`(
+	IN `userId` INT,
+	IN `commentId` INT
+)
+BEGIN
+	WITH a AS (
+		SELECT
+			userId,
+			admin		 
+		FROM users
+		WHERE users.userId = userId
+	)
+	UPDATE comments c
+	SET c.comment = '', c.deleted = 1
+	WHERE c.commentId = commentId AND c.deleted = 0 AND (c.userId = userId OR (SELECT admin FROM a) = 1);
+END//
+DELIMITER ;
+
+-- Dumping structure for table movies.useridentities
+CREATE TABLE IF NOT EXISTS `useridentities` (
+  `provider` varchar(32) NOT NULL,
+  `subject` varchar(255) NOT NULL,
+  `userId` int unsigned NOT NULL,
+  `email` varchar(254) DEFAULT NULL,
+  `createdDT` datetime NOT NULL DEFAULT (now()),
+  `lastUsedDT` datetime DEFAULT NULL,
+  PRIMARY KEY (`provider`,`subject`),
+  UNIQUE KEY `userId_provider` (`userId`,`provider`),
+  CONSTRAINT `FK_useridentities_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
 -- Dumping structure for table movies.users
 CREATE TABLE IF NOT EXISTS `users` (
   `userId` int unsigned NOT NULL AUTO_INCREMENT,
@@ -207,13 +564,74 @@ CREATE TABLE IF NOT EXISTS `users` (
   `registerDate` datetime NOT NULL DEFAULT (now()),
   `admin` tinyint(1) NOT NULL DEFAULT (0),
   `banUntil` datetime NOT NULL DEFAULT (now()),
+  `watchlistPublic` tinyint(1) NOT NULL DEFAULT (1),
+  `diaryPublic` tinyint(1) NOT NULL DEFAULT (1),
+  `displayName` varchar(50) NOT NULL DEFAULT '',
+  `bio` varchar(1000) NOT NULL DEFAULT '',
+  `avatarVersion` int unsigned NOT NULL DEFAULT '0',
+  `email` varchar(254) DEFAULT NULL,
+  `totpSecret` varchar(64) DEFAULT NULL,
+  `totpLastCounter` bigint NOT NULL DEFAULT '0',
+  `passwordSet` tinyint(1) NOT NULL DEFAULT (1) COMMENT '0 for accounts created with single sign-on until a password is set',
   PRIMARY KEY (`userId`,`username`),
   UNIQUE KEY `userId_UNIQUE` (`userId`),
-  UNIQUE KEY `userscol_UNIQUE` (`password`)
+  UNIQUE KEY `username_UNIQUE` (`username`),
+  UNIQUE KEY `userscol_UNIQUE` (`password`),
+  UNIQUE KEY `email_UNIQUE` (`email`)
 ) ENGINE=InnoDB AUTO_INCREMENT=5 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
 
 -- Data exporting was unselected.
 
+-- Dumping structure for table movies.usertokens
+CREATE TABLE IF NOT EXISTS `usertokens` (
+  `tokenHash` char(64) NOT NULL,
+  `userId` int unsigned NOT NULL,
+  `purpose` enum('reset','verify','login') NOT NULL,
+  `email` varchar(254) DEFAULT NULL,
+  `attempts` tinyint unsigned NOT NULL DEFAULT '0',
+  `remember` tinyint(1) NOT NULL DEFAULT (0) COMMENT 'Remember me of a login challenge',
+  `createdDT` datetime NOT NULL DEFAULT (now()),
+  `expiresDT` datetime NOT NULL,
+  PRIMARY KEY (`tokenHash`),
+  KEY `userId_purpose` (`userId`,`purpose`),
+  CONSTRAINT `FK_usertokens_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
+-- Dumping structure for table movies.watchdiary
+CREATE TABLE IF NOT EXISTS `watchdiary` (
+  `entryId` int unsigned NOT NULL AUTO_INCREMENT,
+  `userId` int unsigned NOT NULL,
+  `movieId` int unsigned NOT NULL,
+  `watchedDate` date NOT NULL,
+  `rewatch` tinyint(1) NOT NULL DEFAULT (0),
+  `rating` decimal(2,1) unsigned DEFAULT NULL,
+  PRIMARY KEY (`entryId`),
+  KEY `userId_watchedDate` (`userId`,`watchedDate`),
+  KEY `FK_watchdiary_movies` (`movieId`),
+  CONSTRAINT `FK_watchdiary_movies` FOREIGN KEY (`movieId`) REFERENCES `movies` (`movieId`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `FK_watchdiary_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
+-- Dumping structure for table movies.watchlist
+CREATE TABLE IF NOT EXISTS `watchlist` (
+  `userId` int unsigned NOT NULL,
+  `movieId` int unsigned NOT NULL,
+  `position` int unsigned NOT NULL DEFAULT '0',
+  `note` varchar(500) NOT NULL DEFAULT '',
+  `addedDT` datetime NOT NULL DEFAULT (now()),
+  UNIQUE KEY `userId_movieId` (`userId`,`movieId`) USING BTREE,
+  KEY `userId_position` (`userId`,`position`),
+  KEY `FK_watchlist_movies` (`movieId`),
+  CONSTRAINT `FK_watchlist_movies` FOREIGN KEY (`movieId`) REFERENCES `movies` (`movieId`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `FK_watchlist_users` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Data exporting was unselected.
+
 /*!40103 SET TIME_ZONE=IFNULL(@OLD_TIME_ZONE, 'system') */;
 /*!40101 SET SQL_MODE=IFNULL(@OLD_SQL_MODE, '') */;
 /*!40014 SET FOREIGN_KEY_CHECKS=IFNULL(@OLD_FOREIGN_KEY_CHECKS, 1) */;
@@ -0,0 +1,33 @@
+-- Upgrade of databases created before session tokens were stored hashed.
+-- Plaintext tokens can't be turned into usable sessions, so the table is created again in its
+-- current shape, all existing sessions end and users have to log in again.
+DROP TABLE IF EXISTS `sessions`;
+
+CREATE TABLE `sessions` (
+  `tokenHash` char(64) NOT NULL,
+  `sessionId` int unsigned NOT NULL AUTO_INCREMENT,
+  `expirationDT` datetime NOT NULL,
+  `userId` int unsigned NOT NULL DEFAULT (0),
+  `createdDT` datetime NOT NULL DEFAULT (now()),
+  `lastSeenDT` datetime NOT NULL DEFAULT (now()),
+  `ip` varchar(45) NOT NULL DEFAULT '',
+  `userAgent` varchar(255) NOT NULL DEFAULT '',
+  `remember` tinyint(1) NOT NULL DEFAULT (0),
+  `mfa` tinyint(1) NOT NULL DEFAULT (0),
+  PRIMARY KEY (`tokenHash`),
+  KEY `expirationDT` (`expirationDT`),
+  KEY `lastSeenDT` (`lastSeenDT`),
+  UNIQUE KEY `tokenHash` (`tokenHash`),
+  UNIQUE KEY `sessionId` (`sessionId`),
+  KEY `userId` (`userId`),
+  CONSTRAINT `userIdFK` FOREIGN KEY (`userId`) REFERENCES `users` (`userId`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+
+-- Log of session changes read by other instances sharing the database
+CREATE TABLE IF NOT EXISTS `sessionchanges` (
+  `changeId` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `userId` int unsigned NOT NULL,
+  `createdDT` datetime NOT NULL DEFAULT (now()),
+  PRIMARY KEY (`changeId`),
+  KEY `createdDT` (`createdDT`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
@@ -0,0 +1,363 @@
+// Package oidc is an OpenID Connect relying party: discovery, authorization code flow with PKCE
+// and ID token verification with keys of the provider
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrToken  = errors.New("oidc: malformed ID token")
+	ErrKey    = errors.New("oidc: unknown signing key")
+	ErrClaims = errors.New("oidc: ID token claims rejected")
+)
+
+// Leeway tolerates clock difference with the provider
+const Leeway = time.Minute
+
+const maxResponseSize = 1 << 20
+
+var b64 = base64.RawURLEncoding
+
+// Provider is an identity provider registered for the site. Name identifies it in addresses and db
+type Provider struct {
+	Name         string
+	Label        string //Shown on the login button
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string //openid is always requested
+	Client       *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      map[string]crypto.PublicKey
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims of a verified ID token
+type Claims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+func (p *Provider) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return http.DefaultClient
+}
+
+func (p *Provider) getJSON(ctx context.Context, address string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: %s", address, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+}
+
+// Discover loads provider metadata once. Failed attempts are retried on the next call
+func (p *Provider) Discover(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return nil
+	}
+	d := &discovery{}
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return err
+	}
+	if d.Issuer != p.Issuer {
+		return fmt.Errorf("oidc: discovered issuer %q differs from %q", d.Issuer, p.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return errors.New("oidc: incomplete provider metadata")
+	}
+	p.discovery = d
+	return nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b64.EncodeToString(b), nil
+}
+
+// AuthRequest holds values the site keeps until the provider redirects back
+type AuthRequest struct {
+	State    string
+	Nonce    string
+	Verifier string //PKCE code verifier
+	URL      string //Address of the provider the browser is sent to
+}
+
+// NewAuthRequest prepares an authorization code request with PKCE S256
+func (p *Provider) NewAuthRequest(ctx context.Context) (*AuthRequest, error) {
+	if err := p.Discover(ctx); err != nil {
+		return nil, err
+	}
+	ar := &AuthRequest{}
+	for _, s := range []*string{&ar.State, &ar.Nonce, &ar.Verifier} {
+		v, err := randomString()
+		if err != nil {
+			return nil, err
+		}
+		*s = v
+	}
+	scopes := []string{"openid"}
+	for _, s := range p.Scopes {
+		if s != "openid" {
+			scopes = append(scopes, s)
+		}
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", strings.Join(scopes, " "))
+	v.Set("state", ar.State)
+	v.Set("nonce", ar.Nonce)
+	v.Set("code_challenge", CodeChallenge(ar.Verifier))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(p.discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	ar.URL = p.discovery.AuthorizationEndpoint + sep + v.Encode()
+	return ar, nil
+}
+
+// CodeChallenge is the S256 challenge of a PKCE verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return b64.EncodeToString(sum[:])
+}
+
+// Exchange trades the authorization code for tokens and returns verified claims of the ID token
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	if err := p.Discover(ctx); err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body := struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("oidc: token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return nil, fmt.Errorf("oidc: token request failed: %s %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	return p.Verify(ctx, body.IDToken, nonce)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := b64.DecodeString(k.N)
+		e, err2 := b64.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return nil, ErrKey
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		x, err1 := b64.DecodeString(k.X)
+		y, err2 := b64.DecodeString(k.Y)
+		if k.Crv != "P-256" || err1 != nil || err2 != nil || len(x) != 32 || len(y) != 32 {
+			return nil, ErrKey
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, ErrKey
+}
+
+// key returns a signing key by id. Keys are reloaded once when the id is unknown, providers rotate them
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := p.getJSON(ctx, p.discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrKey
+}
+
+// Verify checks signature, issuer, audience, expiry and nonce of an ID token
+func (p *Provider) Verify(ctx context.Context, rawToken, nonce string) (*Claims, error) {
+	if err := p.Discover(ctx); err != nil {
+		return nil, err
+	}
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrToken
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodePart(parts[0], &header); err != nil {
+		return nil, ErrToken
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrToken
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, ErrToken
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, ErrToken
+		}
+	default:
+		return nil, ErrKey
+	}
+
+	claims := struct {
+		Claims
+		Issuer    string   `json:"iss"`
+		Audience  audience `json:"aud"`
+		AZP       string   `json:"azp"`
+		Expires   int64    `json:"exp"`
+		IssuedAt  int64    `json:"iat"`
+		Nonce     string   `json:"nonce"`
+		NotBefore int64    `json:"nbf"`
+	}{}
+	if err := decodePart(parts[1], &claims); err != nil {
+		return nil, ErrToken
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != p.Issuer,
+		!slices.Contains(claims.Audience, p.ClientID),
+		len(claims.Audience) > 1 && claims.AZP != p.ClientID,
+		now.After(time.Unix(claims.Expires, 0).Add(Leeway)),
+		claims.NotBefore != 0 && now.Add(Leeway).Before(time.Unix(claims.NotBefore, 0)),
+		claims.Nonce != nonce,
+		claims.Subject == "":
+		return nil, ErrClaims
+	}
+	return &claims.Claims, nil
+}
+
+func decodePart(part string, v any) error {
+	b, err := b64.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// audience is a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
@@ -0,0 +1,296 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockIdP is a provider with discovery, keys and token endpoint. Codes are handed out by authorize
+type mockIdP struct {
+	t      *testing.T
+	srv    *httptest.Server
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	codes  map[string]codeGrant
+	claims map[string]any //Extra or replaced claims of issued tokens
+	alg    string
+}
+
+type codeGrant struct {
+	challenge, nonce string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	m := &mockIdP{t: t, codes: map[string]codeGrant{}, claims: map[string]any{}, alg: "RS256"}
+	var err error
+	if m.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if m.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.srv.URL,
+			"authorization_endpoint": m.srv.URL + "/authorize",
+			"token_endpoint":         m.srv.URL + "/token",
+			"jwks_uri":               m.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		x, y := make([]byte, 32), make([]byte, 32)
+		m.ec.X.FillBytes(x)
+		m.ec.Y.FillBytes(y)
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64.EncodeToString(m.rsa.N.Bytes()), "e": "AQAB"},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64.EncodeToString(x), "y": b64.EncodeToString(y)},
+		}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		grant, ok := m.codes[r.FormValue("code")]
+		delete(m.codes, r.FormValue("code"))
+		switch {
+		case id != "client" || secret != "secret":
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		case !ok || CodeChallenge(r.FormValue("code_verifier")) != grant.challenge:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "x", "token_type": "Bearer", "id_token": m.token(grant.nonce)})
+	})
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+// authorize acts as the user approving the request and returns the code given to the redirect address
+func (m *mockIdP) authorize(address string) (code, state string) {
+	u, err := url.Parse(address)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "client" || !strings.Contains(q.Get("scope"), "openid") {
+		m.t.Fatalf("unexpected authorization request %s", address)
+	}
+	code = "code-" + q.Get("state")[:8]
+	m.codes[code] = codeGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	return code, q.Get("state")
+}
+
+func (m *mockIdP) token(nonce string) string {
+	now := time.Now()
+	claims := map[string]any{
+		"iss": m.srv.URL, "aud": "client", "sub": "user-1", "nonce": nonce,
+		"iat": now.Unix(), "exp": now.Add(5 * time.Minute).Unix(),
+		"email": "someone@example.com", "email_verified": true, "preferred_username": "someone",
+	}
+	for k, v := range m.claims {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	kid := "rsa"
+	if m.alg == "ES256" {
+		kid = "ec"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": m.alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	if m.alg == "ES256" {
+		r, s, err := ecdsa.Sign(rand.Reader, m.ec, digest[:])
+		if err != nil {
+			m.t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	} else {
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, m.rsa, crypto.SHA256, digest[:]); err != nil {
+			m.t.Fatal(err)
+		}
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+func (m *mockIdP) provider() *Provider {
+	return &Provider{Name: "mock", Issuer: m.srv.URL, ClientID: "client", ClientSecret: "secret",
+		RedirectURL: "https://movies.example.com/login/oidc/mock/callback", Scopes: []string{"email", "profile"}}
+}
+
+func TestCodeFlow(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256"} {
+		t.Run(alg, func(t *testing.T) {
+			m := newMockIdP(t)
+			m.alg = alg
+			p := m.provider()
+			ar, err := p.NewAuthRequest(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, state := m.authorize(ar.URL)
+			if state != ar.State {
+				t.Fatalf("state %q, want %q", state, ar.State)
+			}
+			claims, err := p.Exchange(context.Background(), code, ar.Verifier, ar.Nonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Claims{Subject: "user-1", Email: "someone@example.com", EmailVerified: true, PreferredUsername: "someone"}
+			if *claims != want {
+				t.Errorf("got %+v, want %+v", *claims, want)
+			}
+			//Codes are single use
+			if _, err := p.Exchange(context.Background(), code, ar.Verifier, ar.Nonce); err == nil {
+				t.Error("reused code accepted")
+			}
+		})
+	}
+}
+
+func TestExchangeErrors(t *testing.T) {
+	m := newMockIdP(t)
+	p := m.provider()
+	ar, err := p.NewAuthRequest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := m.authorize(ar.URL)
+	if _, err := p.Exchange(context.Background(), code, "wrong verifier", ar.Nonce); err == nil {
+		t.Error("wrong PKCE verifier accepted")
+	}
+	code, _ = m.authorize(ar.URL)
+	if _, err := p.Exchange(context.Background(), code, ar.Verifier, "other nonce"); !errors.Is(err, ErrClaims) {
+		t.Errorf("got %v, want %v", err, ErrClaims)
+	}
+	p.ClientSecret = "wrong"
+	code, _ = m.authorize(ar.URL)
+	if _, err := p.Exchange(context.Background(), code, ar.Verifier, ar.Nonce); err == nil {
+		t.Error("wrong client secret accepted")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	m := newMockIdP(t)
+	tests := []struct {
+		name   string
+		claims map[string]any
+		modify func(p *Provider, token string) string
+		want   error
+	}{
+		{"valid", nil, nil, nil},
+		{"audience list", map[string]any{"aud": []string{"other", "client"}, "azp": "client"}, nil, nil},
+		{"audience list without azp", map[string]any{"aud": []string{"other", "client"}}, nil, ErrClaims},
+		{"other audience", map[string]any{"aud": "other"}, nil, ErrClaims},
+		{"other issuer", map[string]any{"iss": "https://evil.example.com"}, nil, ErrClaims},
+		{"expired", map[string]any{"exp": time.Now().Add(-2 * Leeway).Unix()}, nil, ErrClaims},
+		{"within leeway", map[string]any{"exp": time.Now().Add(-Leeway / 2).Unix()}, nil, nil},
+		{"not yet valid", map[string]any{"nbf": time.Now().Add(2 * Leeway).Unix()}, nil, ErrClaims},
+		{"no subject", map[string]any{"sub": nil}, nil, ErrClaims},
+		{"tampered payload", nil, func(p *Provider, token string) string {
+			parts := strings.Split(token, ".")
+			payload, _ := json.Marshal(map[string]any{"iss": p.Issuer, "aud": "client", "sub": "admin", "nonce": "n", "exp": time.Now().Add(time.Hour).Unix()})
+			return parts[0] + "." + b64.EncodeToString(payload) + "." + parts[2]
+		}, ErrToken},
+		{"unsigned", nil, func(p *Provider, token string) string {
+			parts := strings.Split(token, ".")
+			header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa"})
+			return b64.EncodeToString(header) + "." + parts[1] + "."
+		}, ErrToken},
+		{"unknown key", nil, func(p *Provider, token string) string {
+			parts := strings.Split(token, ".")
+			header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "gone"})
+			return b64.EncodeToString(header) + "." + parts[1] + "." + parts[2]
+		}, ErrKey},
+		{"garbage", nil, func(p *Provider, token string) string { return "a.b" }, ErrToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m.claims = tt.claims
+			p := m.provider()
+			token := m.token("n")
+			if tt.modify != nil {
+				token = tt.modify(p, token)
+			}
+			_, err := p.Verify(context.Background(), token, "n")
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	m := newMockIdP(t)
+	p := m.provider()
+	if _, err := p.Verify(context.Background(), m.token("n"), "n"); err != nil {
+		t.Fatal(err)
+	}
+	//New key under the same id is picked up after the cached one fails
+	old := m.rsa
+	var err error
+	if m.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.keys = map[string]crypto.PublicKey{"ec": &m.ec.PublicKey}
+	p.mu.Unlock()
+	if _, err := p.Verify(context.Background(), m.token("n"), "n"); err != nil {
+		t.Errorf("rotated key: %s", err)
+	}
+	if p.keys["rsa"].(*rsa.PublicKey).N.Cmp(old.N) == 0 {
+		t.Error("old key still cached")
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	m := newMockIdP(t)
+	p := m.provider()
+	p.Issuer += "/"
+	if err := p.Discover(context.Background()); err == nil {
+		t.Error("metadata of other issuer accepted")
+	}
+}
+
+func TestAudience(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`"a"`, []string{"a"}},
+		{`["a","b"]`, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		var a audience
+		if err := json.Unmarshal([]byte(tt.in), &a); err != nil || strings.Join(a, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got %v, %v", tt.in, a, err)
+		}
+	}
+	var a audience
+	if err := json.Unmarshal([]byte(`1`), &a); err == nil {
+		t.Error("number accepted as audience")
+	}
+}
@@ -0,0 +1,171 @@
+// Package poster validates uploaded movie posters and other movie images and produces resized
+// versions of them. Every size is re-encoded as JPEG, which also drops EXIF and other metadata of the upload
+package poster
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+type Size string
+
+const (
+	Full  Size = "full"  //Fits into FullWidth x FullHeight keeping aspect ratio
+	Thumb Size = "thumb" //Exactly ThumbWidth x ThumbHeight, cropped to fill
+)
+
+var Sizes = []Size{Full, Thumb}
+
+const (
+	MaxUploadSize int64 = 5 << 20
+	MinWidth      int   = 100
+	MinHeight     int   = 150
+	MaxPixels     int   = 40_000_000 //Guards against images that are small files but huge bitmaps
+	FullWidth     int   = 1000
+	FullHeight    int   = 1500
+	ThumbWidth    int   = 120
+	ThumbHeight   int   = 180
+	ContentType         = "image/jpeg"
+	jpegQuality   int   = 85
+)
+
+// Layout describes limits and output sizes for one shape of images
+type Layout struct {
+	MinWidth, MinHeight     int
+	FullWidth, FullHeight   int  //Full size fits into these keeping aspect ratio
+	ThumbWidth, ThumbHeight int  //Thumbnail is cropped to exactly these
+	CropFull                bool //Full size is cropped to FullWidth:FullHeight aspect ratio too
+}
+
+var (
+	// Portrait is the layout of posters
+	Portrait = Layout{MinWidth, MinHeight, FullWidth, FullHeight, ThumbWidth, ThumbHeight, false}
+	// Landscape is the layout of backdrops and stills
+	Landscape = Layout{320, 180, 1920, 1080, 320, 180, false}
+	// Square is the layout of user avatars
+	Square = Layout{64, 64, 256, 256, 48, 48, true}
+)
+
+var (
+	ErrFormat      = errors.New("poster must be a png, jpeg or webp image")
+	ErrTooSmall    = errors.New("poster is too small")
+	ErrTooLarge    = errors.New("poster is too large")
+	ErrUnknownSize = errors.New("unknown poster size")
+)
+
+// ParseSize converts query value to Size. Empty value means full size
+func ParseSize(s string) (Size, error) {
+	switch Size(s) {
+	case "", Full:
+		return Full, nil
+	case Thumb:
+		return Thumb, nil
+	}
+	return "", ErrUnknownSize
+}
+
+// Decode validates format and dimensions of a poster upload before decoding it
+func Decode(data []byte) (image.Image, error) {
+	return Portrait.Decode(data)
+}
+
+// Process decodes a poster upload and returns encoded image for every size
+func Process(data []byte) (map[Size][]byte, error) {
+	return Portrait.Process(data)
+}
+
+// Resize scales a poster for the size
+func Resize(src image.Image, size Size) image.Image {
+	return Portrait.Resize(src, size)
+}
+
+// Decode validates format and dimensions of the upload before decoding it
+func (l Layout) Decode(data []byte) (image.Image, error) {
+	if int64(len(data)) > MaxUploadSize {
+		return nil, ErrTooLarge
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "png" && format != "jpeg" && format != "webp") {
+		return nil, ErrFormat
+	}
+	if cfg.Width < l.MinWidth || cfg.Height < l.MinHeight {
+		return nil, ErrTooSmall
+	}
+	if cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrFormat
+	}
+	return img, nil
+}
+
+// Process decodes the upload and returns encoded image for every size
+func (l Layout) Process(data []byte) (map[Size][]byte, error) {
+	img, err := l.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[Size][]byte, len(Sizes))
+	for _, size := range Sizes {
+		buf := &bytes.Buffer{}
+		if err := jpeg.Encode(buf, l.Resize(img, size), &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, err
+		}
+		out[size] = buf.Bytes()
+	}
+	return out, nil
+}
+
+// Resize scales image for the size. Transparent areas become white since JPEG has no alpha
+func (l Layout) Resize(src image.Image, size Size) image.Image {
+	b := src.Bounds()
+	srcRect := b
+	var w, h int
+	switch size {
+	case Thumb:
+		w, h = l.ThumbWidth, l.ThumbHeight
+		srcRect = cropToAspect(b, w, h)
+	default:
+		if l.CropFull {
+			srcRect = cropToAspect(b, l.FullWidth, l.FullHeight)
+		}
+		w, h = fit(srcRect.Dx(), srcRect.Dy(), l.FullWidth, l.FullHeight)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, srcRect, draw.Over, nil)
+	return dst
+}
+
+// fit returns dimensions of w x h scaled down to fit into maxW x maxH. Smaller images aren't enlarged
+func fit(w, h, maxW, maxH int) (int, int) {
+	if w <= maxW && h <= maxH {
+		return w, h
+	}
+	if w*maxH > h*maxW {
+		return maxW, max(1, h*maxW/w)
+	}
+	return max(1, w*maxH/h), maxH
+}
+
+// cropToAspect returns the centered part of r with w:h aspect ratio
+func cropToAspect(r image.Rectangle, w, h int) image.Rectangle {
+	dx, dy := r.Dx(), r.Dy()
+	if dx*h > dy*w {
+		cw := dy * w / h
+		x := r.Min.X + (dx-cw)/2
+		return image.Rect(x, r.Min.Y, x+cw, r.Max.Y)
+	}
+	ch := dx * h / w
+	y := r.Min.Y + (dy-ch)/2
+	return image.Rect(r.Min.X, y, r.Max.X, y+ch)
+}
@@ -0,0 +1,227 @@
+package poster
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"movie_db/blob"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testImage(w, h int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for x := range w {
+		for y := range h {
+			img.Set(x, y, color.NRGBA{uint8(x), uint8(y), 100, 255})
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcess(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		wantErr  error
+		wantFull image.Point
+	}{
+		{name: "PNG", data: encodePNG(t, testImage(200, 300)), wantFull: image.Pt(200, 300)},
+		{name: "JPEG", data: encodeJPEG(t, testImage(300, 300)), wantFull: image.Pt(300, 300)},
+		{name: "Large PNG", data: encodePNG(t, testImage(2000, 1500)), wantFull: image.Pt(1000, 750)},
+		{name: "Too small", data: encodePNG(t, testImage(50, 300)), wantErr: ErrTooSmall},
+		{name: "Not an image", data: []byte("GIF89a not really"), wantErr: ErrFormat},
+		{name: "Too large file", data: make([]byte, MaxUploadSize+1), wantErr: ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Process(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Process() error = %v, want %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			for size, want := range map[Size]image.Point{Full: tt.wantFull, Thumb: image.Pt(ThumbWidth, ThumbHeight)} {
+				cfg, format, err := image.DecodeConfig(bytes.NewReader(got[size]))
+				if err != nil || format != "jpeg" {
+					t.Errorf("Process() %s is not a jpeg: %v", size, err)
+					continue
+				}
+				if image.Pt(cfg.Width, cfg.Height) != want {
+					t.Errorf("Process() %s = %dx%d, want %v", size, cfg.Width, cfg.Height, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCropToAspect(t *testing.T) {
+	tests := []struct {
+		name string
+		r    image.Rectangle
+		want image.Rectangle
+	}{
+		{name: "Wide", r: image.Rect(0, 0, 400, 300), want: image.Rect(100, 0, 300, 300)},
+		{name: "Tall", r: image.Rect(0, 0, 200, 600), want: image.Rect(0, 150, 200, 450)},
+		{name: "Exact", r: image.Rect(0, 0, 120, 180), want: image.Rect(0, 0, 120, 180)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cropToAspect(tt.r, 2, 3); got != tt.want {
+				t.Errorf("cropToAspect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	blobs, err := blob.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Store{Blobs: blobs}
+	if _, _, err := s.Open(ctx, 1, Full); err != blob.ErrNotFound {
+		t.Errorf("Open() of missing poster error = %v", err)
+	}
+	legacy := t.TempDir()
+	if err := os.WriteFile(filepath.Join(legacy, "2.png"), []byte("legacy"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Import(ctx, legacy); n != 1 || err != nil {
+		t.Fatalf("Import() = %d, %v", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(legacy, "2.png")); !os.IsNotExist(err) {
+		t.Errorf("Imported file was not removed")
+	}
+	r, info, err := s.Open(ctx, 2, Thumb)
+	if err != nil || info.ContentType != "image/png" {
+		t.Fatalf("Open() of legacy poster = %+v, %v", info, err)
+	}
+	r.Close()
+	images, err := Process(encodePNG(t, testImage(200, 300)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(ctx, 2, images); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	for _, size := range Sizes {
+		r, info, err := s.Open(ctx, 2, size)
+		if err != nil || info.ContentType != ContentType {
+			t.Errorf("Open(%s) = %+v, %v", size, info, err)
+			continue
+		}
+		r.Close()
+	}
+	if err := s.Delete(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Open(ctx, 2, Full); err != blob.ErrNotFound {
+		t.Errorf("Open() after Delete() error = %v", err)
+	}
+}
+
+func TestLandscape(t *testing.T) {
+	images, err := Landscape.Process(encodePNG(t, testImage(3840, 2160)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for size, want := range map[Size]image.Point{Full: image.Pt(1920, 1080), Thumb: image.Pt(320, 180)} {
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(images[size]))
+		if err != nil || image.Pt(cfg.Width, cfg.Height) != want {
+			t.Errorf("Landscape.Process() %s = %dx%d, %v, want %v", size, cfg.Width, cfg.Height, err, want)
+		}
+	}
+	if _, err := Landscape.Process(encodePNG(t, testImage(200, 300))); err != ErrTooSmall {
+		t.Errorf("Landscape.Process() of a poster sized image error = %v, want ErrTooSmall", err)
+	}
+}
+
+func TestSquare(t *testing.T) {
+	images, err := Square.Process(encodePNG(t, testImage(400, 300)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for size, want := range map[Size]image.Point{Full: image.Pt(256, 256), Thumb: image.Pt(48, 48)} {
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(images[size]))
+		if err != nil || image.Pt(cfg.Width, cfg.Height) != want {
+			t.Errorf("Square.Process() %s = %dx%d, %v, want %v", size, cfg.Width, cfg.Height, err, want)
+		}
+	}
+}
+
+func TestStoreMediaAndAvatars(t *testing.T) {
+	ctx := context.Background()
+	blobs, err := blob.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Store{Blobs: blobs}
+	images := map[Size][]byte{Full: []byte("full"), Thumb: []byte("thumb")}
+	for _, mediaId := range []int{1, 2} {
+		if err := s.SaveMedia(ctx, 7, mediaId, images); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SaveMedia(ctx, 8, 3, images); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := s.OpenMedia(ctx, 7, 2, Thumb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "thumb" {
+		t.Errorf("OpenMedia() = %q", data)
+	}
+	if err := s.DeleteMedia(ctx, 7, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.OpenMedia(ctx, 7, 1, Full); err != blob.ErrNotFound {
+		t.Errorf("OpenMedia() after DeleteMedia() error = %v", err)
+	}
+	if err := s.DeleteMovie(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := blobs.List(ctx, "media/"); len(list) != 2 || list[0].Key != "media/8/3.jpg" {
+		t.Errorf("blobs after DeleteMovie() = %+v", list)
+	}
+	if err := s.SaveAvatar(ctx, 7, images); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.OpenAvatar(ctx, 7, Thumb); err != nil {
+		t.Errorf("OpenAvatar() error = %v", err)
+	}
+	if err := s.DeleteAvatar(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.OpenAvatar(ctx, 7, Full); err != blob.ErrNotFound {
+		t.Errorf("OpenAvatar() after DeleteAvatar() error = %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package poster
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"movie_db/blob"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Store keeps processed posters in a blob store under posters/{id}.jpg and posters/{id}_thumb.jpg.
+// Other images of a movie are kept under media/{movieId}/{mediaId}.jpg and media/{movieId}/{mediaId}_thumb.jpg,
+// user avatars under avatars/{userId}.jpg and avatars/{userId}_thumb.jpg
+type Store struct {
+	Blobs blob.Store
+}
+
+func key(id int, size Size) string {
+	return "posters/" + sizedName(id, size)
+}
+
+func mediaPrefix(movieId int) string {
+	return "media/" + strconv.Itoa(movieId) + "/"
+}
+
+func mediaKey(movieId, mediaId int, size Size) string {
+	return mediaPrefix(movieId) + sizedName(mediaId, size)
+}
+
+func sizedName(id int, size Size) string {
+	name := strconv.Itoa(id)
+	if size != Full {
+		name += "_" + string(size)
+	}
+	return name + ".jpg"
+}
+
+// legacyKey is where posters uploaded before thumbnails existed are kept. They are served for every size
+func legacyKey(id int) string {
+	return "posters/" + strconv.Itoa(id) + ".png"
+}
+
+// Save writes all sizes of the poster. Each blob is replaced atomically so readers never get a partial image
+func (s Store) Save(ctx context.Context, id int, images map[Size][]byte) error {
+	for _, size := range Sizes {
+		if _, err := s.Blobs.Put(ctx, key(id, size), bytes.NewReader(images[size]), ContentType); err != nil {
+			return err
+		}
+	}
+	//Legacy poster would otherwise come back after the new one is deleted
+	return s.Blobs.Delete(ctx, legacyKey(id))
+}
+
+// Open returns poster of the size. Error is blob.ErrNotFound if the movie has no poster
+func (s Store) Open(ctx context.Context, id int, size Size) (io.ReadCloser, blob.Info, error) {
+	r, info, err := s.Blobs.Get(ctx, key(id, size))
+	if err == blob.ErrNotFound {
+		return s.Blobs.Get(ctx, legacyKey(id))
+	}
+	return r, info, err
+}
+
+// Delete removes all sizes of the poster
+func (s Store) Delete(ctx context.Context, id int) error {
+	keys := []string{legacyKey(id)}
+	for _, size := range Sizes {
+		keys = append(keys, key(id, size))
+	}
+	for _, k := range keys {
+		if err := s.Blobs.Delete(ctx, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveMedia writes all sizes of a movie image
+func (s Store) SaveMedia(ctx context.Context, movieId, mediaId int, images map[Size][]byte) error {
+	for _, size := range Sizes {
+		if _, err := s.Blobs.Put(ctx, mediaKey(movieId, mediaId, size), bytes.NewReader(images[size]), ContentType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenMedia returns movie image of the size. Error is blob.ErrNotFound if the image doesn't exist
+func (s Store) OpenMedia(ctx context.Context, movieId, mediaId int, size Size) (io.ReadCloser, blob.Info, error) {
+	return s.Blobs.Get(ctx, mediaKey(movieId, mediaId, size))
+}
+
+// DeleteMedia removes all sizes of a movie image
+func (s Store) DeleteMedia(ctx context.Context, movieId, mediaId int) error {
+	for _, size := range Sizes {
+		if err := s.Blobs.Delete(ctx, mediaKey(movieId, mediaId, size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteMovie removes the poster and all other images of the movie
+func (s Store) DeleteMovie(ctx context.Context, movieId int) error {
+	if err := s.Delete(ctx, movieId); err != nil {
+		return err
+	}
+	list, err := s.Blobs.List(ctx, mediaPrefix(movieId))
+	if err != nil {
+		return err
+	}
+	for _, info := range list {
+		if err := s.Blobs.Delete(ctx, info.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func avatarKey(userId int, size Size) string {
+	return "avatars/" + sizedName(userId, size)
+}
+
+// SaveAvatar writes all sizes of the user avatar
+func (s Store) SaveAvatar(ctx context.Context, userId int, images map[Size][]byte) error {
+	for _, size := range Sizes {
+		if _, err := s.Blobs.Put(ctx, avatarKey(userId, size), bytes.NewReader(images[size]), ContentType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenAvatar returns user avatar of the size. Error is blob.ErrNotFound if the user has no avatar
+func (s Store) OpenAvatar(ctx context.Context, userId int, size Size) (io.ReadCloser, blob.Info, error) {
+	return s.Blobs.Get(ctx, avatarKey(userId, size))
+}
+
+// DeleteAvatar removes all sizes of the user avatar
+func (s Store) DeleteAvatar(ctx context.Context, userId int) error {
+	for _, size := range Sizes {
+		if err := s.Blobs.Delete(ctx, avatarKey(userId, size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import moves poster files of the old on-disk layout from dir into the store and returns how many were moved.
+// Missing dir is not an error
+func (s Store) Import(ctx context.Context, dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, e := range entries {
+		name := e.Name()
+		contentType := ContentType
+		switch {
+		case e.IsDir():
+			continue
+		case strings.HasSuffix(name, ".png"):
+			contentType = "image/png"
+		case !strings.HasSuffix(name, ".jpg"):
+			continue
+		}
+		p := filepath.Join(dir, name)
+		f, err := os.Open(p)
+		if err != nil {
+			return moved, err
+		}
+		_, err = s.Blobs.Put(ctx, "posters/"+name, f, contentType)
+		f.Close()
+		if err != nil {
+			return moved, err
+		}
+		if err := os.Remove(p); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
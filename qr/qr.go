@@ -0,0 +1,432 @@
+// Package qr encodes short texts, like otpauth provisioning URIs, into QR codes.
+// Only byte mode with error correction level M and versions 1 to 10 are supported
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrTooLong = errors.New("qr: text too long")
+
+const maxVersion = 10
+
+// Error correction codewords per block and data codewords per block for level M, by version
+var blocks = [maxVersion + 1]struct {
+	ecLen  int
+	groups [][2]int //block count, data codewords per block
+}{
+	{},
+	{10, [][2]int{{1, 16}}},
+	{16, [][2]int{{1, 28}}},
+	{26, [][2]int{{1, 44}}},
+	{18, [][2]int{{2, 32}}},
+	{24, [][2]int{{2, 43}}},
+	{16, [][2]int{{4, 27}}},
+	{18, [][2]int{{4, 31}}},
+	{22, [][2]int{{2, 38}, {2, 39}}},
+	{22, [][2]int{{3, 36}, {2, 37}}},
+	{26, [][2]int{{4, 43}, {1, 44}}},
+}
+
+// Centers of alignment patterns, by version
+var alignment = [maxVersion + 1][]int{
+	{}, {}, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34}, {6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// Code is a square of modules, dark modules are true
+type Code struct {
+	Size    int
+	Version int
+	Mask    int
+	modules []bool
+}
+
+func (c *Code) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.modules[y*c.Size+x]
+}
+
+// SVG draws the code with a quiet zone of border modules, one unit per module
+func (c *Code) SVG(border int) string {
+	n := c.Size + 2*border
+	b := &strings.Builder{}
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, n, n)
+	fmt.Fprintf(b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y := range c.Size {
+		for x := range c.Size {
+			if c.Dark(x, y) {
+				fmt.Fprintf(b, "M%d %dh1v1h-1z", x+border, y+border)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String()
+}
+
+func dataCodewords(version int) int {
+	n := 0
+	for _, g := range blocks[version].groups {
+		n += g[0] * g[1]
+	}
+	return n
+}
+
+// Encode picks the smallest version fitting the text and the mask with the lowest penalty
+func Encode(text string) (*Code, error) {
+	version := 0
+	for v := 1; v <= maxVersion; v++ {
+		countBits := 8
+		if v > 9 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(text) <= 8*dataCodewords(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+	codewords := interleave(version, encodeData(version, []byte(text)))
+
+	best := (*Code)(nil)
+	bestPenalty := 0
+	for mask := range 8 {
+		c, function := newCode(version)
+		c.placeData(codewords, function)
+		c.applyMask(mask, function)
+		c.drawFormat(mask)
+		if p := c.penalty(); best == nil || p < bestPenalty {
+			best, bestPenalty = c, p
+		}
+	}
+	return best, nil
+}
+
+type bitBuffer []bool
+
+func (b *bitBuffer) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (v>>i)&1 == 1)
+	}
+}
+
+// encodeData returns data codewords: mode, length, text, terminator and padding
+func encodeData(version int, data []byte) []byte {
+	capacity := dataCodewords(version) * 8
+	bits := bitBuffer{}
+	bits.append(0b0100, 4)
+	if version > 9 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, d := range data {
+		bits.append(int(d), 8)
+	}
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	result := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			result[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return result
+}
+
+// interleave splits data into blocks, adds error correction and interleaves codewords of the blocks
+func interleave(version int, data []byte) []byte {
+	ecLen := blocks[version].ecLen
+	divisor := rsDivisor(ecLen)
+	dataBlocks, ecBlocks := [][]byte{}, [][]byte{}
+	maxLen := 0
+	for _, g := range blocks[version].groups {
+		for range g[0] {
+			block := data[:g[1]]
+			data = data[g[1]:]
+			dataBlocks = append(dataBlocks, block)
+			ecBlocks = append(ecBlocks, rsRemainder(block, divisor))
+			maxLen = max(maxLen, len(block))
+		}
+	}
+	result := []byte{}
+	for i := range maxLen {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := range ecLen {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor returns coefficients of the Reed-Solomon generator polynomial without the leading term
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for range degree {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= gfMultiply(coef, factor)
+		}
+	}
+	return result
+}
+
+// newCode draws function patterns and returns which modules are reserved for them
+func newCode(version int) (*Code, []bool) {
+	size := 17 + 4*version
+	c := &Code{Size: size, Version: version, modules: make([]bool, size*size)}
+	function := make([]bool, size*size)
+	set := func(x, y int, dark bool) {
+		c.modules[y*size+x] = dark
+		function[y*size+x] = true
+	}
+	for i := range size {
+		set(6, i, i%2 == 0)
+		set(i, 6, i%2 == 0)
+	}
+	//Finder patterns with separators
+	for _, center := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := center[0]+dx, center[1]+dy
+				if x >= 0 && y >= 0 && x < size && y < size {
+					dist := max(abs(dx), abs(dy))
+					set(x, y, dist != 2 && dist != 4)
+				}
+			}
+		}
+	}
+	positions := alignment[version]
+	last := len(positions) - 1
+	for i, cy := range positions {
+		for j, cx := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	//Format areas are reserved now and drawn after masking
+	for i := range 9 {
+		if i != 6 {
+			set(8, i, false)
+			set(i, 8, false)
+		}
+	}
+	for i := range 8 {
+		set(size-1-i, 8, false)
+		set(8, size-1-i, false)
+	}
+	set(8, size-8, true)
+	if version >= 7 {
+		bits := versionBits(version)
+		for i := range 18 {
+			dark := (bits>>i)&1 == 1
+			a, b := size-11+i%3, i/3
+			set(a, b, dark)
+			set(b, a, dark)
+		}
+	}
+	return c, function
+}
+
+// placeData fills non function modules in the zigzag order, from bottom right corner
+func (c *Code) placeData(codewords []byte, function []bool) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := range c.Size {
+			for j := range 2 {
+				x, y := right-j, vert
+				if upward {
+					y = c.Size - 1 - vert
+				}
+				if function[y*c.Size+x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[y*c.Size+x] = (codewords[i/8]>>(7-i%8))&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+func maskBit(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (y/2+x/3)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+func (c *Code) applyMask(mask int, function []bool) {
+	c.Mask = mask
+	for y := range c.Size {
+		for x := range c.Size {
+			if !function[y*c.Size+x] && maskBit(mask, x, y) {
+				c.modules[y*c.Size+x] = !c.modules[y*c.Size+x]
+			}
+		}
+	}
+}
+
+// formatBits returns 15 bits of level M and the mask protected by BCH code
+func formatBits(mask int) int {
+	const levelM = 0b00
+	data := levelM<<3 | mask
+	rem := data
+	for range 10 {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func versionBits(version int) int {
+	rem := version
+	for range 12 {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+func (c *Code) drawFormat(mask int) {
+	bits := formatBits(mask)
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+	set := func(x, y int, dark bool) { c.modules[y*c.Size+x] = dark }
+	for i := range 6 {
+		set(8, i, bit(i))
+	}
+	set(8, 7, bit(6))
+	set(8, 8, bit(7))
+	set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		set(14-i, 8, bit(i))
+	}
+	for i := range 8 {
+		set(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		set(8, c.Size-15+i, bit(i))
+	}
+	set(8, c.Size-8, true)
+}
+
+// penalty scores the code by rules of the standard, codes with lower penalty are easier to scan
+func (c *Code) penalty() int {
+	const n1, n2, n3, n4 = 3, 3, 40, 10
+	result := 0
+	finderLike := []string{"10111010000", "00001011101"}
+	for _, vertical := range []bool{false, true} {
+		for a := range c.Size {
+			line := make([]byte, c.Size)
+			run := 0
+			for b := range c.Size {
+				x, y := b, a
+				if vertical {
+					x, y = a, b
+				}
+				line[b] = '0'
+				if c.Dark(x, y) {
+					line[b] = '1'
+				}
+				if b > 0 && line[b] == line[b-1] {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					result += n1
+				} else if run > 5 {
+					result++
+				}
+			}
+			for _, p := range finderLike {
+				result += n3 * strings.Count(string(line), p)
+			}
+		}
+	}
+	dark := 0
+	for y := range c.Size {
+		for x := range c.Size {
+			d := c.Dark(x, y)
+			if d {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size && d == c.Dark(x+1, y) && d == c.Dark(x, y+1) && d == c.Dark(x+1, y+1) {
+				result += n2
+			}
+		}
+	}
+	total := c.Size * c.Size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return result + k*n4
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
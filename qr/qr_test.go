@@ -0,0 +1,138 @@
+package qr
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRSRemainder(t *testing.T) {
+	//HELLO WORLD in alphanumeric mode, version 1-M
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("rsRemainder() = %v, want %v", got, want)
+	}
+}
+
+func TestFormatBits(t *testing.T) {
+	want := []int{
+		0b101010000010010, 0b101000100100101, 0b101111001111100, 0b101101101001011,
+		0b100010111111001, 0b100000011001110, 0b100111110010111, 0b100101010100000,
+	}
+	for mask, w := range want {
+		if got := formatBits(mask); got != w {
+			t.Errorf("formatBits(%d) = %015b, want %015b", mask, got, w)
+		}
+	}
+	if got, want := versionBits(7), 0b000111110010010100; got != want {
+		t.Errorf("versionBits(7) = %018b, want %018b", got, want)
+	}
+}
+
+func TestEncodeData(t *testing.T) {
+	got := encodeData(1, []byte("hi"))
+	want := []byte{0x40, 0x26, 0x86, 0x90, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	if !bytes.Equal(got, want) {
+		t.Errorf("encodeData() = %x, want %x", got, want)
+	}
+}
+
+// readBack reads codewords from the modules in placement order and removes the mask
+func readBack(c *Code) []byte {
+	_, function := newCode(c.Version)
+	result := []byte{}
+	var cur byte
+	n := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := range c.Size {
+			for j := range 2 {
+				x, y := right-j, vert
+				if upward {
+					y = c.Size - 1 - vert
+				}
+				if function[y*c.Size+x] {
+					continue
+				}
+				bit := c.Dark(x, y) != maskBit(c.Mask, x, y)
+				cur <<= 1
+				if bit {
+					cur |= 1
+				}
+				if n++; n%8 == 0 {
+					result = append(result, cur)
+					cur = 0
+				}
+			}
+		}
+	}
+	return result
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		version int
+	}{
+		{"short", "hi", 1},
+		{"version 1 limit", strings.Repeat("a", 14), 1},
+		{"version 2", strings.Repeat("a", 15), 2},
+		{"otpauth", "otpauth://totp/Movie%20DB:someone?secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP&issuer=Movie%20DB&algorithm=SHA1&digits=6&period=30", 8},
+		{"version 10", strings.Repeat("a", 200), 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Encode(tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Version != tt.version || c.Size != 17+4*tt.version {
+				t.Fatalf("version %d size %d, want version %d", c.Version, c.Size, tt.version)
+			}
+			want := interleave(c.Version, encodeData(c.Version, []byte(tt.text)))
+			if got := readBack(c); !bytes.HasPrefix(got, want) {
+				t.Errorf("codewords read back differ")
+			}
+			//Both copies of format information
+			bits := formatBits(c.Mask)
+			for i := range 8 {
+				if c.Dark(c.Size-1-i, 8) != ((bits>>i)&1 == 1) {
+					t.Errorf("format bit %d differs", i)
+				}
+			}
+			for i := range 6 {
+				if c.Dark(8, i) != ((bits>>i)&1 == 1) {
+					t.Errorf("format bit %d differs in the second copy", i)
+				}
+			}
+			//Finder pattern corners and timing
+			for _, p := range [][2]int{{0, 0}, {6, 6}, {c.Size - 1, 0}, {0, c.Size - 1}, {8, c.Size - 8}, {8, 6}, {6, 8}} {
+				if !c.Dark(p[0], p[1]) {
+					t.Errorf("module %v must be dark", p)
+				}
+			}
+			if c.Dark(7, 7) || c.Dark(9, 6) {
+				t.Errorf("separator or timing module must be light")
+			}
+		})
+	}
+	if _, err := Encode(strings.Repeat("a", 214)); err != ErrTooLong {
+		t.Errorf("got %v, want %v", err, ErrTooLong)
+	}
+}
+
+func TestSVG(t *testing.T) {
+	c, err := Encode("hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := c.SVG(4)
+	if !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, `viewBox="0 0 29 29"`) || !strings.Contains(svg, "M4 4h1v1h-1z") {
+		t.Errorf("unexpected svg: %s", svg)
+	}
+}
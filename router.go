@@ -10,6 +10,7 @@ import (
 func loadRoutes(router *http.ServeMux) {
 	publicStack := middleware.CreateStack(
 		middleware.Logging,
+		middleware.Activity,
 	)
 	protectedStack := middleware.CreateStack(
 		publicStack,
@@ -21,7 +22,6 @@ func loadRoutes(router *http.ServeMux) {
 	)
 
 	handler := &movie.Handler{}
-	fileHandler := http.StripPrefix("/static/", http.FileServer(http.Dir("static")))
 	//public routes
 	public := http.NewServeMux()
 	public.HandleFunc("/{$}", handler.GetIndex)
@@ -30,24 +30,93 @@ func loadRoutes(router *http.ServeMux) {
 	public.HandleFunc(`POST /movies/`, handler.GetAllMoviesHTMX)
 	public.HandleFunc(`POST /movies/reload`, handler.RealodSearchCatalog)
 	public.HandleFunc("GET /movie/poster/{id}", handler.GetPoster)
+	public.HandleFunc("GET /movie/{id}/media/{mediaId}", handler.GetMediaImage)
 	public.HandleFunc("GET /movie/{id}/comments/{last_comment_id}", handler.GetComments)
+	public.HandleFunc("GET /movie/{id}/comments/live", handler.GetCommentStream)
 	public.HandleFunc("GET /movie/comment/{commentId}", handler.GetComment)
+	public.HandleFunc("GET /comment/{commentId}/replies/{last_reply_id}", handler.GetReplies)
 	public.HandleFunc("POST /search", handler.SearchByTitle)
 	public.HandleFunc("POST /user/register", handler.PostRegister)
 	public.HandleFunc("GET /user/register", handler.GetRegistrationPage)
 	public.HandleFunc("POST /user/login", handler.Login)
 	public.HandleFunc("GET /user/{id}", handler.GetUserPage)
 	public.HandleFunc("GET /user/userinfo", handler.GetUserInfo)
+	public.HandleFunc("GET /user/{id}/watchlist", handler.GetWatchlistPage)
+	public.HandleFunc("GET /user/{id}/diary", handler.GetDiaryPage)
+	public.HandleFunc("GET /user/{id}/avatar", handler.GetAvatar)
+	public.HandleFunc("GET /list/{slug}", handler.GetListPage)
 	public.HandleFunc("GET /login", handler.GetLoginPage)
+	public.HandleFunc("GET /login/2fa", handler.GetLoginTwoFactorPage)
+	public.HandleFunc("POST /login/2fa", handler.LoginTwoFactor)
+	public.HandleFunc("POST /login/passkey/options", handler.PasskeyLoginOptions)
+	public.HandleFunc("POST /login/passkey", handler.LoginPasskey)
+	public.HandleFunc("GET /login/oidc/{provider}", handler.LoginOIDC)
+	public.HandleFunc("GET /login/oidc/{provider}/callback", handler.OIDCCallback)
+	public.HandleFunc("GET /password/forgot", handler.GetForgotPasswordPage)
+	public.HandleFunc("POST /password/forgot", handler.ForgotPassword)
+	public.HandleFunc("GET /password/reset", handler.GetResetPasswordPage)
+	public.HandleFunc("POST /password/reset", handler.ResetPassword)
+	public.HandleFunc("GET /email/verify", handler.VerifyEmail)
 	public.HandleFunc("GET /empty", handler.EmptyResponse)
 	//routes that require auth
 	protected := http.NewServeMux()
 	protected.HandleFunc("POST /user/logout", handler.Logout)
+	protected.HandleFunc("GET /account", handler.GetAccountPage)
+	protected.HandleFunc("PUT /account/password", handler.ChangePassword)
+	protected.HandleFunc("PUT /account/username", handler.ChangeUsername)
+	protected.HandleFunc("PUT /account/email", handler.ChangeEmail)
+	protected.HandleFunc("GET /account/2fa", handler.GetTwoFactorPage)
+	protected.HandleFunc("POST /account/2fa", handler.EnableTwoFactor)
+	protected.HandleFunc("POST /account/2fa/recovery", handler.RegenerateRecoveryCodes)
+	protected.HandleFunc("POST /account/2fa/disable", handler.DisableTwoFactor)
+	protected.HandleFunc("GET /account/passkeys", handler.GetPasskeysPage)
+	protected.HandleFunc("POST /account/passkeys/options", handler.PasskeyCreationOptions)
+	protected.HandleFunc("POST /account/passkeys", handler.PostPasskey)
+	protected.HandleFunc("PUT /account/passkeys/{id}", handler.RenamePasskey)
+	protected.HandleFunc("DELETE /account/passkeys/{id}", handler.DeletePasskey)
+	protected.HandleFunc("GET /account/sso", handler.GetSSOPage)
+	protected.HandleFunc("GET /account/sso/{provider}", handler.LinkOIDC)
+	protected.HandleFunc("POST /account/sso/{provider}/unlink", handler.UnlinkOIDC)
+	protected.HandleFunc("GET /account/sessions", handler.GetSessionsPage)
+	protected.HandleFunc("POST /account/sessions/logout", handler.LogoutEverywhere)
+	protected.HandleFunc("POST /account/sessions/{sessionId}/logout", handler.LogoutSession)
+	protected.HandleFunc("POST /account/delete", handler.DeleteAccount)
+	protected.HandleFunc("GET /account/export", handler.GetExportPage)
+	protected.HandleFunc("GET /account/export/list", handler.GetExportList)
+	protected.HandleFunc("POST /account/export", handler.PostExport)
+	protected.HandleFunc("GET /account/export/{exportId}", handler.DownloadExport)
 	protected.HandleFunc("POST /movie/comment", handler.PostComment)
 	protected.HandleFunc("GET /comment/edit/{commentId}", handler.GetCommentEditForm)
 	protected.HandleFunc("PUT /comment/edit", handler.UpdateComment)
+	protected.HandleFunc("GET /comment/revisions/{commentId}", handler.GetCommentRevisions)
+	protected.HandleFunc("POST /comment/{commentId}/react", handler.PostReaction)
+	protected.HandleFunc("POST /comment/{commentId}/report", handler.PostReport)
 	protected.HandleFunc("DELETE /comment/delete/{commentId}", handler.DeleteComment)
 	protected.HandleFunc("POST /movie/rate", handler.PostRateMovie)
+	protected.HandleFunc("POST /watchlist", handler.PostWatchlist)
+	protected.HandleFunc("DELETE /watchlist/{movieId}", handler.DeleteWatchlist)
+	protected.HandleFunc("PUT /watchlist/{movieId}/move", handler.MoveWatchlistEntry)
+	protected.HandleFunc("PUT /watchlist/{movieId}/note", handler.UpdateWatchlistNote)
+	protected.HandleFunc("POST /diary", handler.PostDiaryEntry)
+	protected.HandleFunc("DELETE /diary/{entryId}", handler.DeleteDiaryEntry)
+	protected.HandleFunc("PUT /user/privacy", handler.UpdatePrivacy)
+	protected.HandleFunc("PUT /user/profile", handler.UpdateProfile)
+	protected.HandleFunc("PUT /user/avatar", handler.UpdateAvatar)
+	protected.HandleFunc("DELETE /user/avatar", handler.DeleteAvatar)
+	protected.HandleFunc("POST /user/favorites", handler.PostFavorite)
+	protected.HandleFunc("DELETE /user/favorites/{movieId}", handler.DeleteFavorite)
+	protected.HandleFunc("POST /list", handler.PostList)
+	protected.HandleFunc("PUT /list/{slug}", handler.UpdateList)
+	protected.HandleFunc("DELETE /list/{slug}", handler.DeleteList)
+	protected.HandleFunc("POST /list/{slug}/fork", handler.ForkList)
+	protected.HandleFunc("POST /list/entry", handler.PostListEntry)
+	protected.HandleFunc("DELETE /list/{slug}/entries/{movieId}", handler.DeleteListEntry)
+	protected.HandleFunc("PUT /list/{slug}/entries/{movieId}/move", handler.MoveListEntry)
+	protected.HandleFunc("PUT /list/{slug}/entries/{movieId}/note", handler.UpdateListEntryNote)
+	protected.HandleFunc("GET /notifications", handler.GetNotificationsPage)
+	protected.HandleFunc("GET /notifications/{lastId}", handler.GetNotifications)
+	protected.HandleFunc("PUT /notifications/{notificationId}/read", handler.ReadNotification)
+	protected.HandleFunc("PUT /notifications/read", handler.ReadAllNotifications)
 	//admin routes
 	admin := http.NewServeMux()
 	admin.HandleFunc("GET /movie/add", handler.AddMoviePage)
@@ -56,11 +125,22 @@ func loadRoutes(router *http.ServeMux) {
 	admin.HandleFunc("PUT /movie/{id}", handler.UpdateMovie)
 	admin.HandleFunc("PUT /movie/poster/{id}", handler.UpdatePoster)
 	admin.HandleFunc("DELETE /movie/{id}", handler.DeleteMovie)
+	admin.HandleFunc("GET /movie/gallery/{id}", handler.GetGallery)
+	admin.HandleFunc("POST /movie/gallery/{id}", handler.PostMedia)
+	admin.HandleFunc("PUT /media/{mediaId}", handler.UpdateMediaCaption)
+	admin.HandleFunc("PUT /media/{mediaId}/primary", handler.SetPrimaryMedia)
+	admin.HandleFunc("PUT /media/{mediaId}/move", handler.MoveMedia)
+	admin.HandleFunc("DELETE /media/{mediaId}", handler.DeleteMedia)
 	admin.HandleFunc("POST /user/ban", handler.BanUser)
+	admin.HandleFunc("GET /user/{userId}/sessions", handler.GetUserSessions)
+	admin.HandleFunc("POST /user/{userId}/sessions/logout", handler.LogoutUser)
+	admin.HandleFunc("POST /user/{userId}/sessions/{sessionId}/logout", handler.LogoutUserSession)
+	admin.HandleFunc("GET /moderation", handler.GetModerationQueue)
+	admin.HandleFunc("POST /moderation/{commentId}", handler.ModerateComment)
 	//combining all routes
 	router.Handle("/", publicStack(public))
 	router.Handle("/auth/", http.StripPrefix("/auth", protectedStack(protected)))
 	router.Handle("/admin/", http.StripPrefix("/admin", adminStack(admin)))
 
-	router.Handle("/static/", fileHandler)
+	router.Handle("/static/", movie.Static)
 }
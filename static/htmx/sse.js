@@ -0,0 +1,82 @@
+/*
+  Minimal Server-Sent Events extension for htmx 2, compatible with the attributes
+  of the official htmx-ext-sse:
+    sse-connect="<url>"  opens an EventSource on the element
+    sse-swap="<event>"   swaps data of named events into the element using its hx-swap
+    sse-close="<event>"  closes the connection when the event arrives
+  Connections closed by the server are reopened with exponential backoff.
+*/
+(function () {
+  var api;
+  var maxRetryDelay = 60000;
+
+  function connect(elt, delay) {
+    var url = api.getAttributeValue(elt, "sse-connect");
+    if (!url) {
+      return;
+    }
+    var source = new EventSource(url);
+    api.getInternalData(elt).sseSource = source;
+
+    source.onopen = function () {
+      delay = 500;
+      api.triggerEvent(elt, "htmx:sseOpen", { source: source });
+    };
+    source.onerror = function (err) {
+      api.triggerEvent(elt, "htmx:sseError", { error: err, source: source });
+      if (source.readyState !== EventSource.CLOSED) {
+        return; //Browser reconnects by itself
+      }
+      setTimeout(function () {
+        if (elt.isConnected && api.getInternalData(elt).sseSource === source) {
+          connect(elt, Math.min(delay * 2, maxRetryDelay));
+        }
+      }, delay);
+    };
+
+    var closeOn = api.getAttributeValue(elt, "sse-close");
+    if (closeOn) {
+      source.addEventListener(closeOn, function () {
+        source.close();
+        api.triggerEvent(elt, "htmx:sseClose", { source: source });
+      });
+    }
+
+    var swapElts = [elt].concat(Array.prototype.slice.call(elt.querySelectorAll("[sse-swap]")));
+    swapElts.forEach(function (swapElt) {
+      var names = api.getAttributeValue(swapElt, "sse-swap");
+      if (!names) {
+        return;
+      }
+      names.split(",").forEach(function (name) {
+        source.addEventListener(name.trim(), function (event) {
+          if (!api.triggerEvent(swapElt, "htmx:sseBeforeMessage", event)) {
+            return;
+          }
+          htmx.swap(swapElt, event.data, api.getSwapSpecification(swapElt));
+          api.triggerEvent(swapElt, "htmx:sseMessage", event);
+        });
+      });
+    });
+  }
+
+  htmx.defineExtension("sse", {
+    init: function (internalAPI) {
+      api = internalAPI;
+    },
+    onEvent: function (name, evt) {
+      var elt = evt.target || evt.detail.elt;
+      if (name === "htmx:afterProcessNode" && elt.hasAttribute && elt.hasAttribute("sse-connect")) {
+        if (!api.getInternalData(elt).sseSource) {
+          connect(elt, 500);
+        }
+      } else if (name === "htmx:beforeCleanupElement") {
+        var source = api.getInternalData(elt).sseSource;
+        if (source) {
+          source.close();
+          delete api.getInternalData(elt).sseSource;
+        }
+      }
+    },
+  });
+})();
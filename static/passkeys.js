@@ -0,0 +1,87 @@
+// Passkey registration and login. Binary values are sent to the server as base64url strings.
+// Buttons with data-passkey="register" or "login" start a ceremony, errors are shown in the element
+// with id from data-result, name of a new passkey is read from the input with id from data-nickname
+// and remember me of a login from the checkbox with id from data-remember
+(function () {
+  function toBytes(s) {
+    const b64 = s.replace(/-/g, "+").replace(/_/g, "/");
+    return Uint8Array.from(atob(b64), c => c.charCodeAt(0));
+  }
+
+  function toBase64url(buffer) {
+    let s = "";
+    for (const b of new Uint8Array(buffer)) {
+      s += String.fromCharCode(b);
+    }
+    return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  }
+
+  async function post(url, body) {
+    const options = { method: "POST", credentials: "same-origin" };
+    if (body) {
+      options.headers = { "Content-Type": "application/json" };
+      options.body = JSON.stringify(body);
+    }
+    const response = await fetch(url, options);
+    if (!response.ok) {
+      throw new Error(await response.text());
+    }
+    return response;
+  }
+
+  async function register(button) {
+    const options = await (await post("/auth/account/passkeys/options")).json();
+    options.challenge = toBytes(options.challenge);
+    options.user.id = toBytes(options.user.id);
+    for (const c of options.excludeCredentials) {
+      c.id = toBytes(c.id);
+    }
+    const credential = await navigator.credentials.create({ publicKey: options });
+    const nickname = document.getElementById(button.dataset.nickname);
+    await post("/auth/account/passkeys", {
+      nickname: nickname ? nickname.value : "",
+      clientDataJSON: toBase64url(credential.response.clientDataJSON),
+      attestationObject: toBase64url(credential.response.attestationObject),
+    });
+    location.reload();
+  }
+
+  async function login(button) {
+    const options = await (await post("/login/passkey/options")).json();
+    options.challenge = toBytes(options.challenge);
+    for (const c of options.allowCredentials) {
+      c.id = toBytes(c.id);
+    }
+    const credential = await navigator.credentials.get({ publicKey: options });
+    const remember = document.getElementById(button.dataset.remember);
+    await post("/login/passkey", {
+      id: toBase64url(credential.rawId),
+      clientDataJSON: toBase64url(credential.response.clientDataJSON),
+      authenticatorData: toBase64url(credential.response.authenticatorData),
+      signature: toBase64url(credential.response.signature),
+      remember: remember ? remember.checked : false,
+    });
+    location.href = "/";
+  }
+
+  document.addEventListener("click", event => {
+    const button = event.target.closest("[data-passkey]");
+    if (!button) {
+      return;
+    }
+    event.preventDefault();
+    const result = document.getElementById(button.dataset.result);
+    const show = message => {
+      if (result) {
+        result.textContent = message;
+      }
+    };
+    if (!window.PublicKeyCredential) {
+      show("Your browser doesn't support passkeys.");
+      return;
+    }
+    show("");
+    const ceremony = button.dataset.passkey === "register" ? register(button) : login(button);
+    ceremony.catch(err => show(err.name === "NotAllowedError" ? "Passkey request was cancelled." : err.message));
+  });
+})();
@@ -0,0 +1,119 @@
+// Package totp implements time-based one-time passwords of RFC 6238 with defaults of authenticator apps:
+// SHA-1, 6 digits and 30 second steps
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30 * time.Second
+	// Skew is the number of steps accepted before and after the current one, for clock drift
+	Skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a random 160 bit secret in base32, as authenticator apps expect it
+func NewSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	return encoding.DecodeString(strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "=")))
+}
+
+// hotp computes HOTP value of RFC 4226
+func hotp(key []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for range digits {
+		mod *= 10
+	}
+	code := strconv.FormatUint(uint64(value%mod), 10)
+	return strings.Repeat("0", digits-len(code)) + code
+}
+
+// Counter returns the time step of t
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the password valid at t
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(Counter(t)), Digits), nil
+}
+
+// Verify checks the code around t and returns its time step. Steps up to last are rejected,
+// so a code can't be used twice when the caller keeps the last accepted step
+func Verify(secret, code string, t time.Time, last int64) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(code) != Digits {
+		return 0, false
+	}
+	now := Counter(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		if step <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step), Digits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth provisioning address, which authenticator apps read from a QR code
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", strconv.Itoa(Digits))
+	v.Set("period", strconv.Itoa(int(Period/time.Second)))
+	return "otpauth://totp/" + label + "?" + strings.ReplaceAll(v.Encode(), "+", "%20")
+}
+
+// RecoveryCodes returns n random single-use codes like "abcde-fghij"
+func RecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(encoding.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+// NormalizeRecoveryCode removes separators and case, so codes can be typed loosely
+func NormalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
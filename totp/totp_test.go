@@ -0,0 +1,119 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+var rfcKey = []byte("12345678901234567890")
+
+func TestHOTP(t *testing.T) {
+	//RFC 4226 appendix D
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, w := range want {
+		if got := hotp(rfcKey, uint64(counter), 6); got != w {
+			t.Errorf("hotp(%d) = %s, want %s", counter, got, w)
+		}
+	}
+}
+
+func TestTOTPVectors(t *testing.T) {
+	//RFC 6238 appendix B, SHA-1
+	tests := []struct {
+		name string
+		unix int64
+		want string
+	}{
+		{"59", 59, "94287082"},
+		{"1111111109", 1111111109, "07081804"},
+		{"1111111111", 1111111111, "14050471"},
+		{"1234567890", 1234567890, "89005924"},
+		{"2000000000", 2000000000, "69279037"},
+		{"20000000000", 20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hotp(rfcKey, uint64(Counter(time.Unix(tt.unix, 0))), 8); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString(rfcKey)
+	now := time.Unix(1111111111, 0)
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "050471" {
+		t.Fatalf("Code() = %s, want 050471", code)
+	}
+	tests := []struct {
+		name string
+		code string
+		at   time.Time
+		last int64
+		ok   bool
+	}{
+		{"current", code, now, 0, true},
+		{"previous step", code, now.Add(Period), 0, true},
+		{"next step", code, now.Add(-Period), 0, true},
+		{"too old", code, now.Add(2 * Period), 0, false},
+		{"replayed", code, now, Counter(now), false},
+		{"wrong", "000000", now, 0, false},
+		{"short", "12345", now, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Verify(secret, tt.code, tt.at, tt.last)
+			if ok != tt.ok {
+				t.Fatalf("Verify() = %v, want %v", ok, tt.ok)
+			}
+			if ok && step != Counter(now) {
+				t.Errorf("step = %d, want %d", step, Counter(now))
+			}
+		})
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("secret length %d, want 32", len(secret))
+	}
+	if _, err := Code(strings.ToLower(secret), time.Now()); err != nil {
+		t.Errorf("lower case secret: %s", err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	got := URI("Movie DB", "some one", "JBSWY3DPEHPK3PXP")
+	want := "otpauth://totp/Movie%20DB:some%20one?algorithm=SHA1&digits=6&issuer=Movie%20DB&period=30&secret=JBSWY3DPEHPK3PXP"
+	if got != want {
+		t.Errorf("URI() = %s, want %s", got, want)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := RecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, c := range codes {
+		if len(c) != 11 || c[5] != '-' || seen[c] {
+			t.Errorf("bad code %q", c)
+		}
+		seen[c] = true
+		if n := NormalizeRecoveryCode(" " + strings.ToUpper(c)); n != strings.Replace(c, "-", "", 1) {
+			t.Errorf("NormalizeRecoveryCode() = %q", n)
+		}
+	}
+}
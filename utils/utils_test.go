@@ -59,7 +59,7 @@ func TestPasswordAnalysis(t *testing.T) {
 		{name: "Test 3", args: args{password: "BullShit8373"}, want: false},
 		{name: "Test 4", args: args{password: "Whatever98367_"}, want: true},
 		{name: "Test 5", args: args{password: "H_))eroku88G,,GG"}, want: true},
-		{name: "Test 6", args: args{password: "GolangIsTheBasdfalhsdfh;lasdlfas;dlkfaslk;dfas;dfasdfasdfa;svcamsd,fa,smdnfasdfasdjfalskdfaskdflkjasdkfjhasdhfasdfhjlasestasdfac39asdf2349798jksdfvskjl", minLength: 8, maxLength: 128}, want: false},
+		{name: "Test 6", args: args{password: "GolangIsTheBasdfalhsdfh;lasdlfas;dlkfaslk;dfas;dfasdfasdfa;svcamsd,fa,smdnfasdfasdjfalskdfaskdflkjasdkfjhasdhfasdfhjlasestasdfac39asdf2349798jksdfvskjl"}, want: false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -95,3 +95,21 @@ func TestGenerateToken(t *testing.T) {
 		})
 	}
 }
+
+func TestHashToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{name: "Empty", token: "", want: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{name: "Token", token: "abc", want: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HashToken(tt.token); got != tt.want {
+				t.Errorf("HashToken() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var errCBOR = errors.New("webauthn: malformed CBOR")
+
+// maxDepth limits nesting of decoded items, authenticator data never nests deeply
+const maxDepth = 16
+
+// decodeCBOR decodes the first item of definite length CBOR used by authenticators and returns the rest.
+// Integers become int64, byte strings []byte, text strings string, arrays []any and maps map[any]any
+func decodeCBOR(b []byte) (any, []byte, error) {
+	return decodeItem(b, 0)
+}
+
+func decodeItem(b []byte, depth int) (any, []byte, error) {
+	if depth > maxDepth || len(b) == 0 {
+		return nil, nil, errCBOR
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(b) >= 1:
+		arg, b = uint64(b[0]), b[1:]
+	case info == 25 && len(b) >= 2:
+		arg, b = uint64(binary.BigEndian.Uint16(b)), b[2:]
+	case info == 26 && len(b) >= 4:
+		arg, b = uint64(binary.BigEndian.Uint32(b)), b[4:]
+	case info == 27 && len(b) >= 8:
+		arg, b = binary.BigEndian.Uint64(b), b[8:]
+	default:
+		return nil, nil, errCBOR
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return int64(arg), b, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(arg), b, nil
+	case 2, 3:
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBOR
+		}
+		if major == 2 {
+			return b[:arg], b[arg:], nil
+		}
+		return string(b[:arg]), b[arg:], nil
+	case 4:
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBOR
+		}
+		items := make([]any, 0, arg)
+		for range arg {
+			var item any
+			var err error
+			if item, b, err = decodeItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, b, nil
+	case 5:
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBOR
+		}
+		m := make(map[any]any, arg)
+		for range arg {
+			var key, value any
+			var err error
+			if key, b, err = decodeItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBOR
+			}
+			if value, b, err = decodeItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, b, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22:
+			return nil, b, nil
+		}
+	}
+	return nil, nil, errCBOR
+}
@@ -0,0 +1,361 @@
+// Package webauthn verifies passkey registration and login ceremonies of a relying party.
+// Attestation is not requested, so registered authenticators are trusted as they are
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"time"
+)
+
+var (
+	ErrChallenge  = errors.New("webauthn: challenge mismatch")
+	ErrOrigin     = errors.New("webauthn: origin mismatch")
+	ErrType       = errors.New("webauthn: wrong ceremony type")
+	ErrRPID       = errors.New("webauthn: relying party id mismatch")
+	ErrUser       = errors.New("webauthn: user not present or not verified")
+	ErrKey        = errors.New("webauthn: unsupported public key")
+	ErrSignature  = errors.New("webauthn: invalid signature")
+	ErrSignCount  = errors.New("webauthn: signature counter went back, authenticator may be cloned")
+	ErrMalformed  = errors.New("webauthn: malformed authenticator data")
+	ErrCredential = errors.New("webauthn: credential missing")
+)
+
+// COSE algorithm identifiers
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+// Authenticator data flags
+const (
+	flagUserPresent  byte = 0x01
+	flagUserVerified byte = 0x04
+	flagAttested     byte = 0x40
+)
+
+// Timeout is how long browsers wait for the user, challenges should live a bit longer
+const Timeout = 2 * time.Minute
+
+var b64 = base64.RawURLEncoding
+
+// Encode and Decode convert binary values to base64url used in JSON of the ceremonies
+func Encode(b []byte) string { return b64.EncodeToString(b) }
+
+func Decode(s string) ([]byte, error) { return b64.DecodeString(s) }
+
+// RelyingParty is the site. ID is the domain, Origin the exact scheme, host and port pages are served from
+type RelyingParty struct {
+	ID     string
+	Name   string
+	Origin string
+}
+
+type User struct {
+	ID          []byte //Opaque user handle, stored by authenticators of discoverable credentials
+	Name        string
+	DisplayName string
+}
+
+// Credential is a registered passkey
+type Credential struct {
+	ID        []byte
+	PublicKey []byte //COSE key
+	SignCount uint32
+}
+
+func NewChallenge() ([]byte, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+type rpEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type paramEntity struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type descriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type selection struct {
+	ResidentKey      string `json:"residentKey"`
+	RequireResident  bool   `json:"requireResidentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are publicKey options of navigator.credentials.create with binary values in base64url
+type CreationOptions struct {
+	Challenge              string        `json:"challenge"`
+	RP                     rpEntity      `json:"rp"`
+	User                   userEntity    `json:"user"`
+	PubKeyCredParams       []paramEntity `json:"pubKeyCredParams"`
+	Timeout                int64         `json:"timeout"`
+	ExcludeCredentials     []descriptor  `json:"excludeCredentials"`
+	AuthenticatorSelection selection     `json:"authenticatorSelection"`
+	Attestation            string        `json:"attestation"`
+}
+
+// RequestOptions are publicKey options of navigator.credentials.get with binary values in base64url
+type RequestOptions struct {
+	Challenge        string       `json:"challenge"`
+	RPID             string       `json:"rpId"`
+	Timeout          int64        `json:"timeout"`
+	AllowCredentials []descriptor `json:"allowCredentials"`
+	UserVerification string       `json:"userVerification"`
+}
+
+func descriptors(ids [][]byte) []descriptor {
+	result := make([]descriptor, len(ids))
+	for i, id := range ids {
+		result[i] = descriptor{"public-key", Encode(id)}
+	}
+	return result
+}
+
+// CreationOptions asks for a discoverable credential, so it can log in without a username.
+// Credentials in exclude are already registered and won't be created again on the same authenticator
+func (rp *RelyingParty) CreationOptions(user User, challenge []byte, exclude [][]byte) CreationOptions {
+	return CreationOptions{
+		Challenge: Encode(challenge),
+		RP:        rpEntity{rp.ID, rp.Name},
+		User:      userEntity{Encode(user.ID), user.Name, user.DisplayName},
+		PubKeyCredParams: []paramEntity{
+			{"public-key", AlgES256}, {"public-key", AlgEdDSA}, {"public-key", AlgRS256},
+		},
+		Timeout:                Timeout.Milliseconds(),
+		ExcludeCredentials:     descriptors(exclude),
+		AuthenticatorSelection: selection{"required", true, "required"},
+		Attestation:            "none",
+	}
+}
+
+// RequestOptions with empty allow lets the user pick any passkey of the site
+func (rp *RelyingParty) RequestOptions(challenge []byte, allow [][]byte) RequestOptions {
+	return RequestOptions{
+		Challenge:        Encode(challenge),
+		RPID:             rp.ID,
+		Timeout:          Timeout.Milliseconds(),
+		AllowCredentials: descriptors(allow),
+		UserVerification: "required",
+	}
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// ClientChallenge returns the challenge signed by the client, so the server can find the ceremony it belongs to.
+// The value must still be checked by VerifyRegistration or VerifyAssertion
+func ClientChallenge(clientDataJSON []byte) ([]byte, error) {
+	cd := clientData{}
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return nil, err
+	}
+	return Decode(cd.Challenge)
+}
+
+func (rp *RelyingParty) verifyClientData(clientDataJSON, challenge []byte, ceremony string) error {
+	cd := clientData{}
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return err
+	}
+	if cd.Type != ceremony {
+		return ErrType
+	}
+	if got, err := Decode(cd.Challenge); err != nil || !bytes.Equal(got, challenge) {
+		return ErrChallenge
+	}
+	if cd.Origin != rp.Origin {
+		return ErrOrigin
+	}
+	return nil
+}
+
+type authData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+func (rp *RelyingParty) parseAuthData(b []byte) (*authData, error) {
+	if len(b) < 37 {
+		return nil, ErrMalformed
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(b[:32], rpIDHash[:]) {
+		return nil, ErrRPID
+	}
+	ad := &authData{flags: b[32], signCount: binary.BigEndian.Uint32(b[33:37])}
+	if ad.flags&flagUserPresent == 0 || ad.flags&flagUserVerified == 0 {
+		return nil, ErrUser
+	}
+	if ad.flags&flagAttested == 0 {
+		return ad, nil
+	}
+	rest := b[37:]
+	if len(rest) < 18 {
+		return nil, ErrMalformed
+	}
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if n == 0 || len(rest) < n {
+		return nil, ErrMalformed
+	}
+	ad.credentialID = rest[:n]
+	_, after, err := decodeCBOR(rest[n:])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	ad.publicKey = rest[n : len(rest)-len(after)]
+	return ad, nil
+}
+
+// VerifyRegistration checks a new credential created for the challenge
+func (rp *RelyingParty) VerifyRegistration(challenge, clientDataJSON, attestationObject []byte) (*Credential, error) {
+	if err := rp.verifyClientData(clientDataJSON, challenge, "webauthn.create"); err != nil {
+		return nil, err
+	}
+	obj, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := obj.(map[any]any)
+	if !ok {
+		return nil, ErrMalformed
+	}
+	raw, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, ErrMalformed
+	}
+	ad, err := rp.parseAuthData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, ErrCredential
+	}
+	if _, err := parseKey(ad.publicKey); err != nil {
+		return nil, err
+	}
+	return &Credential{ID: bytes.Clone(ad.credentialID), PublicKey: bytes.Clone(ad.publicKey), SignCount: ad.signCount}, nil
+}
+
+// VerifyAssertion checks a login signature of the credential and returns the new signature counter
+func (rp *RelyingParty) VerifyAssertion(challenge []byte, cred Credential, clientDataJSON, authenticatorData, signature []byte) (uint32, error) {
+	if err := rp.verifyClientData(clientDataJSON, challenge, "webauthn.get"); err != nil {
+		return 0, err
+	}
+	ad, err := rp.parseAuthData(authenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	key, err := parseKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientHash := sha256.Sum256(clientDataJSON)
+	signed := append(bytes.Clone(authenticatorData), clientHash[:]...)
+	if !key.verify(signed, signature) {
+		return 0, ErrSignature
+	}
+	//Authenticators without a counter always send zero
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return 0, ErrSignCount
+	}
+	return ad.signCount, nil
+}
+
+type publicKey struct {
+	alg int64
+	ec  *ecdsa.PublicKey
+	ed  ed25519.PublicKey
+	rsa *rsa.PublicKey
+}
+
+func (k *publicKey) verify(data, sig []byte) bool {
+	switch k.alg {
+	case AlgES256:
+		digest := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(k.ec, digest[:], sig)
+	case AlgEdDSA:
+		return ed25519.Verify(k.ed, data, sig)
+	case AlgRS256:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(k.rsa, crypto.SHA256, digest[:], sig) == nil
+	}
+	return false
+}
+
+// parseKey reads a COSE_Key of RFC 9053
+func parseKey(b []byte) (*publicKey, error) {
+	obj, rest, err := decodeCBOR(b)
+	if err != nil || len(rest) != 0 {
+		return nil, ErrKey
+	}
+	m, ok := obj.(map[any]any)
+	if !ok {
+		return nil, ErrKey
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == AlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, ErrKey
+		}
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, ErrKey
+		}
+		k := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return &publicKey{alg: alg, ec: k}, nil
+	case kty == 1 && alg == AlgEdDSA:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, ErrKey
+		}
+		return &publicKey{alg: alg, ed: ed25519.PublicKey(x)}, nil
+	case kty == 3 && alg == AlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, ErrKey
+		}
+		exp := int(new(big.Int).SetBytes(e).Int64())
+		return &publicKey{alg: alg, rsa: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}}, nil
+	}
+	return nil, ErrKey
+}
@@ -0,0 +1,305 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// encodeCBOR is enough CBOR for test authenticators. Map keys are written in the given order
+func encodeCBOR(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		default:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		}
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []any:
+		b := head(4, uint64(len(v)))
+		for _, item := range v {
+			b = append(b, encodeCBOR(item)...)
+		}
+		return b
+	case [][2]any:
+		b := head(5, uint64(len(v)))
+		for _, kv := range v {
+			b = append(b, encodeCBOR(kv[0])...)
+			b = append(b, encodeCBOR(kv[1])...)
+		}
+		return b
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	}
+	panic("unsupported type")
+}
+
+// authenticator is a software passkey
+type authenticator struct {
+	rpID    string
+	id      []byte
+	ec      *ecdsa.PrivateKey
+	ed      ed25519.PrivateKey
+	counter uint32
+	flags   byte
+}
+
+func newAuthenticator(t *testing.T, rpID string, ed bool) *authenticator {
+	a := &authenticator{rpID: rpID, id: make([]byte, 16), flags: flagUserPresent | flagUserVerified}
+	rand.Read(a.id)
+	var err error
+	if ed {
+		_, a.ed, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		a.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func (a *authenticator) coseKey() []byte {
+	if a.ed != nil {
+		return encodeCBOR([][2]any{{1, 1}, {3, int(AlgEdDSA)}, {-1, 6}, {-2, []byte(a.ed.Public().(ed25519.PublicKey))}})
+	}
+	x, y := make([]byte, 32), make([]byte, 32)
+	a.ec.X.FillBytes(x)
+	a.ec.Y.FillBytes(y)
+	return encodeCBOR([][2]any{{1, 2}, {3, int(AlgES256)}, {-1, 1}, {-2, x}, {-3, y}})
+}
+
+func (a *authenticator) authData(attested bool) []byte {
+	h := sha256.Sum256([]byte(a.rpID))
+	b := append(h[:], a.flags)
+	b = binary.BigEndian.AppendUint32(b, a.counter)
+	if attested {
+		b[32] |= flagAttested
+		b = append(b, make([]byte, 16)...) //AAGUID
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.id)))
+		b = append(b, a.id...)
+		b = append(b, a.coseKey()...)
+	}
+	return b
+}
+
+func clientDataJSON(ceremony string, challenge []byte, origin string) []byte {
+	b, _ := json.Marshal(map[string]any{"type": ceremony, "challenge": Encode(challenge), "origin": origin, "crossOrigin": false})
+	return b
+}
+
+func (a *authenticator) create(challenge []byte, origin string) (cd, attestation []byte) {
+	cd = clientDataJSON("webauthn.create", challenge, origin)
+	attestation = encodeCBOR([][2]any{{"fmt", "none"}, {"attStmt", [][2]any{}}, {"authData", a.authData(true)}})
+	return cd, attestation
+}
+
+func (a *authenticator) get(t *testing.T, challenge []byte, origin string) (cd, ad, sig []byte) {
+	a.counter++
+	cd = clientDataJSON("webauthn.get", challenge, origin)
+	ad = a.authData(false)
+	h := sha256.Sum256(cd)
+	signed := append(slices.Clone(ad), h[:]...)
+	if a.ed != nil {
+		return cd, ad, ed25519.Sign(a.ed, signed)
+	}
+	digest := sha256.Sum256(signed)
+	sig, err := ecdsa.SignASN1(rand.Reader, a.ec, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cd, ad, sig
+}
+
+var testRP = &RelyingParty{ID: "movies.example.com", Name: "Movie DB", Origin: "https://movies.example.com"}
+
+func TestCeremonies(t *testing.T) {
+	for _, ed := range []bool{false, true} {
+		name := "ES256"
+		if ed {
+			name = "EdDSA"
+		}
+		t.Run(name, func(t *testing.T) {
+			a := newAuthenticator(t, testRP.ID, ed)
+			challenge, _ := NewChallenge()
+			cd, att := a.create(challenge, testRP.Origin)
+			if got, err := ClientChallenge(cd); err != nil || !bytes.Equal(got, challenge) {
+				t.Fatalf("ClientChallenge() = %x, %v", got, err)
+			}
+			cred, err := testRP.VerifyRegistration(challenge, cd, att)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(cred.ID, a.id) {
+				t.Fatalf("credential id %x, want %x", cred.ID, a.id)
+			}
+			for i := range 2 {
+				challenge, _ = NewChallenge()
+				cd, ad, sig := a.get(t, challenge, testRP.Origin)
+				count, err := testRP.VerifyAssertion(challenge, *cred, cd, ad, sig)
+				if err != nil {
+					t.Fatalf("assertion %d: %s", i, err)
+				}
+				cred.SignCount = count
+			}
+			//Replayed assertion has an old counter
+			challenge, _ = NewChallenge()
+			a.counter = 0
+			cd, ad, sig := a.get(t, challenge, testRP.Origin)
+			if _, err := testRP.VerifyAssertion(challenge, *cred, cd, ad, sig); err != ErrSignCount {
+				t.Errorf("got %v, want %v", err, ErrSignCount)
+			}
+		})
+	}
+}
+
+func TestAssertionErrors(t *testing.T) {
+	a := newAuthenticator(t, testRP.ID, false)
+	challenge, _ := NewChallenge()
+	cd, att := a.create(challenge, testRP.Origin)
+	cred, err := testRP.VerifyRegistration(challenge, cd, att)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newAuthenticator(t, testRP.ID, false)
+	tests := []struct {
+		name   string
+		modify func(challenge *[]byte, cd, ad, sig *[]byte)
+		want   error
+	}{
+		{"wrong challenge", func(c *[]byte, cd, ad, sig *[]byte) { *c = []byte("other") }, ErrChallenge},
+		{"wrong origin", func(c *[]byte, cd, ad, sig *[]byte) {
+			*cd = clientDataJSON("webauthn.get", *c, "https://evil.example.com")
+		}, ErrOrigin},
+		{"registration data", func(c *[]byte, cd, ad, sig *[]byte) {
+			*cd = clientDataJSON("webauthn.create", *c, testRP.Origin)
+		}, ErrType},
+		{"tampered data", func(c *[]byte, cd, ad, sig *[]byte) { (*ad)[36]++ }, ErrSignature},
+		{"other key", func(c *[]byte, cd, ad, sig *[]byte) { _, _, *sig = other.get(t, *c, testRP.Origin) }, ErrSignature},
+		{"not verified", func(c *[]byte, cd, ad, sig *[]byte) { (*ad)[32] &^= flagUserVerified }, ErrUser},
+		{"other site", func(c *[]byte, cd, ad, sig *[]byte) { (*ad)[0]++ }, ErrRPID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			challenge, _ := NewChallenge()
+			cd, ad, sig := a.get(t, challenge, testRP.Origin)
+			tt.modify(&challenge, &cd, &ad, &sig)
+			if _, err := testRP.VerifyAssertion(challenge, *cred, cd, ad, sig); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistrationErrors(t *testing.T) {
+	a := newAuthenticator(t, testRP.ID, false)
+	challenge, _ := NewChallenge()
+	cd, att := a.create(challenge, testRP.Origin)
+	if _, err := testRP.VerifyRegistration(challenge, clientDataJSON("webauthn.get", challenge, testRP.Origin), att); err != ErrType {
+		t.Errorf("got %v, want %v", err, ErrType)
+	}
+	if _, err := testRP.VerifyRegistration(challenge, cd, att[:len(att)-5]); err == nil {
+		t.Errorf("truncated attestation accepted")
+	}
+	a.flags = flagUserPresent
+	cd, att = a.create(challenge, testRP.Origin)
+	if _, err := testRP.VerifyRegistration(challenge, cd, att); err != ErrUser {
+		t.Errorf("got %v, want %v", err, ErrUser)
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		want    any
+		wantErr bool
+	}{
+		{"small int", []byte{0x17}, int64(23), false},
+		{"uint16", []byte{0x19, 0x01, 0x00}, int64(256), false},
+		{"negative", []byte{0x38, 0x18}, int64(-25), false},
+		{"bytes", []byte{0x42, 1, 2}, []byte{1, 2}, false},
+		{"text", []byte{0x63, 'a', 'b', 'c'}, "abc", false},
+		{"array", []byte{0x82, 0x01, 0xf5}, []any{int64(1), true}, false},
+		{"map", []byte{0xa1, 0x20, 0x61, 'x'}, map[any]any{int64(-1): "x"}, false},
+		{"truncated", []byte{0x43, 1}, nil, true},
+		{"huge array", []byte{0x9a, 0xff, 0xff, 0xff, 0xff}, nil, true},
+		{"indefinite", []byte{0x5f}, nil, true},
+		{"array key", []byte{0xa1, 0x80, 0x01}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := decodeCBOR(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			gotJSON, _ := json.Marshal(normalize(got))
+			wantJSON, _ := json.Marshal(normalize(tt.want))
+			if !bytes.Equal(gotJSON, wantJSON) {
+				t.Errorf("got %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+// normalize turns maps with any keys into comparable JSON
+func normalize(v any) any {
+	switch v := v.(type) {
+	case map[any]any:
+		m := map[string]any{}
+		for k, val := range v {
+			kj, _ := json.Marshal(k)
+			m[string(kj)] = normalize(val)
+		}
+		return m
+	case []any:
+		for i := range v {
+			v[i] = normalize(v[i])
+		}
+	}
+	return v
+}
+
+func TestOptions(t *testing.T) {
+	challenge := []byte{1, 2, 3}
+	opts := testRP.CreationOptions(User{ID: []byte{7}, Name: "someone"}, challenge, [][]byte{{9}})
+	b, err := json.Marshal(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"challenge":"AQID"`, `"id":"Bw"`, `"excludeCredentials":[{"type":"public-key","id":"CQ"}]`, `"residentKey":"required"`} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Errorf("options %s don't contain %s", b, want)
+		}
+	}
+	req, _ := json.Marshal(testRP.RequestOptions(challenge, nil))
+	if !bytes.Contains(req, []byte(`"allowCredentials":[]`)) || !bytes.Contains(req, []byte(`"rpId":"movies.example.com"`)) {
+		t.Errorf("unexpected request options %s", req)
+	}
+}